@@ -3,9 +3,14 @@ package drogue
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
 
-	"github.com/txsvc/apikit/config"
 	"github.com/txsvc/stdlib/v2"
 
 	"github.com/redhat-partner-ecosystem/shadowcar/internal"
@@ -15,27 +20,54 @@ import (
 const (
 	DrogueHttpEndpoint            = "DROGUE_HTTP_ENDPOINT"
 	DrogueHttpIntegrationEndpoint = "DROGUE_HTTP_INTEGRATION_ENDPOINT"
+	DrogueTokenURL                = "DROGUE_TOKEN_URL"
 
-	DrogueClientID     = "DROGUE_CLIENT_ID"
-	DrogueClientSecret = "DROGUE_CLIENT_SECRET"
-	DrogueAccessToken  = "DROGUE_ACCESS_TOKEN"
+	DrogueClientID       = "DROGUE_CLIENT_ID"
+	DrogueClientSecret   = "DROGUE_CLIENT_SECRET"
+	DrogueAccessToken    = "DROGUE_ACCESS_TOKEN"
+	DrogueCredentialsDir = "DROGUE_CREDENTIALS_DIR" // files with the credentials, see internal.FileCredentials
 
+	DrogueService  = "drogue" // the service name used in profiles
 	DrogueApiAgent = "shadowcar/drogue"
+
+	// MaxModifyAttempts limits how often ModifyDevice retries after a conflict
+	MaxModifyAttempts = 5
+	// ModifyBackoff is the delay before the first retry, it doubles with each attempt plus up to the same amount of jitter
+	ModifyBackoff = 20 * time.Millisecond
+
+	// DefaultApplication is used by the tools and services unless configured otherwise
+	DefaultApplication = "bobbycar"
+
+	// API routes, also used to label the request metrics
+	pathTokens       = "/api/tokens/v1alpha1"
+	pathToken        = "/api/tokens/v1alpha1/%s"
+	pathApplications = "/api/registry/v1alpha1/apps"
+	pathApplication  = "/api/registry/v1alpha1/apps/%s"
+	pathDevices      = "/api/registry/v1alpha1/apps/%s/devices"
+	pathDevice       = "/api/registry/v1alpha1/apps/%s/devices/%s"
 )
 
 type (
 	DrogueClient struct {
-		rc internal.RestClient
+		rc *internal.RestClient
 	}
 )
 
 func NewDrogueClient(ctx context.Context, opts ...internal.ClientOption) (*DrogueClient, error) {
 
-	httpClient := internal.NewLoggingTransport(http.DefaultTransport)
 	ds := &settings.DialSettings{
+		Service:     DrogueService,
 		Endpoint:    stdlib.GetString(DrogueHttpEndpoint, ""),
+		TokenURL:    stdlib.GetString(DrogueTokenURL, ""),
 		UserAgent:   DrogueApiAgent,
 		Credentials: LoadCredentials(),
+		TLS:         internal.TLSSettingsFromEnv(""),
+
+		CredentialsDir: stdlib.GetString(DrogueCredentialsDir, ""),
+	}
+
+	if err := internal.ApplyProfileFromEnv(ds, opts...); err != nil {
+		return nil, err
 	}
 
 	// apply options
@@ -45,6 +77,10 @@ func NewDrogueClient(ctx context.Context, opts ...internal.ClientOption) (*Drogu
 		}
 	}
 
+	if err := internal.ResolveCredentials(ctx, ds); err != nil {
+		return nil, err
+	}
+
 	// do some basic validation
 	if ds.Endpoint == "" {
 		return nil, fmt.Errorf("missing DROGUE_HTTP_ENDPOINT")
@@ -54,12 +90,13 @@ func NewDrogueClient(ctx context.Context, opts ...internal.ClientOption) (*Drogu
 		return nil, fmt.Errorf("missing DROGUE_CLIENT_SECRET")
 	}
 
+	rc, err := internal.NewRestClientFromSettings(ds)
+	if err != nil {
+		return nil, err
+	}
+
 	return &DrogueClient{
-		rc: internal.RestClient{
-			HttpClient: httpClient,
-			Settings:   ds,
-			Trace:      stdlib.GetString(config.ForceTraceENV, ""),
-		},
+		rc: rc,
 	}, nil
 }
 
@@ -75,53 +112,229 @@ func LoadCredentials() *settings.Credentials {
 	return c
 }
 
-func (c *DrogueClient) GetAccessToken() (int, Tokens) {
+func (c *DrogueClient) GetAccessToken() (int, Tokens, error) {
+	return c.GetAccessTokenWithContext(context.Background())
+}
+
+func (c *DrogueClient) GetAccessTokenWithContext(ctx context.Context) (int, Tokens, error) {
 	var resp Tokens
 
-	status, _ := c.rc.GET("/api/tokens/v1alpha1", &resp)
-	if status != http.StatusOK {
-		return status, nil
+	status, err := c.rc.GETWithContext(internal.WithRoute(ctx, pathTokens), pathTokens, &resp)
+	if err != nil {
+		return status, nil, err
+	}
+
+	return status, resp, nil
+}
+
+func (c *DrogueClient) CreateAccessToken(description string) (int, Token, error) {
+	return c.CreateAccessTokenWithContext(context.Background(), description)
+}
+
+// CreateAccessTokenWithContext creates a token for the current user. Token.Token is only returned once, the registry keeps just its prefix.
+func (c *DrogueClient) CreateAccessTokenWithContext(ctx context.Context, description string) (int, Token, error) {
+	var resp Token
+
+	uri := pathTokens
+	if description != "" {
+		uri = fmt.Sprintf("%s?%s", pathTokens, url.Values{"description": []string{description}}.Encode())
+	}
+
+	status, err := c.rc.POSTWithContext(internal.WithRoute(ctx, pathTokens), uri, nil, &resp)
+	if err != nil {
+		return status, Token{}, err
+	}
+	resp.Description = description
+
+	return status, resp, nil
+}
+
+func (c *DrogueClient) DeleteAccessToken(prefix string) (int, error) {
+	return c.DeleteAccessTokenWithContext(context.Background(), prefix)
+}
+
+func (c *DrogueClient) DeleteAccessTokenWithContext(ctx context.Context, prefix string) (int, error) {
+	return c.rc.DELETEWithContext(internal.WithRoute(ctx, pathToken), fmt.Sprintf(pathToken, url.PathEscape(prefix)), nil, nil)
+}
+
+func (c *DrogueClient) RotateAccessToken(description string) (int, Token, error) {
+	return c.RotateAccessTokenWithContext(context.Background(), description)
+}
+
+// RotateAccessTokenWithContext creates a new token, switches the client over to it and then deletes the token the client used before.
+// This requires a client that authenticates with an access token, see internal.RestClient.SetCredentials.
+// Once the client uses the new token, the rotation succeeded: if the old token can not be deleted, a warning is logged
+// and the new token is still returned without an error.
+func (c *DrogueClient) RotateAccessTokenWithContext(ctx context.Context, description string) (int, Token, error) {
+	current := c.rc.Settings.CredentialsProvider
+	if current == nil || c.rc.Settings.TokenSource != nil {
+		return http.StatusBadRequest, Token{}, fmt.Errorf("the client does not use an access token")
+	}
+	old := current.Credentials().Clone()
+
+	status, token, err := c.CreateAccessTokenWithContext(ctx, description)
+	if err != nil {
+		return status, Token{}, err
+	}
+
+	creds := old.Clone()
+	creds.Token = token.Token
+	if err := c.rc.SetCredentials(creds); err != nil {
+		c.DeleteAccessTokenWithContext(ctx, token.Prefix) // don't leave an unused token behind, ignore the outcome
+		return http.StatusBadRequest, Token{}, err
+	}
+
+	if err := c.deleteAccessTokenOf(ctx, old.Token, token.Prefix); err != nil {
+		log.Warn().Err(err).Str("prefix", token.Prefix).Msg("access token rotated, the previous token is left behind")
+	}
+	return status, token, nil
+}
+
+// deleteAccessTokenOf deletes the token secret, it is identified by its prefix. The token with prefix keep is never deleted.
+func (c *DrogueClient) deleteAccessTokenOf(ctx context.Context, secret, keep string) error {
+	_, tokens, err := c.GetAccessTokenWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if t.Prefix != "" && t.Prefix != keep && strings.HasPrefix(secret, t.Prefix) {
+			_, err := c.DeleteAccessTokenWithContext(ctx, t.Prefix)
+			return err
+		}
+	}
+	return fmt.Errorf("previous access token not found")
+}
+
+func (c *DrogueClient) GetAllApplications() (int, Applications, error) {
+	return c.GetAllApplicationsWithContext(context.Background())
+}
+
+func (c *DrogueClient) GetAllApplicationsWithContext(ctx context.Context) (int, Applications, error) {
+	var resp Applications
+
+	status, err := c.rc.GETWithContext(internal.WithRoute(ctx, pathApplications), pathApplications, &resp)
+	if err != nil {
+		return status, nil, err
+	}
+
+	return status, resp, nil
+}
+
+func (c *DrogueClient) GetApplication(name string) (int, Application, error) {
+	return c.GetApplicationWithContext(context.Background(), name)
+}
+
+func (c *DrogueClient) GetApplicationWithContext(ctx context.Context, name string) (int, Application, error) {
+	var resp Application
+
+	status, err := c.rc.GETWithContext(internal.WithRoute(ctx, pathApplication), fmt.Sprintf(pathApplication, name), &resp)
+	if err != nil {
+		return status, Application{}, err
+	}
+	return status, resp, nil
+}
+
+func (c *DrogueClient) CreateApplication(app *Application) (int, Application, error) {
+	return c.CreateApplicationWithContext(context.Background(), app)
+}
+
+func (c *DrogueClient) CreateApplicationWithContext(ctx context.Context, app *Application) (int, Application, error) {
+	status, err := c.rc.POSTWithContext(internal.WithRoute(ctx, pathApplications), pathApplications, app, nil)
+	if err != nil {
+		return status, Application{}, err
+	}
+
+	status, newApp, err := c.GetApplicationWithContext(ctx, app.Metadata.Name)
+	if err != nil {
+		return status, Application{}, err
 	}
 
-	return status, resp
+	return http.StatusCreated, newApp, nil
+}
+
+func (c *DrogueClient) UpdateApplication(app *Application, refresh bool) (int, Application, error) {
+	return c.UpdateApplicationWithContext(context.Background(), app, refresh)
 }
 
-func (c *DrogueClient) GetAllDevices(application string) (int, Devices) {
+func (c *DrogueClient) UpdateApplicationWithContext(ctx context.Context, app *Application, refresh bool) (int, Application, error) {
+	status, err := c.rc.PUTWithContext(internal.WithRoute(ctx, pathApplication), fmt.Sprintf(pathApplication, app.Metadata.Name), app, nil)
+	if err != nil {
+		return status, Application{}, err
+	}
+
+	if !refresh {
+		return http.StatusNoContent, Application{}, nil
+	}
+
+	status, newApp, err := c.GetApplicationWithContext(ctx, app.Metadata.Name)
+	if err != nil {
+		return status, Application{}, err
+	}
+
+	return http.StatusNoContent, newApp, nil
+}
+
+// DeleteApplication deletes the application and, asynchronously, all its devices
+func (c *DrogueClient) DeleteApplication(name string) (int, error) {
+	return c.DeleteApplicationWithContext(context.Background(), name)
+}
+
+func (c *DrogueClient) DeleteApplicationWithContext(ctx context.Context, name string) (int, error) {
+	return c.rc.DELETEWithContext(internal.WithRoute(ctx, pathApplication), fmt.Sprintf(pathApplication, name), nil, nil)
+}
+
+func (c *DrogueClient) GetAllDevices(application string) (int, Devices, error) {
+	return c.GetAllDevicesWithContext(context.Background(), application)
+}
+
+func (c *DrogueClient) GetAllDevicesWithContext(ctx context.Context, application string) (int, Devices, error) {
 	var resp Devices
 
-	status, _ := c.rc.GET(fmt.Sprintf("/api/registry/v1alpha1/apps/%s/devices", application), &resp)
-	if status != http.StatusOK {
-		return status, nil
+	status, err := c.rc.GETWithContext(internal.WithRoute(ctx, pathDevices), fmt.Sprintf(pathDevices, application), &resp)
+	if err != nil {
+		return status, nil, err
 	}
 
-	return status, resp
+	return status, resp, nil
+}
+
+func (c *DrogueClient) GetDevice(application, name string) (int, Device, error) {
+	return c.GetDeviceWithContext(context.Background(), application, name)
 }
 
-func (c *DrogueClient) GetDevice(application, name string) (int, Device) {
+func (c *DrogueClient) GetDeviceWithContext(ctx context.Context, application, name string) (int, Device, error) {
 	var resp Device
 
-	status, _ := c.rc.GET(fmt.Sprintf("/api/registry/v1alpha1/apps/%s/devices/%s", application, name), &resp)
-	if status != http.StatusOK {
-		return status, Device{}
+	status, err := c.rc.GETWithContext(internal.WithRoute(ctx, pathDevice), fmt.Sprintf(pathDevice, application, name), &resp)
+	if err != nil {
+		return status, Device{}, err
 	}
-	return status, resp
+	return status, resp, nil
 }
 
-func (c *DrogueClient) CreateDevice(application string, device *Device) (int, Device) {
-	status, _ := c.rc.POST(fmt.Sprintf("/api/registry/v1alpha1/apps/%s/devices", application), device, nil)
-	if status != http.StatusCreated {
-		return status, Device{}
+func (c *DrogueClient) CreateDevice(application string, device *Device) (int, Device, error) {
+	return c.CreateDeviceWithContext(context.Background(), application, device)
+}
+
+func (c *DrogueClient) CreateDeviceWithContext(ctx context.Context, application string, device *Device) (int, Device, error) {
+	status, err := c.rc.POSTWithContext(internal.WithRoute(ctx, pathDevices), fmt.Sprintf(pathDevices, application), device, nil)
+	if err != nil {
+		return status, Device{}, err
 	}
 
-	status, newDevice := c.GetDevice(application, device.Metadata.Name)
-	if status == http.StatusOK {
-		return http.StatusCreated, newDevice
+	status, newDevice, err := c.GetDeviceWithContext(ctx, application, device.Metadata.Name)
+	if err != nil {
+		return status, Device{}, err
 	}
 
-	return status, Device{}
+	return http.StatusCreated, newDevice, nil
+}
+
+func (c *DrogueClient) RegisterDevice(application, name, user, password string) (int, Device, error) {
+	return c.RegisterDeviceWithContext(context.Background(), application, name, user, password)
 }
 
-func (c *DrogueClient) RegisterDevice(application, name, user, password string) (int, Device) {
+func (c *DrogueClient) RegisterDeviceWithContext(ctx context.Context, application, name, user, password string) (int, Device, error) {
 	req := Device{
 		Metadata: &ScopedMetadata{
 			Name:        name,
@@ -149,28 +362,93 @@ func (c *DrogueClient) RegisterDevice(application, name, user, password string)
 		}
 	}
 
-	return c.CreateDevice(application, &req)
+	return c.CreateDeviceWithContext(ctx, application, &req)
 }
 
-func (c *DrogueClient) UpdateDevice(application string, device *Device, refresh bool) (int, Device) {
-	status, _ := c.rc.PUT(fmt.Sprintf("/api/registry/v1alpha1/apps/%s/devices/%s", application, device.Metadata.Name), device, nil)
-	if status != http.StatusNoContent {
-		return status, Device{}
+func (c *DrogueClient) UpdateDevice(application string, device *Device, refresh bool) (int, Device, error) {
+	return c.UpdateDeviceWithContext(context.Background(), application, device, refresh)
+}
+
+// UpdateDeviceWithContext replaces the device. The update is rejected with a ConflictError if the device's
+// resource version is set and the device was modified since, an empty resource version overwrites any changes.
+func (c *DrogueClient) UpdateDeviceWithContext(ctx context.Context, application string, device *Device, refresh bool) (int, Device, error) {
+	status, err := c.rc.PUTWithContext(internal.WithRoute(ctx, pathDevice), fmt.Sprintf(pathDevice, application, device.Metadata.Name), device, nil)
+	if err != nil {
+		if internal.IsConflict(err) {
+			err = &ConflictError{
+				Application:     application,
+				Name:            device.Metadata.Name,
+				ResourceVersion: device.Metadata.ResourceVersion,
+				Err:             err,
+			}
+		}
+		return status, Device{}, err
 	}
 
 	if !refresh {
-		return http.StatusNoContent, Device{}
+		return http.StatusNoContent, Device{}, nil
 	}
 
-	status, newDevice := c.GetDevice(application, device.Metadata.Name)
-	if status == http.StatusOK {
-		return http.StatusNoContent, newDevice
+	status, newDevice, err := c.GetDeviceWithContext(ctx, application, device.Metadata.Name)
+	if err != nil {
+		return status, Device{}, err
 	}
 
-	return status, Device{}
+	return http.StatusNoContent, newDevice, nil
+}
+
+func (c *DrogueClient) ModifyDevice(application, name string, modify func(*Device) error) (int, Device, error) {
+	return c.ModifyDeviceWithContext(context.Background(), application, name, modify)
+}
+
+// ModifyDeviceWithContext reads the device, applies modify and writes it back. If the device was modified
+// concurrently, it is read again and modify is applied to the new version, up to MaxModifyAttempts times.
+// modify must not have other side effects, an error returned by modify aborts without an update.
+func (c *DrogueClient) ModifyDeviceWithContext(ctx context.Context, application, name string, modify func(*Device) error) (int, Device, error) {
+	var err error
+
+	for attempt := 1; attempt <= MaxModifyAttempts; attempt++ {
+		var status int
+		var device Device
+
+		status, device, err = c.GetDeviceWithContext(ctx, application, name)
+		if err != nil {
+			return status, Device{}, err
+		}
+
+		if err := modify(&device); err != nil {
+			return http.StatusBadRequest, Device{}, err
+		}
+
+		status, _, err = c.UpdateDeviceWithContext(ctx, application, &device, false)
+		if err == nil {
+			return status, device, nil
+		}
+		if !IsConflict(err) {
+			return status, Device{}, err
+		}
+
+		// back off a little, the other writer is likely still busy
+		select {
+		case <-ctx.Done():
+			return http.StatusRequestTimeout, Device{}, ctx.Err()
+		case <-time.After(modifyBackoff(attempt)):
+		}
+	}
+
+	return http.StatusConflict, Device{}, err
+}
+
+// modifyBackoff spreads the retries of concurrent writers, it is never shorter than ModifyBackoff
+func modifyBackoff(attempt int) time.Duration {
+	base := ModifyBackoff << (attempt - 1)
+	return base + time.Duration(rand.Int63n(int64(base)))
+}
+
+func (c *DrogueClient) DeleteDevice(application, name string) (int, error) {
+	return c.DeleteDeviceWithContext(context.Background(), application, name)
 }
 
-func (c *DrogueClient) DeleteDevice(application, name string) int {
-	status, _ := c.rc.DELETE(fmt.Sprintf("/api/registry/v1alpha1/apps/%s/devices/%s", application, name), nil, nil)
-	return status
+func (c *DrogueClient) DeleteDeviceWithContext(ctx context.Context, application, name string) (int, error) {
+	return c.rc.DELETEWithContext(internal.WithRoute(ctx, pathDevice), fmt.Sprintf(pathDevice, application, name), nil, nil)
 }
@@ -2,10 +2,16 @@ package drogue
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/redhat-partner-ecosystem/shadowcar/internal"
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 )
@@ -25,11 +31,32 @@ func init() {
 	//zerolog.SetGlobalLevel(zerolog.InfoLevel)
 }
 
+// newCassetteClient replays testdata/<test>.json. To record it against a live registry,
+// run the test with CASSETTE_MODE=record and the usual DROGUE_* environment.
+func newCassetteClient(t *testing.T) *DrogueClient {
+	c, err := internal.NewCassetteFromEnv(filepath.Join("testdata", t.Name()+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := []internal.ClientOption{internal.WithCassette(c)}
+	if c.Mode == internal.CassetteRecord {
+		t.Cleanup(func() { assert.NoError(t, c.Save()) })
+	} else {
+		opts = append(opts, internal.WithEndpoint(internal.ReplayEndpoint), internal.WithCredentials("foo", "bar"), internal.WithTokenURL(""))
+	}
+
+	cl, err := NewDrogueClient(context.TODO(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cl
+}
+
 func TestNewDrogueClient(t *testing.T) {
 
-	cl, err := NewDrogueClient(context.TODO())
+	cl := newCassetteClient(t)
 	assert.NotNil(t, cl)
-	assert.NoError(t, err)
 
 	assert.NotNil(t, cl.rc.HttpClient)
 	assert.NotNil(t, cl.rc.Settings)
@@ -61,7 +88,8 @@ func _TestGetAccessToken(t *testing.T) {
 	cl, _ := NewDrogueClient(context.TODO())
 	assert.NotNil(t, cl)
 
-	status, resp := cl.GetAccessToken()
+	status, resp, err := cl.GetAccessToken()
+	assert.NoError(t, err)
 	assert.NotNil(t, resp)
 	assert.NotEmpty(t, resp)
 	assert.Equal(t, http.StatusOK, status)
@@ -69,13 +97,12 @@ func _TestGetAccessToken(t *testing.T) {
 	//fmt.Println(resp)
 }
 
-/*
 func TestGetAllDevices(t *testing.T) {
 
-	cl, _ := NewDrogueClient(context.TODO())
-	assert.NotNil(t, cl)
+	cl := newCassetteClient(t)
 
-	status, resp := cl.GetAllDevices(application)
+	status, resp, err := cl.GetAllDevices(application)
+	assert.NoError(t, err)
 	assert.NotNil(t, resp)
 	assert.NotEmpty(t, resp)
 	assert.Equal(t, http.StatusOK, status)
@@ -83,17 +110,17 @@ func TestGetAllDevices(t *testing.T) {
 	//fmt.Println(resp)
 }
 
-
 func TestGetDevice(t *testing.T) {
-	cl, _ := NewDrogueClient(context.TODO())
-	assert.NotNil(t, cl)
+	cl := newCassetteClient(t)
 
-	status, devices := cl.GetAllDevices(application)
+	status, devices, err := cl.GetAllDevices(application)
+	assert.NoError(t, err)
 	assert.NotNil(t, devices)
 	assert.Equal(t, http.StatusOK, status)
 
 	if len(devices) > 0 {
-		status, resp := cl.GetDevice(application, devices[0].Metadata.Name)
+		status, resp, err := cl.GetDevice(application, devices[0].Metadata.Name)
+		assert.NoError(t, err)
 
 		assert.NotNil(t, resp)
 		assert.NotEmpty(t, resp)
@@ -106,8 +133,7 @@ func TestGetDevice(t *testing.T) {
 }
 
 func TestCreateDevice(t *testing.T) {
-	cl, _ := NewDrogueClient(context.TODO())
-	assert.NotNil(t, cl)
+	cl := newCassetteClient(t)
 
 	device := Device{
 		Metadata: &ScopedMetadata{
@@ -121,64 +147,65 @@ func TestCreateDevice(t *testing.T) {
 		},
 	}
 
-	status, newDevice := cl.CreateDevice(application, &device)
+	status, newDevice, err := cl.CreateDevice(application, &device)
+	assert.NoError(t, err)
 	assert.Equal(t, http.StatusCreated, status)
 	assert.NotNil(t, newDevice)
 	assert.NotEmpty(t, newDevice)
 
 	// delete the device
-	status = cl.DeleteDevice(application, deviceName)
+	status, _ = cl.DeleteDevice(application, deviceName)
 	assert.Equal(t, http.StatusNoContent, status)
 }
 
 func TestRegisterAndDeleteDevice(t *testing.T) {
-	cl, _ := NewDrogueClient(context.TODO())
-	assert.NotNil(t, cl)
+	cl := newCassetteClient(t)
 
 	// create the device
-	status, device := cl.RegisterDevice(application, deviceName, "", "")
+	status, device, err := cl.RegisterDevice(application, deviceName, "", "")
+	assert.NoError(t, err)
 	assert.Equal(t, http.StatusCreated, status)
 	assert.NotNil(t, device)
 	assert.NotEmpty(t, device)
 
 	// double creation should fail
-	status, _ = cl.RegisterDevice(application, deviceName, "", "")
+	status, _, _ = cl.RegisterDevice(application, deviceName, "", "")
 	assert.Equal(t, http.StatusConflict, status)
 
 	// delete the device
-	status = cl.DeleteDevice(application, deviceName)
+	status, _ = cl.DeleteDevice(application, deviceName)
 	assert.Equal(t, http.StatusNoContent, status)
 
 	// delete again should fail, not found
-	status = cl.DeleteDevice(application, deviceName)
+	status, _ = cl.DeleteDevice(application, deviceName)
 	assert.Equal(t, http.StatusNotFound, status)
 }
 
 func TestRegisterDevicePass(t *testing.T) {
-	cl, _ := NewDrogueClient(context.TODO())
-	assert.NotNil(t, cl)
+	cl := newCassetteClient(t)
 
 	// create the device with pass phrase
-	status, device := cl.RegisterDevice(application, deviceName, "", devicePassword)
+	status, device, err := cl.RegisterDevice(application, deviceName, "", devicePassword)
+	assert.NoError(t, err)
 	assert.Equal(t, http.StatusCreated, status)
 	assert.NotNil(t, device)
 	assert.NotEmpty(t, device)
 	if device.Spec != nil {
-		assert.Equal(t, devicePassword, device.Spec.Authentication.Pass)
+		assert.NotEmpty(t, device.Spec.Authentication.Pass) // masked in the cassette
 		assert.Nil(t, device.Spec.Authentication.User)
 	}
 
 	// delete the device
-	status = cl.DeleteDevice(application, deviceName)
+	status, _ = cl.DeleteDevice(application, deviceName)
 	assert.Equal(t, http.StatusNoContent, status)
 }
 
 func TestRegisterDeviceUser(t *testing.T) {
-	cl, _ := NewDrogueClient(context.TODO())
-	assert.NotNil(t, cl)
+	cl := newCassetteClient(t)
 
 	// create the device with pass phrase
-	status, device := cl.RegisterDevice(application, deviceName, deviceUser, devicePassword)
+	status, device, err := cl.RegisterDevice(application, deviceName, deviceUser, devicePassword)
+	assert.NoError(t, err)
 	assert.Equal(t, http.StatusCreated, status)
 	assert.NotNil(t, device)
 	assert.NotEmpty(t, device)
@@ -186,22 +213,21 @@ func TestRegisterDeviceUser(t *testing.T) {
 		assert.Equal(t, "", device.Spec.Authentication.Pass)
 		assert.NotNil(t, device.Spec.Authentication.User)
 		assert.Equal(t, deviceUser, device.Spec.Authentication.User.Username)
-		assert.Equal(t, devicePassword, device.Spec.Authentication.User.Password)
+		assert.NotEmpty(t, device.Spec.Authentication.User.Password) // masked in the cassette
 	}
 
 	// delete the device
-	status = cl.DeleteDevice(application, deviceName)
+	status, _ = cl.DeleteDevice(application, deviceName)
 	assert.Equal(t, http.StatusNoContent, status)
 }
 
 func TestRegisterAndUpdateDevice(t *testing.T) {
-	cl, _ := NewDrogueClient(context.TODO())
-	assert.NotNil(t, cl)
+	cl := newCassetteClient(t)
 
-	status, device := cl.GetDevice(application, deviceName)
+	status, device, _ := cl.GetDevice(application, deviceName)
 	if status != http.StatusOK {
 		// create the device
-		status, device = cl.RegisterDevice(application, deviceName, "", "")
+		status, device, _ = cl.RegisterDevice(application, deviceName, "", "")
 		assert.Equal(t, http.StatusCreated, status)
 	}
 	assert.NotNil(t, device)
@@ -213,13 +239,346 @@ func TestRegisterAndUpdateDevice(t *testing.T) {
 	device.SetAnnotation("annotation1", "AA")
 	device.SetAnnotation("annotation2", "BB")
 
-	status, newDevice := cl.UpdateDevice(application, &device, true)
+	status, newDevice, err := cl.UpdateDevice(application, &device, true)
+	assert.NoError(t, err)
 	assert.Equal(t, http.StatusNoContent, status)
 	assert.NotNil(t, newDevice)
 	assert.NotEmpty(t, newDevice)
 
 	// delete the device
-	status = cl.DeleteDevice(application, deviceName)
+	status, _ = cl.DeleteDevice(application, deviceName)
 	assert.Equal(t, http.StatusNoContent, status)
 }
-*/
+
+func TestApplicationCRUD(t *testing.T) {
+	cl, _ := newFakeClient(t)
+
+	app := Application{
+		Metadata: &NonScopedMetadata{
+			Name: "demo-event",
+		},
+		Spec: &ApplicationSpec{
+			Kafka: &KafkaSpec{
+				External: &ExternalKafkaSpec{BootstrapServers: "kafka:9092"},
+			},
+		},
+	}
+	app.SetLabel("event", "demo")
+
+	status, created, err := cl.CreateApplication(&app)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "kafka:9092", created.Spec.Kafka.External.BootstrapServers)
+
+	_, _, err = cl.CreateApplication(&app)
+	assert.True(t, internal.IsConflict(err))
+
+	created.SetLabel("event", "other")
+	_, updated, err := cl.UpdateApplication(&created, true)
+	assert.NoError(t, err)
+	label, _ := updated.GetLabel("event")
+	assert.Equal(t, "other", label)
+
+	_, apps, err := cl.GetAllApplications()
+	assert.NoError(t, err)
+	assert.Len(t, apps, 1)
+
+	_, err = cl.DeleteApplication("demo-event")
+	assert.NoError(t, err)
+
+	_, _, err = cl.GetApplication("demo-event")
+	assert.True(t, internal.IsNotFound(err))
+}
+
+func TestModifyDevice(t *testing.T) {
+	cl, _ := newFakeClient(t)
+
+	_, _, err := cl.CreateApplication(&Application{Metadata: &NonScopedMetadata{Name: application}})
+	assert.NoError(t, err)
+	_, device, err := cl.RegisterDevice(application, deviceName, "", devicePassword)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, device.Metadata.ResourceVersion)
+
+	// a stale resource version is rejected
+	stale := device
+	_, _, err = cl.UpdateDevice(application, &device, false)
+	assert.NoError(t, err)
+	_, _, err = cl.UpdateDevice(application, &stale, false)
+	assert.True(t, IsConflict(err))
+	assert.True(t, internal.IsConflict(err))
+
+	// a concurrent update is not lost
+	attempts := 0
+	status, modified, err := cl.ModifyDevice(application, deviceName, func(d *Device) error {
+		attempts++
+		if attempts == 1 {
+			cl.ModifyDevice(application, deviceName, func(other *Device) error {
+				other.SetAnnotation("campaignStatus", "done")
+				return nil
+			})
+		}
+		d.SetAnnotation("campaign", "42")
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, status)
+	assert.Equal(t, 2, attempts)
+
+	campaign, _ := modified.GetAnnotation("campaign")
+	assert.Equal(t, "42", campaign)
+
+	_, device, err = cl.GetDevice(application, deviceName)
+	assert.NoError(t, err)
+	campaignStatus, _ := device.GetAnnotation("campaignStatus")
+	assert.Equal(t, "done", campaignStatus)
+
+	// modify can abort the update
+	_, _, err = cl.ModifyDevice(application, deviceName, func(d *Device) error {
+		return assert.AnError
+	})
+	assert.ErrorIs(t, err, assert.AnError)
+
+	_, _, err = cl.ModifyDevice(application, "unknown", func(d *Device) error { return nil })
+	assert.True(t, internal.IsNotFound(err))
+}
+
+func TestModifyBackoff(t *testing.T) {
+	for attempt := 1; attempt < MaxModifyAttempts; attempt++ {
+		base := ModifyBackoff << (attempt - 1)
+		for i := 0; i < 100; i++ {
+			d := modifyBackoff(attempt)
+			assert.GreaterOrEqual(t, d, base)
+			assert.Less(t, d, 2*base)
+		}
+	}
+}
+
+func TestListDevices(t *testing.T) {
+	cl, reg := newFakeClient(t)
+
+	_, _, err := cl.CreateApplication(&Application{Metadata: &NonScopedMetadata{Name: application}})
+	assert.NoError(t, err)
+
+	for i := 0; i < 7; i++ {
+		d := Device{Metadata: &ScopedMetadata{Name: fmt.Sprintf("car-%d", i), Application: application}}
+		if i%2 == 0 {
+			d.SetLabel("zone", "redhat")
+		}
+		_, _, err := cl.CreateDevice(application, &d)
+		assert.NoError(t, err)
+	}
+
+	opts := ListOptions{Labels: map[string]string{"zone": "redhat"}, Selector: "!archived"}
+	assert.Equal(t, "zone=redhat,!archived", opts.LabelSelector())
+
+	_, devices, err := cl.ListDevices(application, &opts)
+	assert.NoError(t, err)
+	assert.Len(t, devices, 4)
+
+	_, devices, err = cl.ListDevices(application, &ListOptions{Limit: 2, Offset: 5})
+	assert.NoError(t, err)
+	if assert.Len(t, devices, 2) {
+		assert.Equal(t, "car-5", devices[0].Metadata.Name)
+	}
+
+	_, devices, err = cl.ListDevices(application, &ListOptions{Names: []string{"car-1", "car-2"}})
+	assert.NoError(t, err)
+	assert.Len(t, devices, 2)
+
+	// the iterator fetches one page at a time
+	reg.queries = nil
+	it := cl.Devices(application, &ListOptions{Labels: map[string]string{"zone": "redhat"}, Limit: 3})
+	d, err := it.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "car-0", d.Metadata.Name)
+	assert.Len(t, reg.queries, 1)
+
+	all, err := it.All()
+	assert.NoError(t, err)
+	assert.Len(t, all, 3)
+	assert.Equal(t, []string{"labels=zone%3Dredhat&limit=3", "labels=zone%3Dredhat&limit=3&offset=3"}, reg.queries)
+
+	_, err = it.Next()
+	assert.Equal(t, Done, err)
+}
+
+func TestRotateAccessToken(t *testing.T) {
+	cl, reg := newFakeClient(t)
+
+	_, first, err := cl.CreateAccessToken("ci")
+	assert.NoError(t, err)
+	assert.Equal(t, first.Prefix+"_secret", first.Token)
+	assert.Equal(t, "ci", first.Description)
+
+	// switch to the first token, then rotate it
+	assert.NoError(t, cl.rc.SetCredentials(&settings.Credentials{UserID: "foo", Token: first.Token}))
+
+	_, second, err := cl.RotateAccessToken("ci")
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.Prefix, second.Prefix)
+
+	_, tokens, err := cl.GetAccessToken()
+	assert.NoError(t, err)
+	if assert.Len(t, tokens, 1) {
+		assert.Equal(t, second.Prefix, tokens[0].Prefix)
+	}
+	assert.Equal(t, second.Token, reg.password)
+
+	// the original password is not a token, the rotation still succeeds and the client uses the new token
+	assert.NoError(t, cl.rc.SetCredentials(&settings.Credentials{UserID: "foo", Token: "bar"}))
+	_, third, err := cl.RotateAccessToken("")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, third.Token)
+	_, tokens, err = cl.GetAccessToken()
+	assert.NoError(t, err)
+	assert.Len(t, tokens, 2)
+	assert.Equal(t, third.Token, reg.password)
+
+	status, err := cl.DeleteAccessToken("unknown")
+	assert.True(t, internal.IsNotFound(err))
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestConditionLastTransition(t *testing.T) {
+	var d Device
+	err := json.Unmarshal([]byte(`{"metadata":{"name":"car"},"status":{"conditions":[
+		{"type":"Ready","status":"True","lastTransitionTime":"2023-04-25T09:30:00Z"},
+		{"type":"Other","status":"Unknown","lastTransitionTime":""}]}}`), &d)
+	assert.NoError(t, err)
+
+	cond, ok := d.Condition(ConditionReady)
+	assert.True(t, ok)
+	assert.True(t, cond.IsTrue())
+	assert.Equal(t, time.Date(2023, 4, 25, 9, 30, 0, 0, time.UTC), cond.LastTransition())
+
+	cond, ok = d.Condition("Other")
+	assert.True(t, ok)
+	assert.True(t, cond.LastTransition().IsZero())
+}
+
+func TestWaitForDeviceCondition(t *testing.T) {
+	cl, _ := newFakeClient(t)
+
+	_, _, err := cl.CreateApplication(&Application{Metadata: &NonScopedMetadata{Name: application}})
+	assert.NoError(t, err)
+	_, device, err := cl.RegisterDevice(application, deviceName, "", devicePassword)
+	assert.NoError(t, err)
+	assert.False(t, device.Ready())
+
+	// the registry reports the device as ready a little later
+	ready := time.Now().UTC().Truncate(time.Second)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cl.ModifyDevice(application, deviceName, func(d *Device) error {
+			d.Status = &DeviceStatus{Conditions: []ConditionStruct{{Type: ConditionReady, Status: ConditionTrue, LastTransitionTime: ready.Format(time.RFC3339)}}}
+			return nil
+		})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, device, err = cl.WaitForDeviceCondition(ctx, application, deviceName, ConditionReady, ConditionTrue)
+	assert.NoError(t, err)
+	assert.True(t, device.Ready())
+	cond, ok := device.Condition(ConditionReady)
+	assert.True(t, ok)
+	assert.True(t, cond.LastTransition().Equal(ready))
+
+	// never happens
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, _, err = cl.WaitForDeviceCondition(ctx, application, deviceName, ConditionReady, ConditionFalse)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// the device doesn't exist yet
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cl.CreateDevice(application, &Device{
+			Metadata: &ScopedMetadata{Name: "late-car", Application: application},
+			Status:   &DeviceStatus{Conditions: []ConditionStruct{{Type: ConditionReady, Status: ConditionTrue}}},
+		})
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, device, err = cl.WaitForDeviceCondition(ctx, application, "late-car", ConditionReady, ConditionTrue)
+	assert.NoError(t, err)
+	assert.True(t, device.Ready())
+
+	// client errors end the wait
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	forbidden, err := NewDrogueClient(context.TODO(), internal.WithEndpoint(srv.URL), internal.WithCredentials("foo", "bar"))
+	assert.NoError(t, err)
+	status, _, err := forbidden.WaitForDeviceCondition(context.TODO(), application, deviceName, ConditionReady, ConditionTrue)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, status)
+}
+
+func TestPatchDevice(t *testing.T) {
+	cl, reg := newFakeClient(t)
+
+	_, _, err := cl.CreateApplication(&Application{Metadata: &NonScopedMetadata{Name: application}})
+	assert.NoError(t, err)
+	_, _, err = cl.RegisterDevice(application, deviceName, "car", devicePassword)
+	assert.NoError(t, err)
+	_, err = cl.SetDeviceAnnotations(application, deviceName, map[string]string{"campaign": "42", "campaignStatus": "done"})
+	assert.NoError(t, err)
+
+	// only the changed keys are sent
+	_, err = cl.SetDeviceLabels(application, deviceName, map[string]string{"zone": "redhat"})
+	assert.NoError(t, err)
+	_, err = cl.SetDeviceAnnotations(application, deviceName, map[string]string{"campaign": "43"})
+	assert.NoError(t, err)
+
+	_, device, err := cl.GetDevice(application, deviceName)
+	assert.NoError(t, err)
+	zone, _ := device.GetLabel("zone")
+	assert.Equal(t, "redhat", zone)
+	campaign, _ := device.GetAnnotation("campaign")
+	assert.Equal(t, "43", campaign)
+	status, _ := device.GetAnnotation("campaignStatus")
+	assert.Equal(t, "done", status)
+	assert.Equal(t, devicePassword, device.Credentials()[0].User.Password)
+	assert.Equal(t, 3, reg.patches)
+
+	// a JSON patch with a key that needs escaping
+	assert.Equal(t, "/metadata/labels/example.com~1zone", JSONPointer("metadata", "labels", "example.com/zone"))
+	_, err = cl.PatchDevice(application, deviceName, JSONPatchType, JSONPatch{
+		{Op: "test", Path: JSONPointer("metadata", "labels", "zone"), Value: "redhat"},
+		{Op: "remove", Path: JSONPointer("metadata", "labels", "zone")},
+		{Op: "add", Path: JSONPointer("metadata", "labels", "example.com/zone"), Value: "luxoft"},
+	})
+	assert.NoError(t, err)
+
+	_, device, err = cl.GetDevice(application, deviceName)
+	assert.NoError(t, err)
+	_, ok := device.GetLabel("zone")
+	assert.False(t, ok)
+	zone, _ = device.GetLabel("example.com/zone")
+	assert.Equal(t, "luxoft", zone)
+
+	// a merge patch given as raw JSON removes keys with null
+	_, err = cl.PatchDevice(application, deviceName, MergePatchType, []byte(`{"metadata":{"annotations":{"campaignStatus":null}}}`))
+	assert.NoError(t, err)
+	_, device, _ = cl.GetDevice(application, deviceName)
+	_, ok = device.GetAnnotation("campaignStatus")
+	assert.False(t, ok)
+
+	// null values are kept, operations without a value have none
+	data, err := json.Marshal(JSONPatch{
+		{Op: "add", Path: "/x", Value: nil},
+		{Op: "remove", Path: "/y"},
+		{Op: "move", From: "/a", Path: "/b"},
+	})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"op":"add","path":"/x","value":null},{"op":"remove","path":"/y"},{"op":"move","path":"/b","from":"/a"}]`, string(data))
+
+	_, err = cl.PatchDevice(application, deviceName, "application/json", nil)
+	assert.Error(t, err)
+	_, err = cl.SetDeviceLabels(application, "unknown", map[string]string{"zone": "redhat"})
+	assert.True(t, internal.IsNotFound(err))
+}
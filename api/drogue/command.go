@@ -0,0 +1,210 @@
+package drogue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/txsvc/stdlib/v2"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal"
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
+)
+
+const (
+	DrogueCommandService  = "drogue-command" // the service name used in profiles
+	DrogueCommandApiAgent = "shadowcar/drogue-command"
+
+	// commands understood by the vehicles
+	CommandStartUpdate = "start-update"
+	CommandNotify      = "notify"
+
+	// API routes, also used to label the request metrics
+	pathCommand = "/api/command/v1alpha1/apps/%s/devices/%s"
+)
+
+type (
+	// CommandClient sends cloud-to-device commands via the Drogue HTTP integration endpoint
+	CommandClient struct {
+		rc *internal.RestClient
+	}
+
+	// Command is sent to a single device
+	Command struct {
+		Name        string
+		Payload     []byte
+		ContentType string        // defaults to application/octet-stream if there is a payload
+		Timeout     time.Duration // bounds the delivery to the integration endpoint, 0 means the context decides
+	}
+
+	// CommandResult describes the outcome of SendCommand
+	CommandResult struct {
+		Application string
+		Device      string
+		Command     string
+		Status      int
+		Accepted    bool      // the endpoint accepted the command for delivery to the device
+		Sent        time.Time // when the endpoint confirmed the command
+		Response    []byte    // the response body, if any
+	}
+
+	// StartUpdatePayload is the payload of CommandStartUpdate
+	StartUpdatePayload struct {
+		Campaign string `json:"campaign"`
+		Zone     string `json:"zone,omitempty"`
+	}
+
+	// NotifyPayload is the payload of CommandNotify
+	NotifyPayload struct {
+		Title   string `json:"title,omitempty"`
+		Message string `json:"message"`
+	}
+)
+
+// NewCommandClient creates a client for DROGUE_HTTP_INTEGRATION_ENDPOINT, using the same credentials as NewDrogueClient
+func NewCommandClient(ctx context.Context, opts ...internal.ClientOption) (*CommandClient, error) {
+
+	ds := &settings.DialSettings{
+		Service:     DrogueCommandService,
+		Endpoint:    stdlib.GetString(DrogueHttpIntegrationEndpoint, ""),
+		TokenURL:    stdlib.GetString(DrogueTokenURL, ""),
+		UserAgent:   DrogueCommandApiAgent,
+		Credentials: LoadCredentials(),
+		TLS:         internal.TLSSettingsFromEnv(""),
+
+		CredentialsDir: stdlib.GetString(DrogueCredentialsDir, ""),
+	}
+
+	if err := internal.ApplyProfileFromEnv(ds, opts...); err != nil {
+		return nil, err
+	}
+
+	// apply options
+	if len(opts) > 0 {
+		for _, opt := range opts {
+			opt.Apply(ds)
+		}
+	}
+
+	if err := internal.ResolveCredentials(ctx, ds); err != nil {
+		return nil, err
+	}
+
+	// do some basic validation
+	if ds.Endpoint == "" {
+		return nil, fmt.Errorf("missing DROGUE_HTTP_INTEGRATION_ENDPOINT")
+	}
+
+	if ds.Credentials.UserID == "" && ds.Credentials.Token == "" {
+		return nil, fmt.Errorf("missing DROGUE_CLIENT_SECRET")
+	}
+
+	rc, err := internal.NewRestClientFromSettings(ds)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CommandClient{
+		rc: rc,
+	}, nil
+}
+
+// NewCommand creates a command without payload
+func NewCommand(name string) *Command {
+	return &Command{Name: name}
+}
+
+// NewJSONCommand creates a command with v as its JSON payload
+func NewJSONCommand(name string, v interface{}) (*Command, error) {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &Command{
+		Name:        name,
+		Payload:     p,
+		ContentType: internal.ContentTypeJSON,
+	}, nil
+}
+
+func (c *CommandClient) SendCommand(application, device string, cmd *Command) (int, CommandResult, error) {
+	return c.SendCommandWithContext(context.Background(), application, device, cmd)
+}
+
+// SendCommandWithContext sends cmd to device. The endpoint only accepts the command, there is no confirmation from the device itself.
+func (c *CommandClient) SendCommandWithContext(ctx context.Context, application, device string, cmd *Command) (int, CommandResult, error) {
+	result := CommandResult{
+		Application: application,
+		Device:      device,
+		Command:     cmd.Name,
+	}
+
+	if cmd.Name == "" {
+		return http.StatusBadRequest, result, fmt.Errorf("missing command name")
+	}
+
+	if cmd.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cmd.Timeout)
+		defer cancel()
+	}
+
+	q := url.Values{}
+	q.Set("command", cmd.Name)
+
+	sr := &internal.StreamRequest{
+		Method:      http.MethodPost,
+		URI:         fmt.Sprintf("%s?%s", fmt.Sprintf(pathCommand, url.PathEscape(application), url.PathEscape(device)), q.Encode()),
+		ContentType: cmd.ContentType,
+	}
+	if len(cmd.Payload) > 0 {
+		sr.Body = bytes.NewReader(cmd.Payload)
+	}
+
+	status, resp, err := c.rc.Stream(internal.WithRoute(ctx, pathCommand), sr)
+	result.Status = status
+	if err != nil {
+		return status, result, err
+	}
+	defer resp.Body.Close()
+
+	result.Accepted = true
+	result.Sent = time.Now()
+	result.Response, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return http.StatusInternalServerError, result, err
+	}
+
+	return status, result, nil
+}
+
+func (c *CommandClient) StartUpdate(application, device string, payload *StartUpdatePayload) (int, CommandResult, error) {
+	return c.StartUpdateWithContext(context.Background(), application, device, payload)
+}
+
+// StartUpdateWithContext tells the vehicle to install the update package of campaign
+func (c *CommandClient) StartUpdateWithContext(ctx context.Context, application, device string, payload *StartUpdatePayload) (int, CommandResult, error) {
+	cmd, err := NewJSONCommand(CommandStartUpdate, payload)
+	if err != nil {
+		return http.StatusBadRequest, CommandResult{}, err
+	}
+	return c.SendCommandWithContext(ctx, application, device, cmd)
+}
+
+func (c *CommandClient) Notify(application, device string, payload *NotifyPayload) (int, CommandResult, error) {
+	return c.NotifyWithContext(context.Background(), application, device, payload)
+}
+
+// NotifyWithContext shows a notification on the vehicle's display
+func (c *CommandClient) NotifyWithContext(ctx context.Context, application, device string, payload *NotifyPayload) (int, CommandResult, error) {
+	cmd, err := NewJSONCommand(CommandNotify, payload)
+	if err != nil {
+		return http.StatusBadRequest, CommandResult{}, err
+	}
+	return c.SendCommandWithContext(ctx, application, device, cmd)
+}
@@ -0,0 +1,68 @@
+package drogue
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal"
+)
+
+func TestSendCommand(t *testing.T) {
+	var received *http.Request
+	var body []byte
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/command/v1alpha1/apps/" + application + "/devices/" + deviceName:
+			received = r
+			body, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusAccepted)
+		case "/api/command/v1alpha1/apps/" + application + "/devices/slow":
+			time.Sleep(200 * time.Millisecond)
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	cl, err := NewCommandClient(context.TODO(), internal.WithEndpoint(srv.URL), internal.WithCredentials("foo", "bar"))
+	assert.NoError(t, err)
+
+	status, result, err := cl.StartUpdate(application, deviceName, &StartUpdatePayload{Campaign: "42", Zone: "redhat"})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.True(t, result.Accepted)
+	assert.Equal(t, CommandStartUpdate, result.Command)
+
+	if assert.NotNil(t, received) {
+		assert.Equal(t, CommandStartUpdate, received.URL.Query().Get("command"))
+		assert.Equal(t, internal.ContentTypeJSON, received.Header.Get("Content-Type"))
+		assert.NotEmpty(t, received.Header.Get("Authorization"))
+		assert.JSONEq(t, `{"campaign":"42","zone":"redhat"}`, string(body))
+	}
+
+	// binary payload
+	status, _, err = cl.SendCommand(application, deviceName, &Command{Name: "firmware", Payload: []byte{0xca, 0xfe}})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, internal.ContentTypeOctetStream, received.Header.Get("Content-Type"))
+	assert.Equal(t, []byte{0xca, 0xfe}, body)
+
+	_, result, err = cl.SendCommand(application, "unknown", NewCommand(CommandNotify))
+	assert.True(t, internal.IsNotFound(err))
+	assert.False(t, result.Accepted)
+
+	_, result, err = cl.SendCommandWithContext(context.TODO(), application, "slow", &Command{Name: CommandNotify, Timeout: 50 * time.Millisecond})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.False(t, result.Accepted)
+
+	_, _, err = cl.SendCommand(application, deviceName, &Command{})
+	assert.Error(t, err)
+}
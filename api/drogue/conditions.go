@@ -0,0 +1,122 @@
+package drogue
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal"
+)
+
+const (
+	ConditionReady = "Ready"
+
+	ConditionTrue    = "True"
+	ConditionFalse   = "False"
+	ConditionUnknown = "Unknown"
+
+	// WaitForDeviceCondition polls with exponential backoff between these limits
+	DefaultMinPollInterval = 500 * time.Millisecond
+	DefaultMaxPollInterval = 10 * time.Second
+)
+
+// IsTrue reports whether the condition's status is True
+func (c *ConditionStruct) IsTrue() bool {
+	return c.Status == ConditionTrue
+}
+
+// LastTransition returns the parsed LastTransitionTime, the zero time if it is empty or invalid
+func (c *ConditionStruct) LastTransition() time.Time {
+	t, err := time.Parse(time.RFC3339Nano, c.LastTransitionTime)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// Condition returns the condition of the given type
+func (s *DeviceStatus) Condition(conditionType string) (ConditionStruct, bool) {
+	if s == nil {
+		return ConditionStruct{}, false
+	}
+	for _, c := range s.Conditions {
+		if c.Type == conditionType {
+			return c, true
+		}
+	}
+	return ConditionStruct{}, false
+}
+
+// Condition returns the device's condition of the given type
+func (d *Device) Condition(conditionType string) (ConditionStruct, bool) {
+	return d.Status.Condition(conditionType)
+}
+
+// Ready reports whether the device's Ready condition is True
+func (d *Device) Ready() bool {
+	c, ok := d.Condition(ConditionReady)
+	return ok && c.IsTrue()
+}
+
+// Condition returns the condition of the given type
+func (s *ApplicationStatus) Condition(conditionType string) (ConditionStruct, bool) {
+	if s == nil {
+		return ConditionStruct{}, false
+	}
+	for _, c := range s.Conditions {
+		if c.Type == conditionType {
+			return c, true
+		}
+	}
+	return ConditionStruct{}, false
+}
+
+// Ready reports whether the application's Ready condition is True
+func (a *Application) Ready() bool {
+	c, ok := a.Status.Condition(ConditionReady)
+	return ok && c.IsTrue()
+}
+
+// WaitForDeviceCondition polls the device until its condition of type conditionType has the given status,
+// e.g. WaitForDeviceCondition(ctx, app, name, ConditionReady, ConditionTrue). Use ctx to limit the wait.
+// Transient errors and a device that does not exist yet don't end the wait, other client errors do.
+func (c *DrogueClient) WaitForDeviceCondition(ctx context.Context, application, name, conditionType, status string) (int, Device, error) {
+	delay := DefaultMinPollInterval
+
+	for {
+		// the response cache must not hide the change we are waiting for
+		code, device, err := c.GetDeviceWithContext(internal.WithRevalidation(ctx), application, name)
+		if err != nil && ctx.Err() == nil && !isTransient(err) {
+			return code, Device{}, err
+		}
+		if err == nil {
+			if cond, ok := device.Condition(conditionType); ok && cond.Status == status {
+				return code, device, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return http.StatusRequestTimeout, device, fmt.Errorf("device '%s' in '%s' is not %s=%s: %w", name, application, conditionType, status, ctx.Err())
+		case <-time.After(delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))):
+		}
+
+		if delay *= 2; delay > DefaultMaxPollInterval {
+			delay = DefaultMaxPollInterval
+		}
+	}
+}
+
+// isTransient reports whether polling again may succeed: errors without a response, e.g. an open circuit,
+// not found, timeouts, throttling and server errors
+func isTransient(err error) bool {
+	switch status := internal.StatusCode(err); {
+	case status == 0, status == http.StatusNotFound, status == http.StatusRequestTimeout, status == http.StatusTooManyRequests:
+		return true
+	case status >= http.StatusInternalServerError:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,324 @@
+package drogue
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrCredentialExists   = errors.New("credential already exists")
+	ErrCredentialNotFound = errors.New("credential not found")
+	ErrInvalidCredential  = errors.New("a credential needs exactly one of user, pass or psk")
+)
+
+// NewUserCredential returns a username/password credential
+func NewUserCredential(username, password string) DeviceCredentialStruct {
+	return DeviceCredentialStruct{User: &UserStruct{Username: username, Password: password}}
+}
+
+// NewPassCredential returns a password-only credential, the device name is the username
+func NewPassCredential(password string) DeviceCredentialStruct {
+	return DeviceCredentialStruct{Pass: password}
+}
+
+// NewPSKCredential returns a pre-shared key credential, validity is optional
+func NewPSKCredential(key []byte, validity *ValidityStruct) DeviceCredentialStruct {
+	return DeviceCredentialStruct{PSK: &PreSharedKeyStruct{Key: key, Validity: validity}}
+}
+
+// Validate checks that c is exactly one kind of credential
+func (c *DeviceCredentialStruct) Validate() error {
+	n := 0
+	if c.User != nil {
+		if c.User.Username == "" {
+			return fmt.Errorf("%w: missing username", ErrInvalidCredential)
+		}
+		n++
+	}
+	if c.Pass != "" {
+		n++
+	}
+	if c.PSK != nil {
+		if len(c.PSK.Key) == 0 {
+			return fmt.Errorf("%w: missing key", ErrInvalidCredential)
+		}
+		n++
+	}
+	if n != 1 {
+		return ErrInvalidCredential
+	}
+	return nil
+}
+
+// Matches reports whether c and other are the same credential. Users are identified by
+// their username, passwords and pre-shared keys by their value.
+func (c *DeviceCredentialStruct) Matches(other *DeviceCredentialStruct) bool {
+	switch {
+	case c.User != nil:
+		return other.User != nil && c.User.Username == other.User.Username
+	case c.Pass != "":
+		return c.Pass == other.Pass
+	case c.PSK != nil:
+		return other.PSK != nil && bytes.Equal(c.PSK.Key, other.PSK.Key)
+	}
+	return false
+}
+
+// Credentials returns the device's credentials, including the legacy single credential in Spec.Authentication
+func (d *Device) Credentials() []DeviceCredentialStruct {
+	if d.Spec == nil {
+		return nil
+	}
+
+	var creds []DeviceCredentialStruct
+	if d.Spec.Authentication != nil {
+		creds = append(creds, *d.Spec.Authentication)
+	}
+	if d.Spec.Credentials != nil {
+		creds = append(creds, d.Spec.Credentials.Credentials...)
+	}
+	return creds
+}
+
+// AddCredential adds c to the device's credentials
+func (d *Device) AddCredential(c DeviceCredentialStruct) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if d.findCredential(&c) != nil {
+		return ErrCredentialExists
+	}
+
+	if d.Spec == nil {
+		d.Spec = &DeviceSpec{}
+	}
+	if d.Spec.Credentials == nil {
+		d.Spec.Credentials = &CredentialsStruct{}
+	}
+	d.Spec.Credentials.Credentials = append(d.Spec.Credentials.Credentials, c)
+	return nil
+}
+
+// RotateCredential replaces the credential matching old with c, e.g. a user's password
+func (d *Device) RotateCredential(old, c DeviceCredentialStruct) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	current := d.findCredential(&old)
+	if current == nil {
+		return ErrCredentialNotFound
+	}
+	if !old.Matches(&c) && d.findCredential(&c) != nil {
+		return ErrCredentialExists
+	}
+	*current = c
+	return nil
+}
+
+// RemoveCredential removes the credential matching c
+func (d *Device) RemoveCredential(c DeviceCredentialStruct) error {
+	if d.Spec == nil {
+		return ErrCredentialNotFound
+	}
+
+	if d.Spec.Authentication != nil && c.Matches(d.Spec.Authentication) {
+		d.Spec.Authentication = nil
+		return nil
+	}
+	if d.Spec.Credentials != nil {
+		creds := d.Spec.Credentials.Credentials
+		for i := range creds {
+			if c.Matches(&creds[i]) {
+				d.Spec.Credentials.Credentials = append(creds[:i], creds[i+1:]...)
+				return nil
+			}
+		}
+	}
+	return ErrCredentialNotFound
+}
+
+func (d *Device) findCredential(c *DeviceCredentialStruct) *DeviceCredentialStruct {
+	if d.Spec == nil {
+		return nil
+	}
+	if d.Spec.Authentication != nil && c.Matches(d.Spec.Authentication) {
+		return d.Spec.Authentication
+	}
+	if d.Spec.Credentials != nil {
+		for i := range d.Spec.Credentials.Credentials {
+			if c.Matches(&d.Spec.Credentials.Credentials[i]) {
+				return &d.Spec.Credentials.Credentials[i]
+			}
+		}
+	}
+	return nil
+}
+
+// Certificates returns the subjects of the X.509 client certificates the device accepts.
+// Drogue validates certificates against the application's trust anchors and finds the
+// device by the certificate's subject, which is stored as an alias.
+func (d *Device) Certificates() []string {
+	if d.Spec == nil || d.Spec.Alias == nil {
+		return nil
+	}
+
+	var subjects []string
+	for _, a := range d.Spec.Alias.Aliases {
+		if strings.HasPrefix(a, "CN=") || strings.Contains(a, ",CN=") {
+			subjects = append(subjects, a)
+		}
+	}
+	return subjects
+}
+
+// AddCertificate lets the device authenticate with cert, or any other certificate with the same subject
+func (d *Device) AddCertificate(cert *x509.Certificate) error {
+	subject := cert.Subject.String()
+	if subject == "" {
+		return fmt.Errorf("certificate without subject")
+	}
+
+	if d.Spec == nil {
+		d.Spec = &DeviceSpec{}
+	}
+	if d.Spec.Alias == nil {
+		d.Spec.Alias = &AliasStruct{}
+	}
+	for _, a := range d.Spec.Alias.Aliases {
+		if a == subject {
+			return ErrCredentialExists
+		}
+	}
+	d.Spec.Alias.Aliases = append(d.Spec.Alias.Aliases, subject)
+	return nil
+}
+
+// RemoveCertificate removes the certificate subject from the device
+func (d *Device) RemoveCertificate(subject string) error {
+	if d.Spec == nil || d.Spec.Alias == nil {
+		return ErrCredentialNotFound
+	}
+	for i, a := range d.Spec.Alias.Aliases {
+		if a == subject {
+			d.Spec.Alias.Aliases = append(d.Spec.Alias.Aliases[:i], d.Spec.Alias.Aliases[i+1:]...)
+			return nil
+		}
+	}
+	return ErrCredentialNotFound
+}
+
+func (c *DrogueClient) AddCredential(application, name string, cred DeviceCredentialStruct) (int, Device, error) {
+	return c.AddCredentialWithContext(context.Background(), application, name, cred)
+}
+
+// AddCredentialWithContext adds cred to the device, see Device.AddCredential
+func (c *DrogueClient) AddCredentialWithContext(ctx context.Context, application, name string, cred DeviceCredentialStruct) (int, Device, error) {
+	return c.ModifyDeviceWithContext(ctx, application, name, func(d *Device) error {
+		return d.AddCredential(cred)
+	})
+}
+
+func (c *DrogueClient) ListCredentials(application, name string) (int, []DeviceCredentialStruct, []string, error) {
+	return c.ListCredentialsWithContext(context.Background(), application, name)
+}
+
+// ListCredentialsWithContext returns the device's credentials and the subjects of its X.509 certificates
+func (c *DrogueClient) ListCredentialsWithContext(ctx context.Context, application, name string) (int, []DeviceCredentialStruct, []string, error) {
+	status, device, err := c.GetDeviceWithContext(ctx, application, name)
+	if err != nil {
+		return status, nil, nil, err
+	}
+	return status, device.Credentials(), device.Certificates(), nil
+}
+
+func (c *DrogueClient) RotateCredential(application, name string, old, cred DeviceCredentialStruct) (int, Device, error) {
+	return c.RotateCredentialWithContext(context.Background(), application, name, old, cred)
+}
+
+// RotateCredentialWithContext replaces old with cred, see Device.RotateCredential
+func (c *DrogueClient) RotateCredentialWithContext(ctx context.Context, application, name string, old, cred DeviceCredentialStruct) (int, Device, error) {
+	return c.ModifyDeviceWithContext(ctx, application, name, func(d *Device) error {
+		return d.RotateCredential(old, cred)
+	})
+}
+
+func (c *DrogueClient) RemoveCredential(application, name string, cred DeviceCredentialStruct) (int, Device, error) {
+	return c.RemoveCredentialWithContext(context.Background(), application, name, cred)
+}
+
+// RemoveCredentialWithContext removes cred from the device, see Device.RemoveCredential
+func (c *DrogueClient) RemoveCredentialWithContext(ctx context.Context, application, name string, cred DeviceCredentialStruct) (int, Device, error) {
+	return c.ModifyDeviceWithContext(ctx, application, name, func(d *Device) error {
+		return d.RemoveCredential(cred)
+	})
+}
+
+func (c *DrogueClient) AddCertificate(application, name string, cert *x509.Certificate) (int, Device, error) {
+	return c.AddCertificateWithContext(context.Background(), application, name, cert)
+}
+
+// AddCertificateWithContext lets the device authenticate with cert, see Device.AddCertificate
+func (c *DrogueClient) AddCertificateWithContext(ctx context.Context, application, name string, cert *x509.Certificate) (int, Device, error) {
+	return c.ModifyDeviceWithContext(ctx, application, name, func(d *Device) error {
+		return d.AddCertificate(cert)
+	})
+}
+
+func (c *DrogueClient) RotateCertificate(application, name, subject string, cert *x509.Certificate) (int, Device, error) {
+	return c.RotateCertificateWithContext(context.Background(), application, name, subject, cert)
+}
+
+// RotateCertificateWithContext replaces the certificate subject with the subject of cert.
+// A renewed certificate with the same subject needs no rotation.
+func (c *DrogueClient) RotateCertificateWithContext(ctx context.Context, application, name, subject string, cert *x509.Certificate) (int, Device, error) {
+	return c.ModifyDeviceWithContext(ctx, application, name, func(d *Device) error {
+		if err := d.RemoveCertificate(subject); err != nil {
+			return err
+		}
+		return d.AddCertificate(cert)
+	})
+}
+
+func (c *DrogueClient) RemoveCertificate(application, name, subject string) (int, Device, error) {
+	return c.RemoveCertificateWithContext(context.Background(), application, name, subject)
+}
+
+// RemoveCertificateWithContext removes the certificate subject from the device
+func (c *DrogueClient) RemoveCertificateWithContext(ctx context.Context, application, name, subject string) (int, Device, error) {
+	return c.ModifyDeviceWithContext(ctx, application, name, func(d *Device) error {
+		return d.RemoveCertificate(subject)
+	})
+}
+
+func (c *DrogueClient) RegisterDeviceWithCredentials(application, name string, creds []DeviceCredentialStruct, certs ...*x509.Certificate) (int, Device, error) {
+	return c.RegisterDeviceWithCredentialsWithContext(context.Background(), application, name, creds, certs...)
+}
+
+// RegisterDeviceWithCredentialsWithContext creates a device that authenticates with creds and/or X.509 certificates
+func (c *DrogueClient) RegisterDeviceWithCredentialsWithContext(ctx context.Context, application, name string, creds []DeviceCredentialStruct, certs ...*x509.Certificate) (int, Device, error) {
+	req := Device{
+		Metadata: &ScopedMetadata{
+			Name:        name,
+			Application: application,
+		},
+	}
+
+	for _, cred := range creds {
+		if err := req.AddCredential(cred); err != nil {
+			return http.StatusBadRequest, Device{}, err
+		}
+	}
+	for _, cert := range certs {
+		if err := req.AddCertificate(cert); err != nil {
+			return http.StatusBadRequest, Device{}, err
+		}
+	}
+
+	return c.CreateDeviceWithContext(ctx, application, &req)
+}
@@ -0,0 +1,63 @@
+package drogue
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceCredentials(t *testing.T) {
+	cl, _ := newFakeClient(t)
+	ctx := context.TODO()
+
+	_, _, err := cl.CreateApplication(&Application{Metadata: &NonScopedMetadata{Name: application}})
+	assert.NoError(t, err)
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: deviceName, Organization: []string{"Bobbycar"}}}
+	_, _, err = cl.RegisterDeviceWithCredentialsWithContext(ctx, application, deviceName, []DeviceCredentialStruct{NewUserCredential("car", devicePassword)}, cert)
+	assert.NoError(t, err)
+
+	psk := NewPSKCredential([]byte{1, 2, 3, 4}, nil)
+	_, _, err = cl.AddCredentialWithContext(ctx, application, deviceName, psk)
+	assert.NoError(t, err)
+	_, _, err = cl.AddCredentialWithContext(ctx, application, deviceName, psk)
+	assert.ErrorIs(t, err, ErrCredentialExists)
+	_, _, err = cl.AddCredentialWithContext(ctx, application, deviceName, DeviceCredentialStruct{Pass: "foo", PSK: psk.PSK})
+	assert.ErrorIs(t, err, ErrInvalidCredential)
+
+	_, creds, certs, err := cl.ListCredentials(application, deviceName)
+	assert.NoError(t, err)
+	assert.Len(t, creds, 2)
+	assert.Equal(t, []string{"CN=foo-car,O=Bobbycar"}, certs)
+
+	// rotate the password, the user stays the same
+	_, device, err := cl.RotateCredentialWithContext(ctx, application, deviceName, NewUserCredential("car", ""), NewUserCredential("car", "new-pass"))
+	assert.NoError(t, err)
+	assert.Equal(t, "new-pass", device.Credentials()[0].User.Password)
+
+	_, _, err = cl.RotateCredentialWithContext(ctx, application, deviceName, NewPassCredential("unknown"), NewPassCredential("new-pass"))
+	assert.ErrorIs(t, err, ErrCredentialNotFound)
+
+	renewed := &x509.Certificate{Subject: pkix.Name{CommonName: deviceName, Organization: []string{"Red Hat"}}}
+	_, device, err = cl.RotateCertificateWithContext(ctx, application, deviceName, "CN=foo-car,O=Bobbycar", renewed)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"CN=foo-car,O=Red Hat"}, device.Certificates())
+
+	_, _, err = cl.RemoveCredentialWithContext(ctx, application, deviceName, psk)
+	assert.NoError(t, err)
+	_, _, err = cl.RemoveCertificateWithContext(ctx, application, deviceName, "CN=foo-car,O=Red Hat")
+	assert.NoError(t, err)
+
+	_, device, err = cl.GetDevice(application, deviceName)
+	assert.NoError(t, err)
+	assert.Len(t, device.Credentials(), 1)
+	assert.Empty(t, device.Certificates())
+
+	// the wire format of the registry
+	p, _ := json.Marshal(DeviceSpec{Credentials: &CredentialsStruct{Credentials: []DeviceCredentialStruct{NewPassCredential("foo"), psk}}})
+	assert.JSONEq(t, `{"credentials":{"credentials":[{"pass":"foo"},{"psk":{"key":"AQIDBA=="}}]}}`, string(p))
+}
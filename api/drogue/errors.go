@@ -0,0 +1,30 @@
+package drogue
+
+import (
+	"errors"
+	"fmt"
+)
+
+type (
+	// ConflictError is returned if a device was modified since it was read, i.e. its resource version is outdated
+	ConflictError struct {
+		Application     string
+		Name            string
+		ResourceVersion string
+		Err             error // the *internal.APIError with status 409
+	}
+)
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("device '%s' in '%s' was modified, resource version '%s' is outdated", e.Name, e.Application, e.ResourceVersion)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+// IsConflict reports whether err is a ConflictError
+func IsConflict(err error) bool {
+	var e *ConflictError
+	return errors.As(err, &e)
+}
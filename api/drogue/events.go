@@ -0,0 +1,310 @@
+package drogue
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+
+	"github.com/txsvc/stdlib/v2"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal"
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
+)
+
+const (
+	DrogueWebSocketEndpoint = "DROGUE_WEBSOCKET_ENDPOINT" // e.g. wss://websocket-integration-drogue-dev.apps.example.com
+
+	DrogueEventsService  = "drogue-events" // the service name used in profiles
+	DrogueEventsApiAgent = "shadowcar/drogue-events"
+
+	// CloudEvent types sent by the WebSocket integration
+	EventTypeTelemetry = "io.drogue.event.v1"
+	EventTypeRegistry  = "io.drogue.registry.v1"
+
+	// DefaultEventBuffer is the capacity of the channel returned by EventStream.Subscribe
+	DefaultEventBuffer = 64
+	// reconnect with exponential backoff between these limits
+	DefaultMinReconnectDelay = time.Second
+	DefaultMaxReconnectDelay = time.Minute
+
+	pathEvents = "/%s" // the application's stream
+)
+
+type (
+	// EventStream consumes the CloudEvents of an application from Drogue's WebSocket integration
+	EventStream struct {
+		rc          *internal.RestClient // credentials and TLS settings only
+		application string
+		dialer      *websocket.Dialer
+
+		Buffer            int
+		MinReconnectDelay time.Duration
+		MaxReconnectDelay time.Duration
+	}
+
+	// Event is one of *TelemetryEvent, *DeviceChangedEvent or, for any other type, the *CloudEvent itself
+	Event interface {
+		Raw() *CloudEvent
+	}
+
+	// CloudEvent is a CloudEvents 1.0 event in structured JSON mode with Drogue's extension attributes
+	CloudEvent struct {
+		SpecVersion     string          `json:"specversion"`
+		ID              string          `json:"id"`
+		Source          string          `json:"source"`
+		Type            string          `json:"type"`
+		Subject         string          `json:"subject,omitempty"`
+		DataContentType string          `json:"datacontenttype,omitempty"`
+		DataSchema      string          `json:"dataschema,omitempty"`
+		Time            time.Time       `json:"time,omitempty"`
+		Data            json.RawMessage `json:"data,omitempty"`
+		DataBase64      string          `json:"data_base64,omitempty"`
+
+		// Drogue extensions
+		Application string `json:"application,omitempty"`
+		Device      string `json:"device,omitempty"`
+		Sender      string `json:"sender,omitempty"`
+		Instance    string `json:"instance,omitempty"`
+	}
+
+	// TelemetryEvent is a message published by a device
+	TelemetryEvent struct {
+		*CloudEvent
+		Channel string // the channel or MQTT topic the device published to
+		Payload []byte
+	}
+
+	// RegistryChange is the data of a registry event
+	RegistryChange struct {
+		Path       string `json:"path,omitempty"`
+		Generation int64  `json:"generation"`
+		Revision   int64  `json:"revision,omitempty"`
+		UID        string `json:"uid,omitempty"`
+	}
+
+	// DeviceChangedEvent is sent when a device was created, modified or deleted. Drogue doesn't say which,
+	// look the device up to get its current state, it was deleted if the registry returns 404.
+	DeviceChangedEvent struct {
+		*CloudEvent
+		Change RegistryChange
+	}
+)
+
+// NewEventStream creates a consumer for DROGUE_WEBSOCKET_ENDPOINT, using the same credentials as NewDrogueClient
+func NewEventStream(ctx context.Context, application string, opts ...internal.ClientOption) (*EventStream, error) {
+
+	ds := &settings.DialSettings{
+		Service:     DrogueEventsService,
+		Endpoint:    stdlib.GetString(DrogueWebSocketEndpoint, ""),
+		TokenURL:    stdlib.GetString(DrogueTokenURL, ""),
+		UserAgent:   DrogueEventsApiAgent,
+		Credentials: LoadCredentials(),
+		TLS:         internal.TLSSettingsFromEnv(""),
+
+		CredentialsDir: stdlib.GetString(DrogueCredentialsDir, ""),
+	}
+
+	if err := internal.ApplyProfileFromEnv(ds, opts...); err != nil {
+		return nil, err
+	}
+
+	// apply options
+	if len(opts) > 0 {
+		for _, opt := range opts {
+			opt.Apply(ds)
+		}
+	}
+
+	if err := internal.ResolveCredentials(ctx, ds); err != nil {
+		return nil, err
+	}
+
+	// do some basic validation
+	if ds.Endpoint == "" {
+		return nil, fmt.Errorf("missing DROGUE_WEBSOCKET_ENDPOINT")
+	}
+	if application == "" {
+		return nil, fmt.Errorf("missing application")
+	}
+
+	rc, err := internal.NewRestClientFromSettings(ds)
+	if err != nil {
+		return nil, err
+	}
+
+	tc, err := internal.NewTLSConfig(ds.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EventStream{
+		rc:          rc,
+		application: application,
+		dialer: &websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: 45 * time.Second,
+			TLSClientConfig:  tc,
+		},
+		Buffer:            DefaultEventBuffer,
+		MinReconnectDelay: DefaultMinReconnectDelay,
+		MaxReconnectDelay: DefaultMaxReconnectDelay,
+	}, nil
+}
+
+// Subscribe connects to the stream and delivers its events until ctx is done, then the channel is closed.
+// Lost connections are re-established with exponential backoff, events sent in the meantime are lost.
+func (s *EventStream) Subscribe(ctx context.Context) <-chan Event {
+	events := make(chan Event, s.Buffer)
+
+	go func() {
+		defer close(events)
+
+		delay := s.MinReconnectDelay
+		for ctx.Err() == nil {
+			connected, err := s.consume(ctx, events)
+			if ctx.Err() != nil {
+				return
+			}
+			if connected {
+				delay = s.MinReconnectDelay
+			}
+			log.Warn().Str("application", s.application).Err(err).Dur("delay", delay).Msg("event stream disconnected")
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))):
+			}
+
+			if delay *= 2; delay > s.MaxReconnectDelay {
+				delay = s.MaxReconnectDelay
+			}
+		}
+	}()
+
+	return events
+}
+
+// URL returns the WebSocket URL of the application's stream
+func (s *EventStream) URL() string {
+	endpoint := s.rc.Settings.Endpoint
+	if strings.HasPrefix(endpoint, "https://") {
+		endpoint = "wss://" + strings.TrimPrefix(endpoint, "https://")
+	} else if strings.HasPrefix(endpoint, "http://") {
+		endpoint = "ws://" + strings.TrimPrefix(endpoint, "http://")
+	}
+	return strings.TrimSuffix(endpoint, "/") + fmt.Sprintf(pathEvents, url.PathEscape(s.application))
+}
+
+// consume reads events from a single connection until it fails, connected reports whether the handshake succeeded
+func (s *EventStream) consume(ctx context.Context, events chan<- Event) (bool, error) {
+	header, err := s.rc.Header(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	conn, resp, err := s.dialer.DialContext(ctx, s.URL(), header)
+	if err != nil {
+		if resp != nil {
+			// the access token might have been revoked or expired early
+			if resp.StatusCode == http.StatusUnauthorized && s.rc.Settings.TokenSource != nil {
+				s.rc.Settings.TokenSource.Invalidate()
+			}
+			return false, fmt.Errorf("%w: %s", err, resp.Status)
+		}
+		return false, err
+	}
+	defer conn.Close()
+
+	log.Debug().Str("application", s.application).Msg("event stream connected")
+
+	// unblock ReadMessage once ctx is done
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return true, err
+		}
+
+		evt, err := DecodeEvent(msg)
+		if err != nil {
+			log.Error().Str("application", s.application).Err(err).Msg("invalid event")
+			continue
+		}
+
+		select {
+		case events <- evt:
+		case <-ctx.Done():
+			return true, ctx.Err()
+		}
+	}
+}
+
+// DecodeEvent decodes a structured CloudEvent into a typed Event
+func DecodeEvent(msg []byte) (Event, error) {
+	var ce CloudEvent
+	if err := json.Unmarshal(msg, &ce); err != nil {
+		return nil, err
+	}
+	if ce.Type == "" {
+		return nil, fmt.Errorf("missing event type")
+	}
+
+	switch ce.Type {
+	case EventTypeTelemetry:
+		payload, err := ce.Payload()
+		if err != nil {
+			return nil, err
+		}
+		return &TelemetryEvent{CloudEvent: &ce, Channel: ce.Subject, Payload: payload}, nil
+	case EventTypeRegistry:
+		if ce.Device == "" {
+			return &ce, nil // application changes
+		}
+		var change RegistryChange
+		if len(ce.Data) > 0 {
+			if err := json.Unmarshal(ce.Data, &change); err != nil {
+				return nil, err
+			}
+		}
+		return &DeviceChangedEvent{CloudEvent: &ce, Change: change}, nil
+	}
+
+	return &ce, nil
+}
+
+// Raw implements Event
+func (ce *CloudEvent) Raw() *CloudEvent {
+	return ce
+}
+
+// Payload returns the event data, decoding data_base64 if needed
+func (ce *CloudEvent) Payload() ([]byte, error) {
+	if ce.DataBase64 != "" {
+		return base64.StdEncoding.DecodeString(ce.DataBase64)
+	}
+	return ce.Data, nil
+}
+
+// Decode unmarshals the JSON payload of the telemetry event into v
+func (e *TelemetryEvent) Decode(v interface{}) error {
+	return json.Unmarshal(e.Payload, v)
+}
@@ -0,0 +1,93 @@
+package drogue
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal"
+)
+
+func TestEventStream(t *testing.T) {
+	var connections int32
+
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+application || r.Header.Get("Authorization") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if atomic.AddInt32(&connections, 1) == 1 {
+			// drop the connection after the first events
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"specversion":"1.0","id":"1","source":"drogue://bobbycar/car","type":"io.drogue.event.v1","subject":"state","datacontenttype":"application/json","data":{"speed":42},"application":"bobbycar","device":"car"}`))
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"specversion":"1.0","id":"2","source":"drogue://bobbycar","type":"io.drogue.registry.v1","data":{"generation":1},"application":"bobbycar","device":"car"}`))
+			conn.WriteMessage(websocket.TextMessage, []byte(`not an event`))
+			return
+		}
+
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"specversion":"1.0","id":"3","source":"drogue://bobbycar","type":"io.drogue.registry.v1","data":{"generation":2},"application":"bobbycar","device":"car"}`))
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"specversion":"1.0","id":"4","source":"drogue://bobbycar/car","type":"io.drogue.event.v1","subject":"raw","data_base64":"yv4=","application":"bobbycar","device":"car"}`))
+
+		// keep the connection open until the client leaves
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	s, err := NewEventStream(context.TODO(), application, internal.WithEndpoint(srv.URL), internal.WithCredentials("foo", "bar"))
+	assert.NoError(t, err)
+	assert.Equal(t, "ws"+srv.URL[4:]+"/"+application, s.URL())
+	s.MinReconnectDelay = 10 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	events := s.Subscribe(ctx)
+
+	evt := <-events
+	if telemetry, ok := evt.(*TelemetryEvent); assert.True(t, ok) {
+		var state struct{ Speed int }
+		assert.NoError(t, telemetry.Decode(&state))
+		assert.Equal(t, 42, state.Speed)
+		assert.Equal(t, "state", telemetry.Channel)
+		assert.Equal(t, "car", telemetry.Device)
+	}
+
+	evt = <-events
+	if changed, ok := evt.(*DeviceChangedEvent); assert.True(t, ok) {
+		assert.Equal(t, int64(1), changed.Change.Generation)
+	}
+
+	// the invalid event is skipped, the rest is sent after reconnecting
+	evt = <-events
+	if changed, ok := evt.(*DeviceChangedEvent); assert.True(t, ok) {
+		assert.Equal(t, int64(2), changed.Change.Generation)
+		assert.Equal(t, "3", changed.Raw().ID)
+	}
+
+	evt = <-events
+	if telemetry, ok := evt.(*TelemetryEvent); assert.True(t, ok) {
+		assert.Equal(t, []byte{0xca, 0xfe}, telemetry.Payload)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&connections))
+
+	cancel()
+	_, open := <-events
+	assert.False(t, open)
+}
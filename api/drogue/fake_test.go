@@ -0,0 +1,312 @@
+package drogue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal"
+)
+
+type (
+	// fakeRegistry is a minimal in-memory Drogue device registry with optimistic locking
+	fakeRegistry struct {
+		mu      sync.Mutex
+		apps    map[string]map[string]interface{}
+		devices map[string]map[string]map[string]interface{}
+		version int
+		queries []string // the query of each list request
+
+		patches int
+		reject  string // writes of this item fail
+
+		tokens   []Token
+		password string // the password or token of the last request
+	}
+)
+
+func newFakeClient(t *testing.T) (*DrogueClient, *fakeRegistry) {
+	reg := &fakeRegistry{
+		apps:    make(map[string]map[string]interface{}),
+		devices: make(map[string]map[string]map[string]interface{}),
+	}
+
+	srv := httptest.NewServer(reg)
+	t.Cleanup(srv.Close)
+
+	cl, err := NewDrogueClient(context.TODO(), internal.WithEndpoint(srv.URL), internal.WithCredentials("foo", "bar"))
+	assert.NoError(t, err)
+
+	return cl, reg
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, r.password, _ = req.BasicAuth()
+
+	if strings.HasPrefix(req.URL.Path, pathTokens) {
+		r.token(w, req, strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, pathTokens), "/"))
+		return
+	}
+
+	// /api/registry/v1alpha1/apps[/{app}[/devices[/{device}]]]
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/api/registry/v1alpha1/apps"), "/")[1:]
+
+	switch len(parts) {
+	case 0:
+		r.collection(w, req, r.apps)
+	case 1:
+		r.resource(w, req, r.apps, parts[0])
+	case 2:
+		if _, ok := r.apps[parts[0]]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.devices[parts[0]] == nil {
+			r.devices[parts[0]] = make(map[string]map[string]interface{})
+		}
+		r.collection(w, req, r.devices[parts[0]])
+	case 3:
+		r.resource(w, req, r.devices[parts[0]], parts[2])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *fakeRegistry) collection(w http.ResponseWriter, req *http.Request, items map[string]map[string]interface{}) {
+	switch req.Method {
+	case http.MethodGet:
+		names := make([]string, 0, len(items))
+		for name, item := range items {
+			if matchLabels(item, req.URL.Query().Get("labels")) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		offset, _ := strconv.Atoi(req.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+		list := make([]map[string]interface{}, 0, len(names))
+		for i := offset; i < len(names) && (limit == 0 || i < offset+limit); i++ {
+			list = append(list, items[names[i]])
+		}
+		r.queries = append(r.queries, req.URL.RawQuery)
+		json.NewEncoder(w).Encode(list)
+	case http.MethodPost:
+		var item map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&item); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		name := metadata(item)["name"].(string)
+		if name == r.reject {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		if _, ok := items[name]; ok {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		items[name] = r.store(item)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *fakeRegistry) resource(w http.ResponseWriter, req *http.Request, items map[string]map[string]interface{}, name string) {
+	current, ok := items[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(current)
+	case http.MethodPut:
+		var item map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&item); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if v, ok := metadata(item)["resourceVersion"].(string); ok && v != "" && v != metadata(current)["resourceVersion"] {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":"OptimisticLockFailed","message":"resource version mismatch"}`))
+			return
+		}
+		items[name] = r.store(item)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch:
+		var patched map[string]interface{}
+		var err error
+		switch req.Header.Get("Content-Type") {
+		case MergePatchType:
+			var patch map[string]interface{}
+			if err = json.NewDecoder(req.Body).Decode(&patch); err == nil {
+				patched = mergePatch(current, patch)
+			}
+		case JSONPatchType:
+			var patch JSONPatch
+			if err = json.NewDecoder(req.Body).Decode(&patch); err == nil {
+				patched, err = jsonPatch(current, patch)
+			}
+		default:
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.patches++
+		items[name] = r.store(patched)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		delete(items, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// store assigns a new resource version to item
+func (r *fakeRegistry) store(item map[string]interface{}) map[string]interface{} {
+	r.version++
+	metadata(item)["resourceVersion"] = strconv.Itoa(r.version)
+	return item
+}
+
+func metadata(item map[string]interface{}) map[string]interface{} {
+	m, ok := item["metadata"].(map[string]interface{})
+	if !ok {
+		m = make(map[string]interface{})
+		item["metadata"] = m
+	}
+	return m
+}
+
+// matchLabels supports equality and existence ('key', '!key') requirements
+func matchLabels(item map[string]interface{}, selector string) bool {
+	labels, _ := metadata(item)["labels"].(map[string]interface{})
+	for _, req := range strings.Split(selector, ",") {
+		if req == "" {
+			continue
+		}
+		if k, v, ok := strings.Cut(req, "="); ok {
+			if labels[k] != v {
+				return false
+			}
+		} else if strings.HasPrefix(req, "!") {
+			if _, ok := labels[req[1:]]; ok {
+				return false
+			}
+		} else if _, ok := labels[req]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// token serves /api/tokens/v1alpha1[/{prefix}], secrets are the prefix followed by '_secret'
+func (r *fakeRegistry) token(w http.ResponseWriter, req *http.Request, prefix string) {
+	switch {
+	case req.Method == http.MethodGet && prefix == "":
+		json.NewEncoder(w).Encode(r.tokens)
+	case req.Method == http.MethodPost && prefix == "":
+		r.version++
+		t := Token{Prefix: fmt.Sprintf("drg_%d", r.version), Description: req.URL.Query().Get("description")}
+		r.tokens = append(r.tokens, t)
+
+		t.Token = t.Prefix + "_secret"
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(t)
+	case req.Method == http.MethodDelete:
+		for i, t := range r.tokens {
+			if t.Prefix == prefix {
+				r.tokens = append(r.tokens[:i], r.tokens[i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// mergePatch applies an RFC 7386 merge patch to a copy of target
+func mergePatch(target, patch map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(target))
+	for k, v := range target {
+		result[k] = v
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(result, k)
+		} else if p, ok := v.(map[string]interface{}); ok {
+			t, _ := result[k].(map[string]interface{})
+			result[k] = mergePatch(t, p)
+		} else {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// jsonPatch applies the add, replace, remove and test operations of an RFC 6902 patch, objects only
+func jsonPatch(target map[string]interface{}, patch JSONPatch) (map[string]interface{}, error) {
+	// work on a deep copy, the patch is atomic
+	var result map[string]interface{}
+	p, _ := json.Marshal(target)
+	json.Unmarshal(p, &result)
+
+	for _, op := range patch {
+		elements := strings.Split(op.Path, "/")[1:]
+		for i, e := range elements {
+			elements[i] = strings.ReplaceAll(strings.ReplaceAll(e, "~1", "/"), "~0", "~")
+		}
+
+		parent := result
+		for _, e := range elements[:len(elements)-1] {
+			next, ok := parent[e].(map[string]interface{})
+			if !ok {
+				if op.Op != "add" {
+					return nil, fmt.Errorf("path '%s' not found", op.Path)
+				}
+				next = make(map[string]interface{})
+				parent[e] = next
+			}
+			parent = next
+		}
+		key := elements[len(elements)-1]
+
+		switch op.Op {
+		case "add", "replace":
+			parent[key] = op.Value
+		case "remove":
+			if _, ok := parent[key]; !ok {
+				return nil, fmt.Errorf("path '%s' not found", op.Path)
+			}
+			delete(parent, key)
+		case "test":
+			if fmt.Sprint(parent[key]) != fmt.Sprint(op.Value) {
+				return nil, fmt.Errorf("test of '%s' failed", op.Path)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported operation '%s'", op.Op)
+		}
+	}
+	return result, nil
+}
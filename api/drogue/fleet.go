@@ -0,0 +1,230 @@
+package drogue
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal"
+)
+
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+type (
+	// FleetDevice is the desired state of a device. Labels and annotations not listed here,
+	// e.g. the ones maintained by the zonechange adapter, are left alone.
+	FleetDevice struct {
+		Name        string
+		Password    string   // a password credential, none if empty
+		Gateways    []string // the gateways allowed to act for the device
+		Labels      map[string]string
+		Annotations map[string]string
+	}
+
+	// Change is a single step of a FleetPlan
+	Change struct {
+		Action  string
+		Name    string
+		Diff    []string     // what is changed, secrets are not shown
+		Desired *FleetDevice // nil for ActionDelete
+	}
+
+	// FleetPlan lists the changes that make the registry match the fleet
+	FleetPlan []Change
+
+	// ChangeResult is the outcome of applying a Change
+	ChangeResult struct {
+		Change
+		Status int
+		Err    error
+	}
+)
+
+func (c *DrogueClient) PlanFleet(application string, fleet []FleetDevice, opts *ListOptions, prune bool) (FleetPlan, error) {
+	return c.PlanFleetWithContext(context.Background(), application, fleet, opts, prune)
+}
+
+// PlanFleetWithContext compares the devices in application, or the ones selected by opts, with fleet.
+// Devices of the fleet that opts doesn't select, e.g. gateways without the fleet's labels, are looked up by name.
+// With prune, devices that are not part of the fleet but selected by opts are deleted.
+func (c *DrogueClient) PlanFleetWithContext(ctx context.Context, application string, fleet []FleetDevice, opts *ListOptions, prune bool) (FleetPlan, error) {
+	current := make(map[string]Device)
+
+	devices, err := c.DevicesWithContext(ctx, application, opts).All()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range devices {
+		if d.Metadata != nil {
+			current[d.Metadata.Name] = d
+		}
+	}
+
+	var plan FleetPlan
+	desired := make(map[string]bool, len(fleet))
+	for i := range fleet {
+		fd := &fleet[i]
+		if fd.Name == "" {
+			return nil, fmt.Errorf("device %d has no name", i+1)
+		}
+		if desired[fd.Name] {
+			return nil, fmt.Errorf("device '%s' is listed twice", fd.Name)
+		}
+		desired[fd.Name] = true
+
+		d, ok := current[fd.Name]
+		if !ok && opts != nil {
+			_, existing, err := c.GetDeviceWithContext(ctx, application, fd.Name)
+			if err == nil {
+				d, ok = existing, true
+			} else if !internal.IsNotFound(err) {
+				return nil, err
+			}
+		}
+		if !ok {
+			plan = append(plan, Change{Action: ActionCreate, Name: fd.Name, Desired: fd})
+		} else if diff := fd.Diff(&d); len(diff) > 0 {
+			plan = append(plan, Change{Action: ActionUpdate, Name: fd.Name, Diff: diff, Desired: fd})
+		}
+	}
+
+	if prune {
+		var extra []string
+		for name := range current {
+			if !desired[name] {
+				extra = append(extra, name)
+			}
+		}
+		sort.Strings(extra)
+		for _, name := range extra {
+			plan = append(plan, Change{Action: ActionDelete, Name: name})
+		}
+	}
+
+	return plan, nil
+}
+
+func (c *DrogueClient) ApplyFleetPlan(application string, plan FleetPlan) []ChangeResult {
+	return c.ApplyFleetPlanWithContext(context.Background(), application, plan)
+}
+
+// ApplyFleetPlanWithContext applies all changes, failed changes don't stop the others
+func (c *DrogueClient) ApplyFleetPlanWithContext(ctx context.Context, application string, plan FleetPlan) []ChangeResult {
+	results := make([]ChangeResult, 0, len(plan))
+
+	for _, change := range plan {
+		if ctx.Err() != nil {
+			results = append(results, ChangeResult{Change: change, Err: ctx.Err()})
+			continue
+		}
+
+		r := ChangeResult{Change: change}
+		switch change.Action {
+		case ActionCreate:
+			d := Device{Metadata: &ScopedMetadata{Name: change.Name, Application: application}}
+			change.Desired.Apply(&d)
+			r.Status, _, r.Err = c.CreateDeviceWithContext(ctx, application, &d)
+		case ActionUpdate:
+			r.Status, _, r.Err = c.ModifyDeviceWithContext(ctx, application, change.Name, func(d *Device) error {
+				change.Desired.Apply(d)
+				return nil
+			})
+		case ActionDelete:
+			r.Status, r.Err = c.DeleteDeviceWithContext(ctx, application, change.Name)
+		default:
+			r.Err = fmt.Errorf("unknown action '%s'", change.Action)
+		}
+		results = append(results, r)
+	}
+
+	return results
+}
+
+// String formats the change as a line of a plan, e.g. '~ WP0AA2991YS620631: labels.zone "luxoft" -> "redhat"'
+func (c Change) String() string {
+	switch c.Action {
+	case ActionCreate:
+		return fmt.Sprintf("+ %s", c.Name)
+	case ActionDelete:
+		return fmt.Sprintf("- %s", c.Name)
+	}
+	return fmt.Sprintf("~ %s: %s", c.Name, strings.Join(c.Diff, ", "))
+}
+
+// Diff returns the differences between fd and d
+func (fd *FleetDevice) Diff(d *Device) []string {
+	var diff []string
+
+	for _, k := range sortedKeys(fd.Labels) {
+		if v, ok := d.GetLabel(k); !ok || v != fd.Labels[k] {
+			diff = append(diff, fmt.Sprintf("labels.%s %q -> %q", k, v, fd.Labels[k]))
+		}
+	}
+	for _, k := range sortedKeys(fd.Annotations) {
+		if v, ok := d.GetAnnotation(k); !ok || v != fd.Annotations[k] {
+			diff = append(diff, fmt.Sprintf("annotations.%s %q -> %q", k, v, fd.Annotations[k]))
+		}
+	}
+
+	if fd.Password != "" && d.findCredential(&DeviceCredentialStruct{Pass: fd.Password}) == nil {
+		diff = append(diff, "password")
+	}
+
+	var gateways []string
+	if d.Spec != nil && d.Spec.GatewaySelector != nil {
+		gateways = d.Spec.GatewaySelector.MatchName
+	}
+	if len(fd.Gateways) > 0 && strings.Join(fd.Gateways, ",") != strings.Join(gateways, ",") {
+		diff = append(diff, fmt.Sprintf("gateways %v -> %v", gateways, fd.Gateways))
+	}
+
+	return diff
+}
+
+// Apply changes d to match fd. A changed password replaces all password credentials.
+func (fd *FleetDevice) Apply(d *Device) {
+	for k, v := range fd.Labels {
+		d.SetLabel(k, v)
+	}
+	for k, v := range fd.Annotations {
+		d.SetAnnotation(k, v)
+	}
+
+	if d.Spec == nil && (fd.Password != "" || len(fd.Gateways) > 0) {
+		d.Spec = &DeviceSpec{}
+	}
+
+	if fd.Password != "" && d.findCredential(&DeviceCredentialStruct{Pass: fd.Password}) == nil {
+		if d.Spec.Authentication != nil && d.Spec.Authentication.Pass != "" {
+			d.Spec.Authentication = nil
+		}
+		if d.Spec.Credentials != nil {
+			creds := d.Spec.Credentials.Credentials[:0]
+			for _, c := range d.Spec.Credentials.Credentials {
+				if c.Pass == "" {
+					creds = append(creds, c)
+				}
+			}
+			d.Spec.Credentials.Credentials = creds
+		}
+		d.AddCredential(NewPassCredential(fd.Password))
+	}
+
+	if len(fd.Gateways) > 0 {
+		d.Spec.GatewaySelector = &GatewaySelectorStruct{MatchName: fd.Gateways}
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
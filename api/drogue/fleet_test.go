@@ -0,0 +1,117 @@
+package drogue
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconcileFleet(t *testing.T) {
+	cl, reg := newFakeClient(t)
+	ctx := context.TODO()
+
+	_, _, err := cl.CreateApplication(&Application{Metadata: &NonScopedMetadata{Name: application}})
+	assert.NoError(t, err)
+
+	// car-1 drifted, car-2 is up to date, car-3 is not part of the fleet
+	existing := []FleetDevice{
+		{Name: "car-1", Password: "old", Labels: map[string]string{"fleet": "demo"}},
+		{Name: "car-2", Password: "secret", Labels: map[string]string{"fleet": "demo"}},
+		{Name: "car-3"},
+	}
+	results := cl.ApplyFleetPlanWithContext(ctx, application, FleetPlan{
+		{Action: ActionCreate, Name: "car-1", Desired: &existing[0]},
+		{Action: ActionCreate, Name: "car-2", Desired: &existing[1]},
+		{Action: ActionCreate, Name: "car-3", Desired: &existing[2]},
+	})
+	for _, r := range results {
+		assert.NoError(t, r.Err)
+	}
+	// set by the adapter, must survive
+	_, err = cl.SetDeviceLabels(application, "car-1", map[string]string{"zone": "redhat"})
+	assert.NoError(t, err)
+
+	fleet := []FleetDevice{
+		{Name: "car-0-gw", Password: "gw"},
+		{Name: "car-0", Gateways: []string{"car-0-gw"}, Labels: map[string]string{"fleet": "demo"}},
+		{Name: "car-1", Password: "new", Labels: map[string]string{"fleet": "demo", "model": "taycan"}},
+		{Name: "car-2", Password: "secret", Labels: map[string]string{"fleet": "demo"}},
+	}
+
+	plan, err := cl.PlanFleetWithContext(ctx, application, fleet, nil, false)
+	assert.NoError(t, err)
+	if assert.Len(t, plan, 3) {
+		assert.Equal(t, "+ car-0-gw", plan[0].String())
+		assert.Equal(t, "+ car-0", plan[1].String())
+		assert.Equal(t, `~ car-1: labels.model "" -> "taycan", password`, plan[2].String())
+	}
+
+	plan, err = cl.PlanFleetWithContext(ctx, application, fleet, nil, true)
+	assert.NoError(t, err)
+	if assert.Len(t, plan, 4) {
+		assert.Equal(t, "- car-3", plan[3].String())
+	}
+
+	// a failed change doesn't stop the others
+	reg.reject = "car-0-gw"
+	results = cl.ApplyFleetPlanWithContext(ctx, application, plan)
+	assert.Len(t, results, 4)
+	assert.Error(t, results[0].Err)
+	for _, r := range results[1:] {
+		assert.NoError(t, r.Err)
+	}
+
+	_, car1, err := cl.GetDevice(application, "car-1")
+	assert.NoError(t, err)
+	zone, _ := car1.GetLabel("zone")
+	assert.Equal(t, "redhat", zone)
+	if creds := car1.Credentials(); assert.Len(t, creds, 1) {
+		assert.Equal(t, "new", creds[0].Pass)
+	}
+
+	// only the failed change is left
+	reg.reject = ""
+	plan, err = cl.PlanFleetWithContext(ctx, application, fleet, nil, true)
+	assert.NoError(t, err)
+	if assert.Len(t, plan, 1) {
+		assert.Equal(t, "+ car-0-gw", plan[0].String())
+	}
+
+	_, err = cl.PlanFleetWithContext(ctx, application, append(fleet, fleet[0]), nil, false)
+	assert.Error(t, err)
+}
+
+func TestReconcileFleetWithSelector(t *testing.T) {
+	cl, _ := newFakeClient(t)
+	ctx := context.TODO()
+
+	_, _, err := cl.CreateApplication(&Application{Metadata: &NonScopedMetadata{Name: application}})
+	assert.NoError(t, err)
+
+	// another team's device in the shared application
+	_, _, err = cl.CreateDevice(application, &Device{Metadata: &ScopedMetadata{Name: "other", Labels: map[string]string{"fleet": "other"}}})
+	assert.NoError(t, err)
+
+	// the gateway doesn't carry the fleet's labels
+	fleet := []FleetDevice{
+		{Name: "car-gw", Password: "secret"},
+		{Name: "car-1", Gateways: []string{"car-gw"}, Labels: map[string]string{"fleet": "demo"}},
+		{Name: "car-2", Gateways: []string{"car-gw"}, Labels: map[string]string{"fleet": "demo"}},
+	}
+	opts := &ListOptions{Selector: "fleet=demo"}
+
+	plan, err := cl.PlanFleetWithContext(ctx, application, fleet, opts, true)
+	assert.NoError(t, err)
+	assert.Len(t, plan, 3)
+	for _, r := range cl.ApplyFleetPlanWithContext(ctx, application, plan) {
+		assert.NoError(t, r.Err)
+	}
+
+	plan, err = cl.PlanFleetWithContext(ctx, application, fleet, opts, true)
+	assert.NoError(t, err)
+	assert.Empty(t, plan)
+
+	_, _, err = cl.GetDevice(application, "other")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,194 @@
+package drogue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal"
+)
+
+const (
+	DefaultPageSize = 100 // the page size used by DeviceIterator if ListOptions.Limit is not set
+)
+
+type (
+	// ListOptions filters and pages the result of ListDevices
+	ListOptions struct {
+		Labels   map[string]string // devices must have all labels with exactly these values, e.g. {"zone": "redhat"}
+		Selector string            // additional label selector expressions, e.g. "zone in (redhat,ibm),!archived"
+		Names    []string          // only return devices with one of these names, applied to each page by the client
+		Limit    int               // the maximum number of devices per request, 0 means no limit
+		Offset   int
+	}
+
+	// DeviceIterator walks all pages of a device list lazily, see DrogueClient.DevicesWithContext
+	DeviceIterator struct {
+		ctx         context.Context
+		c           *DrogueClient
+		application string
+		opts        ListOptions
+		page        Devices
+		done        bool
+	}
+)
+
+var (
+	// Done is returned by DeviceIterator.Next when there are no more devices
+	Done = errors.New("no more items in iterator")
+)
+
+// LabelSelector returns the label selector for opts, in the format expected by the registry's 'labels' parameter
+func (opts *ListOptions) LabelSelector() string {
+	keys := make([]string, 0, len(opts.Labels))
+	for k := range opts.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	selector := make([]string, 0, len(keys)+1)
+	for _, k := range keys {
+		selector = append(selector, fmt.Sprintf("%s=%s", k, opts.Labels[k]))
+	}
+	if opts.Selector != "" {
+		selector = append(selector, opts.Selector)
+	}
+	return strings.Join(selector, ",")
+}
+
+// Query returns the URL query parameters for opts
+func (opts *ListOptions) Query() url.Values {
+	q := url.Values{}
+	if selector := opts.LabelSelector(); selector != "" {
+		q.Set("labels", selector)
+	}
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Offset > 0 {
+		q.Set("offset", strconv.Itoa(opts.Offset))
+	}
+	return q
+}
+
+func (opts *ListOptions) filter(devices Devices) Devices {
+	if len(opts.Names) == 0 {
+		return devices
+	}
+
+	names := make(map[string]bool, len(opts.Names))
+	for _, n := range opts.Names {
+		names[n] = true
+	}
+
+	filtered := make(Devices, 0, len(devices))
+	for _, d := range devices {
+		if d.Metadata != nil && names[d.Metadata.Name] {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered
+}
+
+func (c *DrogueClient) ListDevices(application string, opts *ListOptions) (int, Devices, error) {
+	return c.ListDevicesWithContext(context.Background(), application, opts)
+}
+
+// ListDevicesWithContext returns one page of the devices in application that match opts.
+// A nil opts is the same as GetAllDevicesWithContext.
+func (c *DrogueClient) ListDevicesWithContext(ctx context.Context, application string, opts *ListOptions) (int, Devices, error) {
+	if opts == nil {
+		return c.GetAllDevicesWithContext(ctx, application)
+	}
+
+	status, devices, err := c.listDevices(ctx, application, opts)
+	if err != nil {
+		return status, nil, err
+	}
+	return status, opts.filter(devices), nil
+}
+
+func (c *DrogueClient) listDevices(ctx context.Context, application string, opts *ListOptions) (int, Devices, error) {
+	var resp Devices
+
+	uri := fmt.Sprintf(pathDevices, application)
+	if q := opts.Query().Encode(); q != "" {
+		uri = fmt.Sprintf("%s?%s", uri, q)
+	}
+
+	status, err := c.rc.GETWithContext(internal.WithRoute(ctx, pathDevices), uri, &resp)
+	if err != nil {
+		return status, nil, err
+	}
+	return status, resp, nil
+}
+
+func (c *DrogueClient) Devices(application string, opts *ListOptions) *DeviceIterator {
+	return c.DevicesWithContext(context.Background(), application, opts)
+}
+
+// DevicesWithContext returns an iterator over all devices in application that match opts, fetching
+// opts.Limit (or DefaultPageSize) devices at a time, starting at opts.Offset.
+func (c *DrogueClient) DevicesWithContext(ctx context.Context, application string, opts *ListOptions) *DeviceIterator {
+	it := &DeviceIterator{
+		ctx:         ctx,
+		c:           c,
+		application: application,
+	}
+	if opts != nil {
+		it.opts = *opts
+	}
+	if it.opts.Limit <= 0 {
+		it.opts.Limit = DefaultPageSize
+	}
+	return it
+}
+
+// Next returns the next device. Its error is Done if there are no more devices.
+func (it *DeviceIterator) Next() (Device, error) {
+	for len(it.page) == 0 {
+		if it.done {
+			return Device{}, Done
+		}
+		if err := it.fetch(); err != nil {
+			return Device{}, err
+		}
+	}
+
+	d := it.page[0]
+	it.page = it.page[1:]
+	return d, nil
+}
+
+// All drains the iterator
+func (it *DeviceIterator) All() (Devices, error) {
+	var devices Devices
+	for {
+		d, err := it.Next()
+		if err == Done {
+			return devices, nil
+		}
+		if err != nil {
+			return devices, err
+		}
+		devices = append(devices, d)
+	}
+}
+
+func (it *DeviceIterator) fetch() error {
+	_, devices, err := it.c.listDevices(it.ctx, it.application, &it.opts)
+	if err != nil {
+		return err
+	}
+
+	// a short page is the last one, check before filtering by name
+	it.done = len(devices) < it.opts.Limit
+	it.opts.Offset += len(devices)
+	it.page = it.opts.filter(devices)
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package drogue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal"
+)
+
+const (
+	// the patch formats supported by PatchDevice
+	MergePatchType = "application/merge-patch+json" // RFC 7386
+	JSONPatchType  = "application/json-patch+json"  // RFC 6902
+)
+
+type (
+	// JSONPatchOperation is a single operation of a JSON patch. Value is always sent for add, replace and test,
+	// a nil Value sets or tests for null.
+	JSONPatchOperation struct {
+		Op    string      `json:"op"` // add, remove, replace, move, copy or test
+		Path  string      `json:"path"`
+		Value interface{} `json:"value"`
+		From  string      `json:"from,omitempty"`
+	}
+
+	// JSONPatch is a list of operations, applied in order and atomically
+	JSONPatch []JSONPatchOperation
+)
+
+// MarshalJSON omits the value of remove, move and copy operations, they have none
+func (op JSONPatchOperation) MarshalJSON() ([]byte, error) {
+	switch op.Op {
+	case "remove", "move", "copy":
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+			From string `json:"from,omitempty"`
+		}{op.Op, op.Path, op.From})
+	}
+
+	type operation JSONPatchOperation // without the MarshalJSON method
+	return json.Marshal(operation(op))
+}
+
+// NewMetadataPatch returns a merge patch that only sets the given labels and annotations, other metadata is not changed
+func NewMetadataPatch(labels, annotations map[string]string) map[string]interface{} {
+	metadata := make(map[string]interface{})
+	if len(labels) > 0 {
+		metadata["labels"] = labels
+	}
+	if len(annotations) > 0 {
+		metadata["annotations"] = annotations
+	}
+	return map[string]interface{}{"metadata": metadata}
+}
+
+// JSONPointer returns the JSON pointer to the path elements, e.g. JSONPointer("metadata", "labels", "zone")
+func JSONPointer(elements ...string) string {
+	var sb strings.Builder
+	for _, e := range elements {
+		sb.WriteString("/")
+		sb.WriteString(strings.ReplaceAll(strings.ReplaceAll(e, "~", "~0"), "/", "~1"))
+	}
+	return sb.String()
+}
+
+func (c *DrogueClient) PatchDevice(application, name, patchType string, patch interface{}) (int, error) {
+	return c.PatchDeviceWithContext(context.Background(), application, name, patchType, patch)
+}
+
+// PatchDeviceWithContext changes parts of the device without replacing it, patch is a JSONPatch for JSONPatchType,
+// or any value that marshals to a merge patch for MergePatchType. A []byte patch is sent unchanged.
+func (c *DrogueClient) PatchDeviceWithContext(ctx context.Context, application, name, patchType string, patch interface{}) (int, error) {
+	if patchType != MergePatchType && patchType != JSONPatchType {
+		return http.StatusBadRequest, fmt.Errorf("unsupported patch type '%s'", patchType)
+	}
+
+	p, ok := patch.([]byte)
+	if !ok {
+		var err error
+		if p, err = json.Marshal(patch); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+
+	status, err := c.rc.Upload(internal.WithRoute(ctx, pathDevice), http.MethodPatch, fmt.Sprintf(pathDevice, application, name), bytes.NewReader(p), patchType, nil)
+	if err != nil && internal.IsConflict(err) {
+		return status, &ConflictError{Application: application, Name: name, Err: err}
+	}
+	return status, err
+}
+
+func (c *DrogueClient) SetDeviceLabels(application, name string, labels map[string]string) (int, error) {
+	return c.SetDeviceLabelsWithContext(context.Background(), application, name, labels)
+}
+
+// SetDeviceLabelsWithContext sets only the given labels, all other fields of the device are not changed
+func (c *DrogueClient) SetDeviceLabelsWithContext(ctx context.Context, application, name string, labels map[string]string) (int, error) {
+	return c.PatchDeviceWithContext(ctx, application, name, MergePatchType, NewMetadataPatch(labels, nil))
+}
+
+func (c *DrogueClient) SetDeviceAnnotations(application, name string, annotations map[string]string) (int, error) {
+	return c.SetDeviceAnnotationsWithContext(context.Background(), application, name, annotations)
+}
+
+// SetDeviceAnnotationsWithContext sets only the given annotations, all other fields of the device are not changed
+func (c *DrogueClient) SetDeviceAnnotationsWithContext(ctx context.Context, application, name string, annotations map[string]string) (int, error) {
+	return c.PatchDeviceWithContext(ctx, application, name, MergePatchType, NewMetadataPatch(nil, annotations))
+}
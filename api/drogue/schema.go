@@ -1,14 +1,65 @@
 package drogue
 
+import (
+	"time"
+)
+
 type (
 	Token struct {
-		Prefix            string `json:"prefix,omitempty"` // The name of the application the resource is scoped to
+		Prefix            string `json:"prefix,omitempty"` // identifies the token, it is the start of the secret
+		Token             string `json:"token,omitempty"`  // the secret, only returned when the token is created
 		Description       string `json:"description"`
 		CreationTimestamp string `json:"created,omitempty"`
 	}
 
 	Tokens []Token
 
+	Application struct {
+		Metadata *NonScopedMetadata `json:"metadata"`
+		Spec     *ApplicationSpec   `json:"spec,omitempty"`
+		Status   *ApplicationStatus `json:"status,omitempty"`
+	}
+
+	Applications []Application
+
+	NonScopedMetadata struct {
+		Name              string            `json:"name"`
+		UID               string            `json:"uid,omitempty"`
+		CreationTimestamp string            `json:"creationTimestamp,omitempty"`
+		DeletionTimestamp string            `json:"deletionTimestamp,omitempty"`
+		Generation        int               `json:"generation,omitempty"`
+		ResourceVersion   string            `json:"resourceVersion,omitempty"`
+		Finalizers        []string          `json:"finalizers,omitempty"`
+		Annotations       map[string]string `json:"annotations,omitempty"`
+		Labels            map[string]string `json:"labels,omitempty"`
+	}
+
+	ApplicationSpec struct {
+		Kafka        *KafkaSpec        `json:"kafka,omitempty"`
+		TrustAnchors *TrustAnchorsSpec `json:"trustAnchors,omitempty"`
+	}
+
+	KafkaSpec struct {
+		External *ExternalKafkaSpec `json:"external,omitempty"` // the internal Kafka is used if not set
+	}
+
+	ExternalKafkaSpec struct {
+		BootstrapServers string            `json:"bootstrapServers"`
+		Properties       map[string]string `json:"properties,omitempty"`
+	}
+
+	TrustAnchorsSpec struct {
+		Anchors []TrustAnchor `json:"anchors"`
+	}
+
+	TrustAnchor struct {
+		Certificate string `json:"certificate"` // PEM, base64 encoded
+	}
+
+	ApplicationStatus struct {
+		Conditions []ConditionStruct `json:"conditions"`
+	}
+
 	Device struct {
 		Metadata *ScopedMetadata `json:"metadata"`
 		Spec     *DeviceSpec     `json:"spec,omitempty"`
@@ -33,21 +84,38 @@ type (
 	DeviceSpec struct {
 		Description     string                  `json:"description,omitempty"`
 		Authentication  *DeviceCredentialStruct `json:"authentication,omitempty"`
+		Credentials     *CredentialsStruct      `json:"credentials,omitempty"`
 		GatewaySelector *GatewaySelectorStruct  `json:"gatewaySelector,omitempty"`
 		Alias           *AliasStruct            `json:"alias,omitempty"`
 	}
 
+	CredentialsStruct struct {
+		Credentials []DeviceCredentialStruct `json:"credentials"`
+	}
+
+	// DeviceCredentialStruct holds exactly one of User, Pass or PSK. X.509 certificates are
+	// matched to devices by their subject, see Device.AddCertificate.
 	DeviceCredentialStruct struct {
-		Description string      `json:"description,omitempty"`
-		User        *UserStruct `json:"user,omitempty"`
-		Pass        string      `json:"pass,omitempty"`
-		//UserCredential UserCredentialStruct `json:"user"`
-		//PassCredential PasswordStruct       `json:"pass"`
+		Description string              `json:"description,omitempty"`
+		User        *UserStruct         `json:"user,omitempty"`
+		Pass        string              `json:"pass,omitempty"`
+		PSK         *PreSharedKeyStruct `json:"psk,omitempty"`
 	}
 
 	UserStruct struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
+		Unique   bool   `json:"unique,omitempty"` // the username is unique across the application
+	}
+
+	PreSharedKeyStruct struct {
+		Key      []byte          `json:"key"` // base64 encoded
+		Validity *ValidityStruct `json:"validity,omitempty"`
+	}
+
+	ValidityStruct struct {
+		NotBefore time.Time `json:"notBefore"`
+		NotAfter  time.Time `json:"notAfter"`
 	}
 
 	GatewaySelectorStruct struct {
@@ -64,8 +132,10 @@ type (
 
 	ConditionStruct struct {
 		Type               string `json:"type"`
-		Status             string `json:"status"`
-		LastTransitionTime string `json:"lastTransitionTime"`
+		Status             string `json:"status"`             // ConditionTrue, ConditionFalse or ConditionUnknown
+		LastTransitionTime string `json:"lastTransitionTime"` // RFC 3339, see LastTransition
+		Reason             string `json:"reason,omitempty"`
+		Message            string `json:"message,omitempty"`
 	}
 )
 
@@ -97,6 +167,34 @@ func (d *Device) GetAnnotation(k string) (string, bool) {
 	return d.Metadata.GetAnnotation(k)
 }
 
+func (a *Application) SetLabel(k, v string) {
+	if a.Metadata == nil {
+		a.Metadata = &NonScopedMetadata{}
+	}
+	a.Metadata.SetLabel(k, v)
+}
+
+func (a *Application) GetLabel(k string) (string, bool) {
+	if a.Metadata == nil {
+		return "", false
+	}
+	return a.Metadata.GetLabel(k)
+}
+
+func (m *NonScopedMetadata) SetLabel(k, v string) {
+	if m.Labels == nil {
+		m.Labels = make(map[string]string)
+	}
+	m.Labels[k] = v
+}
+
+func (m *NonScopedMetadata) GetLabel(k string) (string, bool) {
+	if v, ok := m.Labels[k]; ok {
+		return v, true
+	}
+	return "", false
+}
+
 func (m *ScopedMetadata) SetLabel(k, v string) {
 	if m.Labels == nil {
 		m.Labels = make(map[string]string)
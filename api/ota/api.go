@@ -3,9 +3,9 @@ package ota
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 
-	"github.com/txsvc/apikit/config"
 	"github.com/txsvc/stdlib/v2"
 
 	"github.com/redhat-partner-ecosystem/shadowcar/internal"
@@ -14,27 +14,46 @@ import (
 
 const (
 	CampaignManagerHttpEndpoint = "CAMPAIGN_MANAGER_HTTP_ENDPOINT"
+	CampaignManagerTokenURL     = "CAMPAIGN_MANAGER_TOKEN_URL"
 
-	CampaignManagerClientID     = "CAMPAIGN_MANAGER_CLIENT_ID"
-	CampaignManagerClientSecret = "CAMPAIGN_MANAGER_CLIENT_SECRET"
-	CampaignManagerAccessToken  = "CAMPAIGN_MANAGER_ACCESS_TOKEN"
+	CampaignManagerClientID       = "CAMPAIGN_MANAGER_CLIENT_ID"
+	CampaignManagerClientSecret   = "CAMPAIGN_MANAGER_CLIENT_SECRET"
+	CampaignManagerAccessToken    = "CAMPAIGN_MANAGER_ACCESS_TOKEN"
+	CampaignManagerCredentialsDir = "CAMPAIGN_MANAGER_CREDENTIALS_DIR" // files with the credentials, see internal.FileCredentials
 
+	CampaignManagerService  = "campaignmanager" // the service name used in profiles
 	CampaignManagerApiAgent = "shadowcar/campaignmanager"
+
+	// API routes, also used to label the request metrics
+	pathCampaigns         = "/campaign"
+	pathCampaign          = "/campaign/%s"
+	pathCampaignExecution = "/campaign/%s/execution"
+	pathVehicleGroups     = "/vehicle_group"
+	pathVehicleGroup      = "/vehicle_group/%s"
+	pathUpdatePackage     = "update_package" // metrics label only, the URI is part of the campaign
 )
 
 type (
 	CampaignManagerClient struct {
-		rc internal.RestClient
+		rc *internal.RestClient
 	}
 )
 
 func NewCampaignManagerClient(ctx context.Context, opts ...internal.ClientOption) (*CampaignManagerClient, error) {
 
-	httpClient := internal.NewLoggingTransport(http.DefaultTransport)
 	ds := &settings.DialSettings{
+		Service:     CampaignManagerService,
 		Endpoint:    stdlib.GetString(CampaignManagerHttpEndpoint, ""),
+		TokenURL:    stdlib.GetString(CampaignManagerTokenURL, ""),
 		UserAgent:   CampaignManagerApiAgent,
 		Credentials: credentials(),
+		TLS:         internal.TLSSettingsFromEnv(""),
+
+		CredentialsDir: stdlib.GetString(CampaignManagerCredentialsDir, ""),
+	}
+
+	if err := internal.ApplyProfileFromEnv(ds, opts...); err != nil {
+		return nil, err
 	}
 
 	// apply options
@@ -44,17 +63,22 @@ func NewCampaignManagerClient(ctx context.Context, opts ...internal.ClientOption
 		}
 	}
 
+	if err := internal.ResolveCredentials(ctx, ds); err != nil {
+		return nil, err
+	}
+
 	// do some basic validation
 	if ds.Endpoint == "" {
 		return nil, fmt.Errorf("missing CAMPAIGN_MANAGER_HTTP_ENDPOINT")
 	}
 
+	rc, err := internal.NewRestClientFromSettings(ds)
+	if err != nil {
+		return nil, err
+	}
+
 	return &CampaignManagerClient{
-		rc: internal.RestClient{
-			HttpClient: httpClient,
-			Settings:   ds,
-			Trace:      stdlib.GetString(config.ForceTraceENV, ""),
-		},
+		rc: rc,
 	}, nil
 }
 
@@ -70,66 +94,118 @@ func credentials() *settings.Credentials {
 	return c
 }
 
-func (c *CampaignManagerClient) GetAllCampaigns() (int, Campaigns) {
+func (c *CampaignManagerClient) GetAllCampaigns() (int, Campaigns, error) {
+	return c.GetAllCampaignsWithContext(context.Background())
+}
+
+func (c *CampaignManagerClient) GetAllCampaignsWithContext(ctx context.Context) (int, Campaigns, error) {
 	var resp Campaigns
 
-	status, _ := c.rc.GET("/campaign", &resp)
-	if status != http.StatusOK {
-		return status, nil
+	status, err := c.rc.GETWithContext(internal.WithRoute(ctx, pathCampaigns), pathCampaigns, &resp)
+	if err != nil {
+		return status, nil, err
 	}
 
-	return status, resp
+	return status, resp, nil
+}
+
+func (c *CampaignManagerClient) GetCampaign(campaignId string) (int, Campaign, error) {
+	return c.GetCampaignWithContext(context.Background(), campaignId)
 }
 
-func (c *CampaignManagerClient) GetCampaign(campaignId string) (int, Campaign) {
+func (c *CampaignManagerClient) GetCampaignWithContext(ctx context.Context, campaignId string) (int, Campaign, error) {
 	var resp Campaign
 
-	status, _ := c.rc.GET(fmt.Sprintf("/campaign/%s", campaignId), &resp)
-	if status != http.StatusOK {
-		return status, Campaign{}
+	status, err := c.rc.GETWithContext(internal.WithRoute(ctx, pathCampaign), fmt.Sprintf(pathCampaign, campaignId), &resp)
+	if err != nil {
+		return status, Campaign{}, err
 	}
 
-	return status, resp
+	return status, resp, nil
 }
 
-func (c *CampaignManagerClient) GetCampaignExecution(campaignId string) (int, CampaignExecutions) {
+// DownloadUpdatePackage writes the campaign's update package to w, starting at offset to resume an interrupted download.
+// It returns the number of bytes written. The package URI may point to another host, e.g. a CDN, which gets no credentials.
+func (c *CampaignManagerClient) DownloadUpdatePackage(ctx context.Context, campaign *Campaign, offset int64, w io.Writer) (int, int64, error) {
+	if campaign.UpdatePackeURI == "" {
+		return http.StatusNotFound, 0, fmt.Errorf("campaign '%s' has no update package", campaign.CampaignID)
+	}
+
+	sr := &internal.StreamRequest{
+		URI: campaign.UpdatePackeURI,
+	}
+	if offset > 0 {
+		sr.Range = internal.ByteRange(offset, -1)
+	}
+
+	status, resp, err := c.rc.Stream(internal.WithRoute(ctx, pathUpdatePackage), sr)
+	if err != nil {
+		return status, 0, err
+	}
+	defer resp.Body.Close()
+
+	if offset > 0 && status != http.StatusPartialContent {
+		return status, 0, fmt.Errorf("range requests not supported for '%s'", campaign.UpdatePackeURI)
+	}
+
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return http.StatusInternalServerError, n, err
+	}
+	return status, n, nil
+}
+
+func (c *CampaignManagerClient) GetCampaignExecution(campaignId string) (int, CampaignExecutions, error) {
+	return c.GetCampaignExecutionWithContext(context.Background(), campaignId)
+}
+
+func (c *CampaignManagerClient) GetCampaignExecutionWithContext(ctx context.Context, campaignId string) (int, CampaignExecutions, error) {
 	var resp CampaignExecutions
 
 	// FIXME ?limit=10&offset=20
 
-	status, _ := c.rc.GET(fmt.Sprintf("/campaign/%s/execution", campaignId), &resp)
-	if status != http.StatusOK {
-		return status, CampaignExecutions{}
+	status, err := c.rc.GETWithContext(internal.WithRoute(ctx, pathCampaignExecution), fmt.Sprintf(pathCampaignExecution, campaignId), &resp)
+	if err != nil {
+		return status, CampaignExecutions{}, err
 	}
 
-	return status, resp
+	return status, resp, nil
 }
 
 func (c *CampaignManagerClient) ExecuteCampaign(campaignId string) error {
-	status, err := c.rc.POST(fmt.Sprintf("/campaign/%s/execution", campaignId), nil, nil)
-	if status != http.StatusCreated {
-		return err
-	}
-	return nil
+	return c.ExecuteCampaignWithContext(context.Background(), campaignId)
+}
+
+func (c *CampaignManagerClient) ExecuteCampaignWithContext(ctx context.Context, campaignId string) error {
+	_, err := c.rc.POSTWithContext(internal.WithRoute(ctx, pathCampaignExecution), fmt.Sprintf(pathCampaignExecution, campaignId), nil, nil)
+	return err
 }
 
-func (c *CampaignManagerClient) GetVehicleGroups() (int, VehicleGroups) {
+func (c *CampaignManagerClient) GetVehicleGroups() (int, VehicleGroups, error) {
+	return c.GetVehicleGroupsWithContext(context.Background())
+}
+
+func (c *CampaignManagerClient) GetVehicleGroupsWithContext(ctx context.Context) (int, VehicleGroups, error) {
 	var resp VehicleGroups
 
-	if status, _ := c.rc.GET("/vehicle_group", &resp); status != http.StatusOK {
-		return status, VehicleGroups{}
+	if status, err := c.rc.GETWithContext(internal.WithRoute(ctx, pathVehicleGroups), pathVehicleGroups, &resp); err != nil {
+		return status, VehicleGroups{}, err
 	}
 
-	return http.StatusOK, resp
+	return http.StatusOK, resp, nil
+}
+
+func (c *CampaignManagerClient) GetVehicleGroup(vehicleGroupId string) (int, VehicleGroup, error) {
+	return c.GetVehicleGroupWithContext(context.Background(), vehicleGroupId)
 }
 
-func (c *CampaignManagerClient) GetVehicleGroup(vehicleGroupId string) (int, VehicleGroup) {
+func (c *CampaignManagerClient) GetVehicleGroupWithContext(ctx context.Context, vehicleGroupId string) (int, VehicleGroup, error) {
 	var resp VehicleGroup
 
-	status, _ := c.rc.GET(fmt.Sprintf("/vehicle_group/%s", vehicleGroupId), &resp)
-	if status != http.StatusOK {
-		return status, VehicleGroup{}
+	status, err := c.rc.GETWithContext(internal.WithRoute(ctx, pathVehicleGroup), fmt.Sprintf(pathVehicleGroup, vehicleGroupId), &resp)
+	if err != nil {
+		return status, VehicleGroup{}, err
 	}
 
-	return status, resp
+	return status, resp, nil
 }
@@ -1,10 +1,15 @@
 package ota
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/redhat-partner-ecosystem/shadowcar/internal"
 	"github.com/rs/zerolog"
@@ -31,11 +36,32 @@ func init() {
 	//zerolog.SetGlobalLevel(zerolog.InfoLevel)
 }
 
+// newCassetteClient replays testdata/<test>.json. To record it against a live campaign manager,
+// run the test with CASSETTE_MODE=record and the usual CAMPAIGN_MANAGER_* environment.
+func newCassetteClient(t *testing.T) *CampaignManagerClient {
+	c, err := internal.NewCassetteFromEnv(filepath.Join("testdata", t.Name()+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := []internal.ClientOption{internal.WithCassette(c)}
+	if c.Mode == internal.CassetteRecord {
+		t.Cleanup(func() { assert.NoError(t, c.Save()) })
+	} else {
+		opts = append(opts, internal.WithEndpoint(internal.ReplayEndpoint), internal.WithCredentials("foo", "bar"), internal.WithTokenURL(""))
+	}
+
+	cl, err := NewCampaignManagerClient(context.TODO(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cl
+}
+
 func TestNewCampaignManagerClient(t *testing.T) {
 
-	cl, err := NewCampaignManagerClient(context.TODO())
+	cl := newCassetteClient(t)
 	assert.NotNil(t, cl)
-	assert.NoError(t, err)
 
 	assert.NotNil(t, cl.rc.HttpClient)
 	assert.NotNil(t, cl.rc.Settings)
@@ -64,11 +90,10 @@ func TestNewCampaignManagerClientWithOptions(t *testing.T) {
 
 func TestGetAllCampaigns(t *testing.T) {
 
-	cl, err := NewCampaignManagerClient(context.TODO())
-	assert.NotNil(t, cl)
-	assert.NoError(t, err)
+	cl := newCassetteClient(t)
 
-	status, resp := cl.GetAllCampaigns()
+	status, resp, err := cl.GetAllCampaigns()
+	assert.NoError(t, err)
 	assert.NotNil(t, resp)
 	assert.NotEmpty(t, resp)
 	assert.Equal(t, http.StatusOK, status)
@@ -78,17 +103,17 @@ func TestGetAllCampaigns(t *testing.T) {
 
 func TestGetCampaign(t *testing.T) {
 
-	cl, err := NewCampaignManagerClient(context.TODO())
-	assert.NotNil(t, cl)
-	assert.NoError(t, err)
+	cl := newCassetteClient(t)
 
-	status, campaigns := cl.GetAllCampaigns()
+	status, campaigns, err := cl.GetAllCampaigns()
+	assert.NoError(t, err)
 	assert.NotNil(t, campaigns)
 	assert.NotEmpty(t, campaigns)
 	assert.Equal(t, http.StatusOK, status)
 
 	if len(campaigns) > 0 {
-		status, resp := cl.GetCampaign(campaigns[0].CampaignID)
+		status, resp, err := cl.GetCampaign(campaigns[0].CampaignID)
+		assert.NoError(t, err)
 
 		assert.NotNil(t, resp)
 		assert.NotEmpty(t, resp)
@@ -103,19 +128,18 @@ func TestGetCampaign(t *testing.T) {
 
 func TestExecuteCampaign(t *testing.T) {
 
-	cl, err := NewCampaignManagerClient(context.TODO())
-	assert.NotNil(t, cl)
-	assert.NoError(t, err)
+	cl := newCassetteClient(t)
 
 	// check the tick/tock logic
-	err = cl.ExecuteCampaign(campaignIdZone1)
+	err := cl.ExecuteCampaign(campaignIdZone1)
 
 	if err == nil {
 		err = cl.ExecuteCampaign(campaignIdZone1)
 		assert.Error(t, err)
 		log.Error().Err(err).Msg("execute campaignIdZone1")
 
-		status, resp := cl.GetCampaignExecution(campaignIdZone1)
+		status, resp, err := cl.GetCampaignExecution(campaignIdZone1)
+		assert.NoError(t, err)
 		assert.NotNil(t, resp)
 		assert.NotEmpty(t, resp)
 		assert.Equal(t, http.StatusOK, status)
@@ -125,7 +149,8 @@ func TestExecuteCampaign(t *testing.T) {
 		err = cl.ExecuteCampaign(campaignIdZone2)
 		assert.NoError(t, err)
 
-		status, resp := cl.GetCampaignExecution(campaignIdZone2)
+		status, resp, err := cl.GetCampaignExecution(campaignIdZone2)
+		assert.NoError(t, err)
 		assert.NotNil(t, resp)
 		assert.NotEmpty(t, resp)
 		assert.Equal(t, http.StatusOK, status)
@@ -134,11 +159,10 @@ func TestExecuteCampaign(t *testing.T) {
 
 func TestGetVehicleGroups(t *testing.T) {
 
-	cl, err := NewCampaignManagerClient(context.TODO())
-	assert.NotNil(t, cl)
-	assert.NoError(t, err)
+	cl := newCassetteClient(t)
 
-	status, resp := cl.GetVehicleGroups()
+	status, resp, err := cl.GetVehicleGroups()
+	assert.NoError(t, err)
 
 	assert.NotNil(t, resp)
 	assert.NotEmpty(t, resp)
@@ -148,17 +172,17 @@ func TestGetVehicleGroups(t *testing.T) {
 
 func TestGetVehicleGroup(t *testing.T) {
 
-	cl, err := NewCampaignManagerClient(context.TODO())
-	assert.NotNil(t, cl)
-	assert.NoError(t, err)
+	cl := newCassetteClient(t)
 
-	status, campaigns := cl.GetAllCampaigns()
+	status, campaigns, err := cl.GetAllCampaigns()
+	assert.NoError(t, err)
 	assert.NotNil(t, campaigns)
 	assert.NotEmpty(t, campaigns)
 	assert.Equal(t, http.StatusOK, status)
 
 	if len(campaigns) > 0 {
-		status, resp := cl.GetVehicleGroup(campaigns[0].VehicleGroupID)
+		status, resp, err := cl.GetVehicleGroup(campaigns[0].VehicleGroupID)
+		assert.NoError(t, err)
 
 		assert.NotNil(t, resp)
 		assert.NotEmpty(t, resp)
@@ -170,3 +194,34 @@ func TestGetVehicleGroup(t *testing.T) {
 		assert.Fail(t, "no campaigns found")
 	}
 }
+
+func TestDownloadUpdatePackage(t *testing.T) {
+	pkg := strings.Repeat("firmware", 64)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "update.bin", time.Time{}, strings.NewReader(pkg))
+	}))
+	defer srv.Close()
+
+	cl, err := NewCampaignManagerClient(context.TODO(), internal.WithEndpoint(srv.URL), internal.WithCredentials("foo", "bar"))
+	assert.NoError(t, err)
+
+	campaign := &Campaign{CampaignID: campaignId, UpdatePackeURI: srv.URL + "/packages/update.bin"}
+
+	var buf bytes.Buffer
+	status, n, err := cl.DownloadUpdatePackage(context.TODO(), campaign, 0, &buf)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, int64(len(pkg)), n)
+
+	// resume
+	buf.Reset()
+	status, n, err = cl.DownloadUpdatePackage(context.TODO(), campaign, 500, &buf)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, status)
+	assert.Equal(t, int64(len(pkg)-500), n)
+	assert.Equal(t, pkg[500:], buf.String())
+
+	_, _, err = cl.DownloadUpdatePackage(context.TODO(), &Campaign{CampaignID: campaignId}, 0, &buf)
+	assert.Error(t, err)
+}
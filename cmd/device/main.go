@@ -2,12 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"log"
-	"net/http"
+	"os"
+	"time"
+
+	"github.com/txsvc/stdlib/v2"
 
 	"github.com/redhat-partner-ecosystem/shadowcar/api/drogue"
+	"github.com/redhat-partner-ecosystem/shadowcar/internal"
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
 )
 
 func main() {
@@ -15,16 +22,63 @@ func main() {
 	var application string
 	var deviceName string
 	var devicePassword string
+	var configFile string
+	var profileName string
+	var createApplication bool
+	var certificateFile string
+	var wait time.Duration
+	var manifestFile string
+	var selector string
+	var planOnly bool
+	var prune bool
 
-	flag.StringVar(&application, "application", "bobbycar", "Drogue App")
+	flag.StringVar(&application, "application", drogue.DefaultApplication, "Drogue App")
 	flag.StringVar(&deviceName, "name", "WP0AA2991YS620631", "Device name")
 	flag.StringVar(&devicePassword, "password", "car123456", "Device password")
+	flag.StringVar(&configFile, "config", stdlib.GetString(settings.ConfigFile, ""), "Config file with the connection profiles")
+	flag.StringVar(&profileName, "profile", stdlib.GetString(settings.ProfileName, settings.DefaultProfile), "Connection profile")
+	flag.BoolVar(&createApplication, "create-application", false, "Create the Drogue App if it does not exist")
+	flag.StringVar(&certificateFile, "certificate", "", "PEM file with the device's X.509 client certificate")
+	flag.DurationVar(&wait, "wait", 0, "Wait up to this long until Drogue reports the devices as ready, e.g. 2m. 0 returns immediately")
+	flag.StringVar(&manifestFile, "manifest", "", "YAML or CSV fleet manifest, reconciles all its devices instead of a single one")
+	flag.StringVar(&selector, "selector", "", "Label selector for the devices managed by the manifest, e.g. fleet=demo")
+	flag.BoolVar(&planOnly, "plan", false, "Only show the changes the manifest requires")
+	flag.BoolVar(&prune, "prune", false, "Delete devices that are selected by -selector but not in the manifest")
+	flag.Parse()
+
+	var opts []internal.ClientOption
+	if configFile != "" {
+		profile, err := settings.LoadProfile(configFile, profileName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, internal.WithProfile(profile))
+	}
 
-	cl, err := drogue.NewDrogueClient(context.TODO())
+	cl, err := drogue.NewDrogueClient(context.TODO(), opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if createApplication {
+		if _, _, err := cl.GetApplication(application); internal.IsNotFound(err) {
+			app := drogue.Application{
+				Metadata: &drogue.NonScopedMetadata{
+					Name: application,
+				},
+			}
+			if _, _, err := cl.CreateApplication(&app); err != nil {
+				log.Fatal(fmt.Errorf("can not create application '%s': %w", application, err))
+			}
+		} else if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if manifestFile != "" {
+		os.Exit(reconcile(cl, application, manifestFile, selector, planOnly, prune, wait))
+	}
+
 	gatewayDeviceName := fmt.Sprintf("%s-gw", deviceName)
 
 	gw_device := drogue.Device{
@@ -39,8 +93,8 @@ func main() {
 		},
 	}
 
-	if status, _ := cl.CreateDevice(application, &gw_device); status != http.StatusCreated {
-		log.Fatal(fmt.Errorf("can not create gateway device '%s'", gw_device.Metadata.Name))
+	if _, _, err := cl.CreateDevice(application, &gw_device); err != nil {
+		log.Fatal(fmt.Errorf("can not create gateway device '%s': %w", gw_device.Metadata.Name, err))
 	}
 
 	device := drogue.Device{
@@ -55,9 +109,104 @@ func main() {
 		},
 	}
 
-	if status, _ := cl.CreateDevice(application, &device); status != http.StatusCreated {
+	if certificateFile != "" {
+		cert, err := loadCertificate(certificateFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := device.AddCertificate(cert); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if _, _, err := cl.CreateDevice(application, &device); err != nil {
 		cl.DeleteDevice(application, gatewayDeviceName) // try to delete the gateway, ignore the outcome
-		log.Fatal(fmt.Errorf("can not create device '%s'", device.Metadata.Name))
+		log.Fatal(fmt.Errorf("can not create device '%s': %w", device.Metadata.Name, err))
+	}
+
+	if wait > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), wait)
+		defer cancel()
+
+		for _, name := range []string{gatewayDeviceName, deviceName} {
+			if _, _, err := cl.WaitForDeviceCondition(ctx, application, name, drogue.ConditionReady, drogue.ConditionTrue); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+}
+
+// reconcile makes the registry match the manifest and returns the exit code
+func reconcile(cl *drogue.DrogueClient, application, manifestFile, selector string, planOnly, prune bool, wait time.Duration) int {
+	// the application is shared, without a selector every other device would be deleted
+	if prune && selector == "" {
+		log.Fatal("-prune requires -selector")
+	}
+
+	manifest, err := LoadManifest(manifestFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fleet, err := manifest.Fleet()
+	if err != nil {
+		log.Fatal(err)
 	}
 
+	var opts *drogue.ListOptions
+	if selector != "" {
+		opts = &drogue.ListOptions{Selector: selector}
+	}
+
+	plan, err := cl.PlanFleet(application, fleet, opts, prune)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, change := range plan {
+		fmt.Println(change)
+	}
+	fmt.Printf("%d change(s)\n", len(plan))
+
+	if planOnly || len(plan) == 0 {
+		return 0
+	}
+
+	failed := 0
+	for _, r := range cl.ApplyFleetPlan(application, plan) {
+		if r.Err != nil {
+			failed++
+			fmt.Printf("failed to %s '%s': %v\n", r.Action, r.Name, r.Err)
+			continue
+		}
+
+		if r.Action == drogue.ActionCreate && wait > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), wait)
+			_, _, err := cl.WaitForDeviceCondition(ctx, application, r.Name, drogue.ConditionReady, drogue.ConditionTrue)
+			cancel()
+
+			if err != nil {
+				failed++
+				fmt.Println(err)
+			}
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d change(s) failed\n", failed, len(plan))
+		return 1
+	}
+	return 0
+}
+
+func loadCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate in '%s'", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
 }
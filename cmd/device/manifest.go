@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/api/drogue"
+)
+
+type (
+	// Manifest lists the vehicles of a fleet, as YAML:
+	//
+	//	devices:
+	//	  - vin: WP0AA2991YS620631
+	//	    password: car123456
+	//	    gateway: WP0AA2991YS620631-gw
+	//	    labels:
+	//	      fleet: demo
+	//
+	// or as CSV with the header 'vin,password,gateway,labels,annotations' and 'k=v;k=v' maps.
+	Manifest struct {
+		Devices []ManifestDevice `yaml:"devices"`
+	}
+
+	ManifestDevice struct {
+		VIN         string            `yaml:"vin"`
+		Password    string            `yaml:"password"`
+		Gateway     string            `yaml:"gateway"`
+		Labels      map[string]string `yaml:"labels"`
+		Annotations map[string]string `yaml:"annotations"`
+	}
+)
+
+// LoadManifest reads a YAML or, if the file ends with .csv, a CSV manifest
+func LoadManifest(path string) (*Manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return parseCSVManifest(f)
+	}
+
+	var m Manifest
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid manifest '%s': %w", path, err)
+	}
+	return &m, nil
+}
+
+func parseCSVManifest(r io.Reader) (*Manifest, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return &Manifest{}, nil
+	}
+
+	columns := make(map[string]int)
+	for i, h := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	if _, ok := columns["vin"]; !ok {
+		return nil, fmt.Errorf("missing column 'vin'")
+	}
+
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	m := &Manifest{}
+	for n, record := range records[1:] {
+		labels, err := parseMap(field(record, "labels"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n+2, err)
+		}
+		annotations, err := parseMap(field(record, "annotations"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n+2, err)
+		}
+
+		m.Devices = append(m.Devices, ManifestDevice{
+			VIN:         field(record, "vin"),
+			Password:    field(record, "password"),
+			Gateway:     field(record, "gateway"),
+			Labels:      labels,
+			Annotations: annotations,
+		})
+	}
+	return m, nil
+}
+
+// parseMap parses 'k=v;k=v'
+func parseMap(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	m := make(map[string]string)
+	for _, kv := range strings.Split(s, ";") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("invalid key=value '%s'", kv)
+		}
+		m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return m, nil
+}
+
+// Fleet returns the desired devices. Like a single device provisioned with flags, a vehicle whose gateway
+// is not listed on its own gets a gateway device with the vehicle's password, and no password itself.
+// All vehicles behind such a gateway must use the same password.
+func (m *Manifest) Fleet() ([]drogue.FleetDevice, error) {
+	listed := make(map[string]bool, len(m.Devices))
+	for _, d := range m.Devices {
+		listed[d.VIN] = true
+	}
+
+	var gateways, devices []drogue.FleetDevice
+	implicit := make(map[string]string) // gateway -> password
+	for _, d := range m.Devices {
+		fd := drogue.FleetDevice{
+			Name:        d.VIN,
+			Password:    d.Password,
+			Labels:      d.Labels,
+			Annotations: d.Annotations,
+		}
+
+		if d.Gateway != "" {
+			fd.Gateways = []string{d.Gateway}
+			if !listed[d.Gateway] {
+				password, ok := implicit[d.Gateway]
+				if !ok {
+					gateways = append(gateways, drogue.FleetDevice{Name: d.Gateway, Password: d.Password})
+					implicit[d.Gateway] = d.Password
+				} else if password != d.Password {
+					return nil, fmt.Errorf("vehicles behind gateway '%s' have different passwords", d.Gateway)
+				}
+				fd.Password = ""
+			}
+		}
+		devices = append(devices, fd)
+	}
+
+	// create the gateways first
+	return append(gateways, devices...), nil
+}
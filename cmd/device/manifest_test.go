@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadManifest(t *testing.T) {
+	dir := t.TempDir()
+
+	yamlFile := filepath.Join(dir, "fleet.yaml")
+	os.WriteFile(yamlFile, []byte(`devices:
+  - vin: WP0AA2991YS620631
+    password: car123456
+    gateway: WP0AA2991YS620631-gw
+    labels:
+      fleet: demo
+  - vin: WP0AA2991YS620632
+    password: car654321
+    annotations:
+      owner: redhat
+`), 0600)
+
+	csvFile := filepath.Join(dir, "fleet.csv")
+	os.WriteFile(csvFile, []byte(`vin,password,gateway,labels,annotations
+WP0AA2991YS620631,car123456,WP0AA2991YS620631-gw,fleet=demo,
+WP0AA2991YS620632,car654321,,,owner=redhat
+`), 0600)
+
+	for _, path := range []string{yamlFile, csvFile} {
+		m, err := LoadManifest(path)
+		assert.NoError(t, err)
+
+		fleet, err := m.Fleet()
+		assert.NoError(t, err)
+		if assert.Len(t, fleet, 3, path) {
+			// the implicit gateway gets the password
+			assert.Equal(t, "WP0AA2991YS620631-gw", fleet[0].Name)
+			assert.Equal(t, "car123456", fleet[0].Password)
+
+			assert.Equal(t, "WP0AA2991YS620631", fleet[1].Name)
+			assert.Empty(t, fleet[1].Password)
+			assert.Equal(t, []string{"WP0AA2991YS620631-gw"}, fleet[1].Gateways)
+			assert.Equal(t, map[string]string{"fleet": "demo"}, fleet[1].Labels)
+
+			assert.Equal(t, "car654321", fleet[2].Password)
+			assert.Equal(t, map[string]string{"owner": "redhat"}, fleet[2].Annotations)
+		}
+	}
+
+	// every vehicle behind an implicit gateway has no password of its own
+	m := &Manifest{Devices: []ManifestDevice{
+		{VIN: "car-1", Password: "secret", Gateway: "gw"},
+		{VIN: "car-2", Password: "secret", Gateway: "gw"},
+	}}
+	fleet, err := m.Fleet()
+	assert.NoError(t, err)
+	if assert.Len(t, fleet, 3) {
+		assert.Equal(t, "secret", fleet[0].Password)
+		assert.Empty(t, fleet[1].Password)
+		assert.Empty(t, fleet[2].Password)
+	}
+
+	m.Devices[1].Password = "other"
+	_, err = m.Fleet()
+	assert.Error(t, err)
+
+	os.WriteFile(yamlFile, []byte("devices:\n  - vim: WP0AA2991YS620631\n"), 0600)
+	_, err = LoadManifest(yamlFile)
+	assert.Error(t, err)
+
+	os.WriteFile(csvFile, []byte("vin,labels\nWP0AA2991YS620631,fleet\n"), 0600)
+	_, err = LoadManifest(csvFile)
+	assert.Error(t, err)
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
 	"net/http"
 	"os"
@@ -10,6 +9,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/redhat-partner-ecosystem/shadowcar/api/drogue"
 	"github.com/redhat-partner-ecosystem/shadowcar/internal"
 	"github.com/rs/zerolog/log"
 
@@ -17,8 +17,7 @@ import (
 )
 
 const (
-	application = "bobbycar" // the Drogue application
-	VIN         = "test-car1"
+	VIN = "test-car1"
 	//VIN = "WBAFR9C59BC270614"
 )
 
@@ -113,7 +112,7 @@ func main() {
 
 	// simulate cars ...
 	vin := stdlib.GetString("VIN", VIN)
-	go simulate(vin, application)
+	go simulate(vin, stdlib.GetString("APPLICATION", drogue.DefaultApplication))
 
 	// background stuff goes here ...
 	for !shutdown {
@@ -125,19 +124,12 @@ func simulate(vin, application string) {
 	//user := fmt.Sprintf("%s-gw@%s", vin, application)
 	log.Info().Msg(fmt.Sprintf("simulating car with VIN='%s'", vin))
 
-	// connect to the HTTP endpoint
+	// connect to the HTTP endpoint. A private CA is configured with TLS_CA_FILE,
+	// certificate verification is only skipped with TLS_INSECURE_SKIP_VERIFY=true.
 	cl, err := internal.NewRestClient(context.TODO())
 	if err != nil {
 		log.Fatal().Err(err).Msg(err.Error())
 	}
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true, // server certificate is not trusted
-			},
-		},
-	}
-	cl.SetClient(client)
 
 	// main event loop
 
@@ -4,43 +4,58 @@ import (
 	"context"
 	"crypto/tls"
 	"net/http"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
-	"github.com/txsvc/stdlib/v2"
 
 	"github.com/redhat-partner-ecosystem/shadowcar/internal"
 )
 
+// newCassetteClient replays testdata/<test>.json. To record it against a live endpoint,
+// run the test with CASSETTE_MODE=record and the usual HTTP_ENDPOINT and CLIENT_* environment.
+func newCassetteClient(t *testing.T) *internal.RestClient {
+	c, err := internal.NewCassetteFromEnv(filepath.Join("testdata", t.Name()+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := []internal.ClientOption{internal.WithCassette(c)}
+	if c.Mode == internal.CassetteRecord {
+		c.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true, // test server certificate is not trusted.
+			},
+		}
+		t.Cleanup(func() { assert.NoError(t, c.Save()) })
+	} else {
+		opts = append(opts, internal.WithEndpoint(internal.ReplayEndpoint), internal.WithCredentials("foo", "bar"), internal.WithTokenURL(""))
+	}
+
+	cl, err := internal.NewRestClient(context.TODO(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cl
+}
+
 func TestNewRestClient(t *testing.T) {
 
-	cl, err := internal.NewRestClient(context.TODO())
+	cl := newCassetteClient(t)
 	assert.NotNil(t, cl)
-	assert.NoError(t, err)
 	assert.NotEmpty(t, cl.Settings.Credentials.UserID)
 	assert.NotEmpty(t, cl.Settings.Credentials.Token)
 }
 
 func TestPostPayload(t *testing.T) {
 
-	cl, err := internal.NewRestClient(context.TODO())
-	assert.NotNil(t, cl)
-	assert.NoError(t, err)
+	cl := newCassetteClient(t)
 	assert.NotEmpty(t, cl.Settings.Credentials.UserID)
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true, // test server certificate is not trusted.
-			},
-		},
-	}
-	assert.NotNil(t, client)
-	cl.SetClient(client)
-
+	// fixed values, the recorded request body must match
 	coord := Coordinates{
-		VIN:       stdlib.GetString("VIN", VIN),
-		EventTime: stdlib.Now(),
+		VIN:       VIN,
+		EventTime: 1682415000,
 		Lat:       39.78876,
 		Long:      -86.23759,
 	}
@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
+)
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitHalfOpen
+	CircuitOpen
+
+	DefaultFailureThreshold = 5
+	DefaultOpenTimeout      = 30 * time.Second
+)
+
+type (
+	// CircuitState is the state of the circuit for a single endpoint
+	CircuitState int
+
+	// CircuitBreakerTransport fails requests fast once an endpoint failed too often in a row.
+	// After OpenTimeout a single probe request is let through, its outcome closes or re-opens the circuit.
+	CircuitBreakerTransport struct {
+		InnerTransport   http.RoundTripper
+		Client           string // used to label the metrics
+		FailureThreshold int
+		OpenTimeout      time.Duration
+
+		mu       sync.Mutex
+		circuits map[string]*circuit
+	}
+
+	// CircuitOpenError is returned for requests that were rejected without being sent
+	CircuitOpenError struct {
+		Endpoint   string
+		RetryAfter time.Duration // time until the next probe request is allowed
+	}
+
+	circuit struct {
+		state    CircuitState
+		failures int
+		openedAt time.Time
+		probing  bool
+	}
+)
+
+var (
+	// ErrCircuitOpen indicates that a request was rejected by the circuit breaker
+	ErrCircuitOpen = errors.New("circuit open")
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitHalfOpen:
+		return "half-open"
+	case CircuitOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit open for '%s', retry in %s", e.Endpoint, Duration(e.RetryAfter, 2))
+}
+
+func (e *CircuitOpenError) Unwrap() error {
+	return ErrCircuitOpen
+}
+
+// IsCircuitOpen reports whether err was caused by an open circuit
+func IsCircuitOpen(err error) bool {
+	return errors.Is(err, ErrCircuitOpen)
+}
+
+// NewCircuitBreakerTransport wraps transport with a circuit breaker per endpoint (host)
+func NewCircuitBreakerTransport(transport http.RoundTripper, client string, cfg *settings.CircuitBreakerSettings) *CircuitBreakerTransport {
+	t := &CircuitBreakerTransport{
+		InnerTransport:   transport,
+		Client:           client,
+		FailureThreshold: DefaultFailureThreshold,
+		OpenTimeout:      DefaultOpenTimeout,
+		circuits:         make(map[string]*circuit),
+	}
+	if cfg != nil {
+		if cfg.FailureThreshold > 0 {
+			t.FailureThreshold = cfg.FailureThreshold
+		}
+		if cfg.OpenTimeout > 0 {
+			t.OpenTimeout = cfg.OpenTimeout.Duration()
+		}
+	}
+	return t
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *CircuitBreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := req.URL.Host
+
+	if err := t.allow(endpoint); err != nil {
+		circuitRejected.WithLabelValues(t.Client, endpoint).Inc()
+		return nil, err
+	}
+
+	resp, err := t.InnerTransport.RoundTrip(req)
+
+	if req.Context().Err() != nil {
+		// cancelled by the caller, says nothing about the endpoint
+		t.release(endpoint)
+	} else {
+		t.record(endpoint, err != nil || resp.StatusCode >= http.StatusInternalServerError)
+	}
+
+	return resp, err
+}
+
+// State returns the current state of the circuit for endpoint
+func (t *CircuitBreakerTransport) State(endpoint string) CircuitState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if c, ok := t.circuits[endpoint]; ok {
+		return c.state
+	}
+	return CircuitClosed
+}
+
+func (t *CircuitBreakerTransport) allow(endpoint string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.circuits[endpoint]
+	if !ok {
+		c = &circuit{}
+		t.circuits[endpoint] = c
+	}
+
+	switch c.state {
+	case CircuitOpen:
+		if wait := t.OpenTimeout - time.Since(c.openedAt); wait > 0 {
+			return &CircuitOpenError{Endpoint: endpoint, RetryAfter: wait}
+		}
+		t.transition(endpoint, c, CircuitHalfOpen)
+		c.probing = true
+	case CircuitHalfOpen:
+		if c.probing {
+			return &CircuitOpenError{Endpoint: endpoint}
+		}
+		c.probing = true
+	}
+
+	return nil
+}
+
+func (t *CircuitBreakerTransport) record(endpoint string, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.circuits[endpoint]
+	c.probing = false
+
+	if !failed {
+		c.failures = 0
+		if c.state != CircuitClosed {
+			t.transition(endpoint, c, CircuitClosed)
+		}
+		return
+	}
+
+	c.failures++
+	if c.state == CircuitHalfOpen || c.failures >= t.FailureThreshold {
+		c.openedAt = time.Now()
+		if c.state != CircuitOpen {
+			t.transition(endpoint, c, CircuitOpen)
+		}
+	}
+}
+
+func (t *CircuitBreakerTransport) release(endpoint string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.circuits[endpoint].probing = false
+}
+
+func (t *CircuitBreakerTransport) transition(endpoint string, c *circuit, state CircuitState) {
+	log.Warn().Str("client", t.Client).Str("endpoint", endpoint).Str("from", c.state.String()).Str("to", state.String()).Msg("circuit breaker")
+
+	c.state = state
+	circuitState.WithLabelValues(t.Client, endpoint).Set(float64(state))
+}
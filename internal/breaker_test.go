@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var calls int32
+	var healthy int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&healthy) == 1 {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	cl, err := NewRestClient(context.TODO(), WithEndpoint(srv.URL), WithCredentials("foo", "bar"),
+		WithRetryPolicy(settings.RetryPolicy{MaxAttempts: 1}),
+		WithCircuitBreaker(2, 50*time.Millisecond))
+	assert.NoError(t, err)
+
+	breaker := cl.HttpClient.Transport.(*LoggingTransport).InnerTransport.(*TracingTransport).InnerTransport.(*MetricsTransport).InnerTransport.(*CircuitBreakerTransport)
+	endpoint := mustHost(srv.URL)
+
+	cl.GET("/", nil)
+	assert.Equal(t, CircuitClosed, breaker.State(endpoint))
+	cl.GET("/", nil)
+	assert.Equal(t, CircuitOpen, breaker.State(endpoint))
+
+	// fail fast
+	status, err := cl.GET("/", nil)
+	assert.True(t, IsCircuitOpen(err))
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// failing probe re-opens the circuit
+	time.Sleep(60 * time.Millisecond)
+	cl.GET("/", nil)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	assert.Equal(t, CircuitOpen, breaker.State(endpoint))
+
+	// successful probe closes it
+	atomic.StoreInt32(&healthy, 1)
+	time.Sleep(60 * time.Millisecond)
+	_, err = cl.GET("/", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, CircuitClosed, breaker.State(endpoint))
+}
+
+func TestRateLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	cl, err := NewRestClient(context.TODO(), WithEndpoint(srv.URL), WithCredentials("foo", "bar"), WithRateLimit(20, 1))
+	assert.NoError(t, err)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		_, err := cl.GET("/", nil)
+		assert.NoError(t, err)
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+
+	// waiting for a token honors the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	cl.GET("/", nil)
+	_, err = cl.GETWithContext(ctx, "/", nil)
+	assert.Error(t, err)
+}
+
+func mustHost(u string) string {
+	parsed, _ := url.Parse(u)
+	return parsed.Host
+}
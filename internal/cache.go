@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
+)
+
+const (
+	DefaultCacheSize = 256
+	DefaultCacheTTL  = 1 * time.Minute
+
+	// CacheHeader is added to responses served by the cache, its value is "HIT" or "REVALIDATED"
+	CacheHeader = "X-Cache"
+)
+
+type (
+	// CacheTransport caches successful GET responses in an LRU. Entries are fresh for the Cache-Control max-age
+	// or TTL, stale entries with an ETag are revalidated with If-None-Match. Writes invalidate the matching entries.
+	CacheTransport struct {
+		InnerTransport http.RoundTripper
+		Client         string // used to label the metrics
+		Size           int
+		TTL            time.Duration
+
+		mu      sync.Mutex
+		lru     *list.List
+		entries map[string]*list.Element
+	}
+
+	cacheEntry struct {
+		key     string
+		status  int
+		header  http.Header
+		body    []byte
+		etag    string
+		expires time.Time
+	}
+)
+
+var (
+	ctxKeyRevalidate = &contextKey{"Revalidate"}
+
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "cache_requests_total",
+		Help:      "The number of cacheable requests by result: hit, revalidated or miss",
+	}, []string{"client", "result"})
+)
+
+// NewCacheTransport wraps transport with a response cache
+func NewCacheTransport(transport http.RoundTripper, client string, cfg *settings.CacheSettings) *CacheTransport {
+	t := &CacheTransport{
+		InnerTransport: transport,
+		Client:         client,
+		Size:           DefaultCacheSize,
+		TTL:            DefaultCacheTTL,
+		lru:            list.New(),
+		entries:        make(map[string]*list.Element),
+	}
+	if cfg != nil {
+		if cfg.Size > 0 {
+			t.Size = cfg.Size
+		}
+		if cfg.TTL > 0 {
+			t.TTL = cfg.TTL.Duration()
+		}
+	}
+	return t
+}
+
+// WithRevalidation returns a context that asks the cache to revalidate its entry instead of serving it, e.g. when polling for a change
+func WithRevalidation(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeyRevalidate, true)
+}
+
+func mustRevalidate(req *http.Request) bool {
+	revalidate, _ := req.Context().Value(ctxKeyRevalidate).(bool)
+	return revalidate
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *CacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		resp, err := t.InnerTransport.RoundTrip(req)
+		if req.Method != http.MethodHead && req.Method != http.MethodOptions {
+			t.Invalidate(req.URL.Scheme + "://" + req.URL.Host + req.URL.Path)
+		}
+		return resp, err
+	}
+	if IsStream(req) || req.Header.Get("Range") != "" {
+		return t.InnerTransport.RoundTrip(req)
+	}
+
+	key := req.URL.String()
+	e := t.get(key)
+
+	if e != nil && time.Now().Before(e.expires) && !mustRevalidate(req) {
+		cacheRequests.WithLabelValues(t.Client, "hit").Inc()
+		return e.response(req, "HIT"), nil
+	}
+
+	if e != nil && e.etag != "" {
+		// RoundTrip must not modify the request
+		req = req.Clone(req.Context())
+		req.Header.Set("If-None-Match", e.etag)
+	}
+
+	resp, err := t.InnerTransport.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && e != nil {
+		resp.Body.Close()
+		cacheRequests.WithLabelValues(t.Client, "revalidated").Inc()
+
+		// the 304 may update the cache directives, otherwise the stored ones apply
+		revalidated := *e
+		revalidated.header = e.header.Clone()
+		if cc := resp.Header.Get("Cache-Control"); cc != "" {
+			revalidated.header.Set("Cache-Control", cc)
+		}
+		revalidated.expires = t.expires(revalidated.header)
+		t.put(&revalidated)
+		return revalidated.response(req, "REVALIDATED"), nil
+	}
+
+	cacheRequests.WithLabelValues(t.Client, "miss").Inc()
+	if resp.StatusCode != http.StatusOK || !cacheable(resp.Header) {
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	e = &cacheEntry{
+		key:     key,
+		status:  resp.StatusCode,
+		header:  resp.Header.Clone(),
+		body:    body,
+		etag:    resp.Header.Get("ETag"),
+		expires: t.expires(resp.Header),
+	}
+	if e.etag != "" || time.Now().Before(e.expires) {
+		t.put(e)
+	}
+
+	return resp, nil
+}
+
+// Invalidate removes all entries for the resource at url (without query), its parents and its children,
+// e.g. a write to /apps/foo/devices/bar invalidates /apps/foo/devices and /apps/foo/devices/bar?x=y, but not /apps/foo/devices/bar2.
+// Paths are compared by segments.
+func (t *CacheTransport) Invalidate(url string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	url = strings.TrimSuffix(url, "/")
+	for key, el := range t.entries {
+		path := strings.TrimSuffix(strings.SplitN(key, "?", 2)[0], "/")
+		if path == url || strings.HasPrefix(path, url+"/") || strings.HasPrefix(url, path+"/") {
+			t.lru.Remove(el)
+			delete(t.entries, key)
+		}
+	}
+}
+
+// Len returns the number of cached entries
+func (t *CacheTransport) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.lru.Len()
+}
+
+func (t *CacheTransport) get(key string) *cacheEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	el, ok := t.entries[key]
+	if !ok {
+		return nil
+	}
+	t.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+func (t *CacheTransport) put(e *cacheEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if el, ok := t.entries[e.key]; ok {
+		el.Value = e
+		t.lru.MoveToFront(el)
+		return
+	}
+
+	t.entries[e.key] = t.lru.PushFront(e)
+	for t.lru.Len() > t.Size {
+		oldest := t.lru.Back()
+		t.lru.Remove(oldest)
+		delete(t.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// expires uses the max-age of the response or the TTL, no-cache entries have to be revalidated every time
+func (t *CacheTransport) expires(h http.Header) time.Time {
+	now := time.Now()
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "no-cache" {
+			return now
+		}
+		if strings.HasPrefix(directive, "max-age=") {
+			if secs, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
+				return now.Add(time.Duration(secs) * time.Second)
+			}
+		}
+	}
+	return now.Add(t.TTL)
+}
+
+func cacheable(h http.Header) bool {
+	return !strings.Contains(strings.ToLower(h.Get("Cache-Control")), "no-store")
+}
+
+func (e *cacheEntry) response(req *http.Request, result string) *http.Response {
+	header := e.header.Clone()
+	header.Set(CacheHeader, result)
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.status, http.StatusText(e.status)),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheTransport(t *testing.T) {
+	calls := 0
+	revalidated := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.Path {
+		case "/devices/etag":
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				revalidated++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Cache-Control", "no-cache")
+		case "/devices/nostore":
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		if r.Method == http.MethodGet {
+			w.Write([]byte(`{"name":"WVW123"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	cl, err := NewRestClient(context.TODO(), WithEndpoint(srv.URL), WithCredentials("foo", "bar"), WithCache(2, time.Minute))
+	assert.NoError(t, err)
+
+	var device map[string]interface{}
+
+	// fresh for the TTL
+	for i := 0; i < 3; i++ {
+		status, err := cl.GET("/devices/ttl", &device)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "WVW123", device["name"])
+	}
+	assert.Equal(t, 1, calls)
+
+	// always revalidated
+	for i := 0; i < 3; i++ {
+		status, err := cl.GET("/devices/etag", &device)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, status)
+	}
+	assert.Equal(t, 4, calls)
+	assert.Equal(t, 2, revalidated)
+
+	// not cached at all
+	cl.GET("/devices/nostore", &device)
+	cl.GET("/devices/nostore", &device)
+	assert.Equal(t, 6, calls)
+
+	// a write invalidates the device and the collection
+	cl.PUT("/devices/ttl", &device, nil)
+	cl.GET("/devices/ttl", &device)
+	assert.Equal(t, 8, calls)
+
+	// fresh entries are fetched again on request
+	cl.GETWithContext(WithRevalidation(context.TODO()), "/devices/ttl", &device)
+	assert.Equal(t, 9, calls)
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := NewCacheTransport(http.DefaultTransport, "test", nil)
+	c.Size = 2
+
+	for _, key := range []string{"http://a/1", "http://a/2", "http://a/3"} {
+		c.put(&cacheEntry{key: key, expires: time.Now().Add(time.Minute)})
+	}
+	assert.Equal(t, 2, c.Len())
+	assert.Nil(t, c.get("http://a/1"))
+	assert.NotNil(t, c.get("http://a/3"))
+
+	c.Invalidate("http://a")
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	c := NewCacheTransport(http.DefaultTransport, "test", nil)
+
+	for _, key := range []string{
+		"http://a/apps/foo/devices",
+		"http://a/apps/foo/devices/car1",
+		"http://a/apps/foo/devices/car1?x=y",
+		"http://a/apps/foo/devices/car1/status",
+		"http://a/apps/foo/devices/car10",
+		"http://a/apps/foo/devices/car1x",
+		"http://a/apps/foobar",
+	} {
+		c.put(&cacheEntry{key: key, expires: time.Now().Add(time.Minute)})
+	}
+
+	c.Invalidate("http://a/apps/foo/devices/car1")
+	assert.Equal(t, 3, c.Len())
+	assert.NotNil(t, c.get("http://a/apps/foo/devices/car10"))
+	assert.NotNil(t, c.get("http://a/apps/foo/devices/car1x"))
+	assert.NotNil(t, c.get("http://a/apps/foobar"))
+}
@@ -0,0 +1,247 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/txsvc/stdlib/v2"
+)
+
+const (
+	CassetteReplay CassetteMode = iota // replay recorded interactions, never call the server
+	CassetteRecord                     // call the server and record all interactions
+
+	// CASSETTE_MODE switches tests between "replay" (default) and "record"
+	CASSETTE_MODE = "CASSETTE_MODE"
+
+	// BodyBase64 marks bodies that are not valid UTF-8, e.g. binary downloads
+	BodyBase64 = "base64"
+
+	// ReplayEndpoint is the endpoint of clients replaying a cassette, the recorded host is ignored
+	ReplayEndpoint = "http://replay.invalid"
+)
+
+type (
+	// CassetteMode selects whether a Cassette records or replays
+	CassetteMode int
+
+	// Cassette is a RoundTripper that records HTTP interactions to a file and replays them, e.g. for offline tests.
+	// Secrets are scrubbed before anything is written, see Redactor.
+	Cassette struct {
+		Path      string
+		Mode      CassetteMode
+		Transport http.RoundTripper // used when recording, http.DefaultTransport if nil
+		Redactor  *Redactor
+
+		mu           sync.Mutex
+		interactions []*Interaction
+		replayed     []bool
+	}
+
+	// Interaction is a recorded request and its response
+	Interaction struct {
+		Request  RecordedRequest  `json:"request"`
+		Response RecordedResponse `json:"response"`
+	}
+
+	RecordedRequest struct {
+		Method       string            `json:"method"`
+		URL          string            `json:"url"` // sensitive query values are masked
+		Header       map[string]string `json:"header,omitempty"`
+		Body         string            `json:"body,omitempty"`
+		BodyEncoding string            `json:"body_encoding,omitempty"` // empty or BodyBase64
+	}
+
+	RecordedResponse struct {
+		StatusCode   int               `json:"status_code"`
+		Header       map[string]string `json:"header,omitempty"`
+		Body         string            `json:"body,omitempty"`
+		BodyEncoding string            `json:"body_encoding,omitempty"` // empty or BodyBase64
+	}
+)
+
+// NewCassette creates a cassette for the file at path. In replay mode, the file must exist.
+func NewCassette(path string, mode CassetteMode) (*Cassette, error) {
+	r := NewRedactor(nil)
+	r.MaxBodySize = 0 // never truncate the recorded bodies
+
+	c := &Cassette{
+		Path:     path,
+		Mode:     mode,
+		Redactor: r,
+	}
+
+	if mode == CassetteReplay {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &c.interactions); err != nil {
+			return nil, fmt.Errorf("invalid cassette '%s': %w", path, err)
+		}
+		c.replayed = make([]bool, len(c.interactions))
+	}
+
+	return c, nil
+}
+
+// NewCassetteFromEnv creates a cassette in the mode selected by CASSETTE_MODE
+func NewCassetteFromEnv(path string) (*Cassette, error) {
+	if stdlib.GetString(CASSETTE_MODE, "replay") == "record" {
+		return NewCassette(path, CassetteRecord)
+	}
+	return NewCassette(path, CassetteReplay)
+}
+
+// Client returns a http.Client that uses the cassette, e.g. for RestClient.SetClient
+func (c *Cassette) Client() *http.Client {
+	return NewLoggingTransport(c)
+}
+
+// RoundTrip implements http.RoundTripper
+func (c *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		data, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = data
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	if c.Mode == CassetteRecord {
+		return c.record(req, body)
+	}
+	return c.replay(req, body)
+}
+
+// Save writes all recorded interactions to the cassette file
+func (c *Cassette) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	interactions := c.interactions
+	if interactions == nil {
+		interactions = []*Interaction{} // a test without any calls
+	}
+
+	data, err := json.MarshalIndent(interactions, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(c.Path, data, 0644)
+}
+
+func (c *Cassette) record(req *http.Request, body []byte) (*http.Response, error) {
+	transport := c.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	it := &Interaction{
+		Request: RecordedRequest{
+			Method: req.Method,
+			URL:    c.Redactor.URL(req.URL).String(),
+			Header: c.Redactor.Header(req.Header),
+		},
+		Response: RecordedResponse{
+			StatusCode: resp.StatusCode,
+			Header:     c.Redactor.Header(resp.Header),
+		},
+	}
+	it.Request.Body, it.Request.BodyEncoding = encodeBody(c.Redactor.Body(body))
+	it.Response.Body, it.Response.BodyEncoding = encodeBody(c.Redactor.Body(data))
+	c.interactions = append(c.interactions, it)
+
+	return resp, nil
+}
+
+// replay returns the first interaction not replayed yet with the same method, path, query and body.
+// The host is ignored, so a cassette recorded against one cluster can be replayed with any endpoint.
+func (c *Cassette) replay(req *http.Request, body []byte) (*http.Response, error) {
+	scrubbed, encoding := encodeBody(c.Redactor.Body(body))
+	uri := c.Redactor.URL(req.URL).RequestURI()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, it := range c.interactions {
+		if c.replayed[i] || it.Request.Method != req.Method || it.Request.Body != scrubbed || it.Request.BodyEncoding != encoding {
+			continue
+		}
+		u, err := url.Parse(it.Request.URL)
+		if err != nil || u.RequestURI() != uri {
+			continue
+		}
+		data, err := decodeBody(it.Response.Body, it.Response.BodyEncoding)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cassette '%s': %w", c.Path, err)
+		}
+		c.replayed[i] = true
+
+		header := http.Header{}
+		for k, v := range it.Response.Header {
+			header.Set(k, v)
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", it.Response.StatusCode, http.StatusText(it.Response.StatusCode)),
+			StatusCode:    it.Response.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(data)),
+			ContentLength: int64(len(data)),
+			Request:       req,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("no recorded interaction for %s %s in '%s'", req.Method, req.URL.RequestURI(), c.Path)
+}
+
+// encodeBody keeps UTF-8 bodies readable in the cassette file, anything else is base64 encoded
+func encodeBody(data []byte) (string, string) {
+	if utf8.Valid(data) {
+		return string(data), ""
+	}
+	return base64.StdEncoding.EncodeToString(data), BodyBase64
+}
+
+func decodeBody(body, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return []byte(body), nil
+	case BodyBase64:
+		return base64.StdEncoding.DecodeString(body)
+	}
+	return nil, fmt.Errorf("unsupported body encoding '%s'", encoding)
+}
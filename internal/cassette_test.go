@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCassette(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"name":"WVW123","access_token":"s3cr3t"}`))
+	}))
+
+	path := filepath.Join(t.TempDir(), "testdata", "device.json")
+	device := map[string]interface{}{"name": "WVW123", "password": "car123456"}
+
+	// record
+	c, err := NewCassette(path, CassetteRecord)
+	assert.NoError(t, err)
+
+	cl, err := NewRestClient(context.TODO(), WithEndpoint(srv.URL), WithCredentials("foo", "bar"), WithCassette(c))
+	assert.NoError(t, err)
+
+	var resp map[string]interface{}
+	status, err := cl.POST("/devices", device, &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "s3cr3t", resp["access_token"])
+
+	assert.NoError(t, c.Save())
+	srv.Close()
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "car123456")
+	assert.NotContains(t, string(data), "s3cr3t")
+	assert.NotContains(t, string(data), "Basic Zm9vOmJhcg==")
+
+	// replay against any endpoint
+	c, err = NewCassette(path, CassetteReplay)
+	assert.NoError(t, err)
+
+	cl, err = NewRestClient(context.TODO(), WithEndpoint("http://localhost:1"), WithCredentials("foo", "bar"))
+	assert.NoError(t, err)
+	cl.SetClient(c.Client())
+
+	resp = nil
+	status, err = cl.POST("/devices", device, &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "WVW123", resp["name"])
+
+	// every interaction is replayed only once
+	_, err = cl.POST("/devices", device, &resp)
+	assert.Error(t, err)
+
+	_, err = NewCassette(filepath.Join(t.TempDir(), "missing.json"), CassetteReplay)
+	assert.Error(t, err)
+}
+
+func TestCassetteBinaryBody(t *testing.T) {
+	payload := []byte{0x1f, 0x8b, 0x08, 0x00, 0xff, 0xfe, 0x00, 0x80}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentTypeOctetStream)
+		w.Write(payload)
+	}))
+
+	path := filepath.Join(t.TempDir(), "download.json")
+	c, err := NewCassette(path, CassetteRecord)
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/package?access_token=s3cr3t&part=1", nil)
+	resp, err := c.RoundTrip(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.NoError(t, c.Save())
+	srv.Close()
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "s3cr3t")
+	assert.Contains(t, string(data), BodyBase64)
+
+	c, err = NewCassette(path, CassetteReplay)
+	assert.NoError(t, err)
+
+	req, _ = http.NewRequest(http.MethodGet, "http://localhost:1/package?access_token=other&part=1", nil)
+	resp, err = c.RoundTrip(req)
+	if assert.NoError(t, err) {
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, payload, body)
+	}
+}
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
+)
+
+const (
+	CredentialsDir = "CREDENTIALS_DIR"
+
+	// files read from the credentials directory, e.g. the keys of a mounted Kubernetes secret
+	CredentialsFile  = "credentials.json" // settings.Credentials as JSON
+	AccessTokenFile  = "access_token"
+	ClientIDFile     = "client_id"
+	ClientSecretFile = "client_secret"
+
+	DefaultCredentialsRefresh = 10 * time.Second
+)
+
+type (
+	// FileCredentials provides the credentials found in a directory and picks up changes while the clients are running.
+	// The directory contains either credentials.json or plain token files (access_token or client_id and client_secret).
+	FileCredentials struct {
+		Dir string
+
+		current atomic.Pointer[settings.Credentials]
+	}
+
+	// StaticCredentials provides credentials that are replaced explicitly, e.g. after rotating an access token
+	StaticCredentials struct {
+		current atomic.Pointer[settings.Credentials]
+	}
+)
+
+// NewStaticCredentials provides a copy of c, see StaticCredentials
+func NewStaticCredentials(c *settings.Credentials) *StaticCredentials {
+	sc := &StaticCredentials{}
+	sc.Set(c)
+	return sc
+}
+
+// Credentials implements settings.CredentialsProvider. The result must not be modified.
+func (sc *StaticCredentials) Credentials() *settings.Credentials {
+	return sc.current.Load()
+}
+
+// Set replaces the credentials, requests in flight are not affected
+func (sc *StaticCredentials) Set(c *settings.Credentials) {
+	sc.current.Store(c.Clone())
+}
+
+// NewFileCredentials reads the credentials from dir, see FileCredentials
+func NewFileCredentials(dir string) (*FileCredentials, error) {
+	fc := &FileCredentials{
+		Dir: dir,
+	}
+	if _, err := fc.Reload(); err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+// Credentials implements settings.CredentialsProvider. The result must not be modified.
+func (fc *FileCredentials) Credentials() *settings.Credentials {
+	return fc.current.Load()
+}
+
+// Reload reads the files again, it reports whether the credentials changed.
+// The current credentials are kept if the files can't be read, e.g. while a secret is being updated.
+func (fc *FileCredentials) Reload() (bool, error) {
+	c, err := readCredentialsDir(fc.Dir)
+	if err != nil {
+		return false, err
+	}
+
+	if old := fc.current.Load(); old != nil && *old == *c {
+		return false, nil
+	}
+	fc.current.Store(c)
+
+	return true, nil
+}
+
+// Watch reloads the credentials every interval until ctx is done
+func (fc *FileCredentials) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultCredentialsRefresh
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				changed, err := fc.Reload()
+				if err != nil {
+					log.Warn().Err(err).Str("dir", fc.Dir).Msg("reloading credentials")
+				} else if changed {
+					log.Info().Str("dir", fc.Dir).Msg("credentials reloaded")
+				}
+			}
+		}
+	}()
+}
+
+// ResolveCredentials loads the credentials from ds.CredentialsDir, if set, and keeps them up to date until ctx is done.
+// ds.Credentials is replaced with the credentials found initially. Without a directory or provider, the static
+// credentials are wrapped in StaticCredentials so that RestClient.SetCredentials can replace them.
+func ResolveCredentials(ctx context.Context, ds *settings.DialSettings) error {
+	if ds.CredentialsProvider == nil && ds.CredentialsDir != "" {
+		fc, err := NewFileCredentials(ds.CredentialsDir)
+		if err != nil {
+			return err
+		}
+		fc.Watch(ctx, DefaultCredentialsRefresh)
+
+		ds.CredentialsProvider = fc
+	}
+	if ds.CredentialsProvider == nil && ds.Credentials != nil {
+		ds.CredentialsProvider = NewStaticCredentials(ds.Credentials)
+	}
+
+	if ds.CredentialsProvider != nil {
+		ds.Credentials = ds.CredentialsProvider.Credentials().Clone()
+	}
+	return nil
+}
+
+func readCredentialsDir(dir string) (*settings.Credentials, error) {
+	data, err := os.ReadFile(filepath.Join(dir, CredentialsFile))
+	if err == nil {
+		var c settings.Credentials
+		if err := json.Unmarshal(data, &c); err != nil {
+			return nil, fmt.Errorf("invalid '%s': %w", CredentialsFile, err)
+		}
+		if c.Token == "" {
+			return nil, fmt.Errorf("no token in '%s'", CredentialsFile)
+		}
+		return &c, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	c := &settings.Credentials{}
+	if c.Token, err = readTokenFile(dir, AccessTokenFile); err != nil {
+		return nil, err
+	}
+	if c.Token == "" {
+		if c.UserID, err = readTokenFile(dir, ClientIDFile); err != nil {
+			return nil, err
+		}
+		if c.Token, err = readTokenFile(dir, ClientSecretFile); err != nil {
+			return nil, err
+		}
+	}
+	if c.Token == "" {
+		return nil, fmt.Errorf("no credentials found in '%s'", dir)
+	}
+	return c, nil
+}
+
+// readTokenFile returns the trimmed content of file, or an empty string if it does not exist
+func readTokenFile(dir, file string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
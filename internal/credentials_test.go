@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileCredentials(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, ClientIDFile), []byte("foo\n"), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, ClientSecretFile), []byte("bar\n"), 0600))
+
+	var user, pass string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ = r.BasicAuth()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	cl, err := NewRestClient(ctx, WithEndpoint(srv.URL), WithCredentialsDir(dir))
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", cl.Settings.Credentials.UserID)
+
+	_, err = cl.GET("/", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", user)
+	assert.Equal(t, "bar", pass)
+
+	// rotate the secret
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, CredentialsFile), []byte(`{"user_id":"foo","token":"baz"}`), 0600))
+
+	fc := cl.Settings.CredentialsProvider.(*FileCredentials)
+	changed, err := fc.Reload()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+
+	_, err = cl.GET("/", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "baz", pass)
+
+	// a broken file keeps the current credentials
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, CredentialsFile), []byte(`{"user_id":`), 0600))
+	_, err = fc.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, "baz", fc.Credentials().Token)
+}
+
+func TestFileCredentialsMissing(t *testing.T) {
+	_, err := NewFileCredentials(t.TempDir())
+	assert.Error(t, err)
+
+	_, err = NewRestClient(context.TODO(), WithEndpoint("http://localhost"), WithCredentialsDir(t.TempDir()))
+	assert.Error(t, err)
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type (
+	// APIError is returned by RestClient for every response with a status other
+	// than OK, Created, Accepted or NoContent.
+	APIError struct {
+		StatusCode int    `json:"status"`
+		Method     string `json:"method"`
+		URL        string `json:"url"`
+		RequestID  string `json:"request_id,omitempty"`
+		Body       []byte `json:"body,omitempty"`
+
+		Problem *ProblemDetails `json:"problem,omitempty"` // RFC 7807 response, if any
+		Details *ErrorDetails   `json:"details,omitempty"` // Drogue style response, if any
+	}
+
+	// ProblemDetails is the 'application/problem+json' payload as defined in RFC 7807
+	ProblemDetails struct {
+		Type     string `json:"type,omitempty"`
+		Title    string `json:"title,omitempty"`
+		Status   int    `json:"status,omitempty"`
+		Detail   string `json:"detail,omitempty"`
+		Instance string `json:"instance,omitempty"`
+	}
+
+	// ErrorDetails is the error payload returned by Drogue Cloud, e.g. {"error":"NotFound","message":"..."}
+	ErrorDetails struct {
+		Error   string `json:"error"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// NewAPIError creates an APIError from a response and its already consumed body.
+func NewAPIError(resp *http.Response, body []byte) *APIError {
+	e := &APIError{
+		StatusCode: resp.StatusCode,
+		Body:       body,
+	}
+
+	if req := resp.Request; req != nil {
+		e.Method = req.Method
+		e.URL = req.URL.String()
+		e.RequestID = req.Header.Get("X-Request-ID")
+	}
+	if id := resp.Header.Get("X-Request-ID"); id != "" {
+		e.RequestID = id
+	}
+
+	if len(body) > 0 {
+		if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/problem+json") {
+			var p ProblemDetails
+			if err := json.Unmarshal(body, &p); err == nil {
+				e.Problem = &p
+			}
+		} else {
+			var d ErrorDetails
+			if err := json.Unmarshal(body, &d); err == nil && d.Error != "" {
+				e.Details = &d
+			}
+		}
+	}
+
+	return e
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("%s %s: %d %s", e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+
+	if e.Problem != nil {
+		if e.Problem.Detail != "" {
+			return fmt.Sprintf("%s: %s", msg, e.Problem.Detail)
+		}
+		return fmt.Sprintf("%s: %s", msg, e.Problem.Title)
+	}
+	if e.Details != nil {
+		if e.Details.Message != "" {
+			return fmt.Sprintf("%s: %s: %s", msg, e.Details.Error, e.Details.Message)
+		}
+		return fmt.Sprintf("%s: %s", msg, e.Details.Error)
+	}
+	if len(e.Body) > 0 {
+		return fmt.Sprintf("%s: %s", msg, string(e.Body))
+	}
+	return msg
+}
+
+// Unwrap makes errors.Is(err, ErrApiInvocationError) work for all API errors
+func (e *APIError) Unwrap() error {
+	return ErrApiInvocationError
+}
+
+// AsAPIError returns the APIError wrapped in err, if any.
+func AsAPIError(err error) (*APIError, bool) {
+	var e *APIError
+	if errors.As(err, &e) {
+		return e, true
+	}
+	return nil, false
+}
+
+// StatusCode returns the HTTP status of an APIError or 0 if err is not an APIError.
+func StatusCode(err error) int {
+	if e, ok := AsAPIError(err); ok {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// IsNotFound reports whether err is an APIError with status 404
+func IsNotFound(err error) bool {
+	return StatusCode(err) == http.StatusNotFound
+}
+
+// IsConflict reports whether err is an APIError with status 409
+func IsConflict(err error) bool {
+	return StatusCode(err) == http.StatusConflict
+}
+
+// IsAuthError reports whether err is an APIError with status 401 or 403
+func IsAuthError(err error) bool {
+	status := StatusCode(err)
+	return status == http.StatusUnauthorized || status == http.StatusForbidden
+}
@@ -1,7 +1,6 @@
 package internal
 
 import (
-	"crypto/tls"
 	"fmt"
 	"math"
 	"net/http"
@@ -17,6 +16,8 @@ import (
 	"github.com/rs/zerolog/log"
 
 	"github.com/txsvc/stdlib/v2"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
 )
 
 const (
@@ -92,7 +93,18 @@ func SetLogLevel() {
 	}
 }
 
-func CreateMqttClient(protocol, host, port, clientID, username, password string) mqtt.Client {
+// CreateMqttClient creates a client using the TLS settings from the MQTT_TLS_* environment variables
+func CreateMqttClient(protocol, host, port, clientID, username, password string) (mqtt.Client, error) {
+	return CreateMqttClientWithTLS(protocol, host, port, clientID, username, password, TLSSettingsFromEnv(MqttPrefix))
+}
+
+// CreateMqttClientWithTLS creates a client that verifies the broker according to cfg, see NewTLSConfig
+func CreateMqttClientWithTLS(protocol, host, port, clientID, username, password string, cfg *settings.TLSSettings) (mqtt.Client, error) {
+	tc, err := NewTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	// setup and configuration
 	broker := fmt.Sprintf("%s://%s:%s", protocol, host, port)
 	opts := mqtt.NewClientOptions().AddBroker(broker)
@@ -115,12 +127,10 @@ func CreateMqttClient(protocol, host, port, clientID, username, password string)
 	if password != "" {
 		opts.SetPassword(password)
 	}
-	opts.SetTLSConfig(&tls.Config{
-		InsecureSkipVerify: true,
-	})
+	opts.SetTLSConfig(tc)
 
 	// create a client
-	return mqtt.NewClient(opts)
+	return mqtt.NewClient(opts), nil
 }
 
 func onConnectHandler(c mqtt.Client) {
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	metricsNamespace = "shadowcar"
+	metricsSubsystem = "http_client"
+
+	// UnknownRoute labels the metrics of requests without a route, see WithRoute
+	UnknownRoute = "other"
+)
+
+type (
+	// MetricsTransport records Prometheus metrics for every request that passes through it.
+	MetricsTransport struct {
+		InnerTransport http.RoundTripper
+	}
+)
+
+var (
+	ctxKeyRoute = &contextKey{"Route"}
+
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "requests_total",
+		Help:      "The number of outbound requests",
+	}, []string{"client", "method", "route", "status"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "request_duration_seconds",
+		Help:      "The latency of outbound requests, including retries",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"client", "method", "route", "status"})
+
+	requestsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "requests_in_flight",
+		Help:      "The number of outbound requests waiting for a response",
+	}, []string{"client", "method", "route"})
+
+	retriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "retries_total",
+		Help:      "The number of retried attempts of outbound requests",
+	}, []string{"client", "method", "route"})
+
+	circuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "circuit_state",
+		Help:      "State of the circuit breaker per endpoint: 0 = closed, 1 = half-open, 2 = open",
+	}, []string{"client", "endpoint"})
+
+	circuitRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "circuit_rejected_total",
+		Help:      "The number of requests rejected because the circuit was open",
+	}, []string{"client", "endpoint"})
+)
+
+// WithRoute returns a context that labels the request metrics with route instead of the actual path.
+// route is usually the format string the path was built from, e.g. "/campaign/%s".
+func WithRoute(ctx context.Context, route string) context.Context {
+	return context.WithValue(ctx, ctxKeyRoute, route)
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *MetricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	client, method, route := metricLabels(req)
+
+	inFlight := requestsInFlight.WithLabelValues(client, method, route)
+	inFlight.Inc()
+	defer inFlight.Dec()
+
+	start := time.Now()
+	resp, err := t.InnerTransport.RoundTrip(req)
+
+	status := "error"
+	if err == nil {
+		status = fmt.Sprintf("%dxx", resp.StatusCode/100)
+	}
+
+	requestsTotal.WithLabelValues(client, method, route, status).Inc()
+	requestDuration.WithLabelValues(client, method, route, status).Observe(time.Since(start).Seconds())
+
+	return resp, err
+}
+
+func metricLabels(req *http.Request) (string, string, string) {
+	route := UnknownRoute // never the raw path, it contains IDs and would create a time series per resource
+	if r, ok := req.Context().Value(ctxKeyRoute).(string); ok {
+		route = strings.ReplaceAll(r, "%s", "*")
+	}
+	return req.UserAgent(), req.Method, route
+}
@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
+)
+
+func TestMetricsTransport(t *testing.T) {
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			fail = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	cl, err := NewRestClient(context.TODO(), WithEndpoint(srv.URL), WithCredentials("foo", "bar"), WithRetryPolicy(settings.RetryPolicy{
+		MaxAttempts:   2,
+		MinBackoff:    settings.Duration(time.Millisecond),
+		RetryStatuses: []int{http.StatusServiceUnavailable},
+	}))
+	assert.NoError(t, err)
+
+	ctx := WithRoute(context.TODO(), "/metrics/%s")
+	cl.GETWithContext(ctx, "/metrics/42", nil)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(requestsTotal.WithLabelValues(ApiAgent, "GET", "/metrics/*", "4xx")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(retriesTotal.WithLabelValues(ApiAgent, "GET", "/metrics/*")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(requestsInFlight.WithLabelValues(ApiAgent, "GET", "/metrics/*")))
+	assert.Greater(t, testutil.CollectAndCount(requestDuration, "shadowcar_http_client_request_duration_seconds"), 0)
+
+	// no route template, the path is not used
+	cl.DELETE("/other/42", nil, nil)
+	assert.Equal(t, float64(1), testutil.ToFloat64(requestsTotal.WithLabelValues(ApiAgent, "DELETE", UnknownRoute, "4xx")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(requestsTotal.WithLabelValues(ApiAgent, "DELETE", "/other/42", "4xx")))
+}
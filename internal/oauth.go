@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/txsvc/stdlib/v2"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
+)
+
+const (
+	TokenURL = "TOKEN_URL"
+
+	// DefaultExpiryDelta is how long before its expiration a token is refreshed
+	DefaultExpiryDelta = 30 * time.Second
+)
+
+type (
+	// ClientCredentialsTokenSource implements the OAuth2 client credentials grant
+	// (RFC 6749, section 4.4) against e.g. a Keycloak/OIDC token endpoint.
+	// Tokens are cached until shortly before they expire.
+	ClientCredentialsTokenSource struct {
+		TokenURL    string
+		Credentials *settings.Credentials        // UserID = client_id, Token = client_secret
+		Provider    settings.CredentialsProvider // if set, replaces Credentials
+		Scopes      []string
+		ExpiryDelta time.Duration
+		HttpClient  *http.Client // defaults to http.DefaultTransport, see NewRestClientFromSettings
+
+		mu    sync.Mutex
+		token *settings.Credentials
+	}
+
+	tokenResponse struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type,omitempty"`
+		ExpiresIn   int64  `json:"expires_in,omitempty"`
+	}
+)
+
+// NewClientCredentialsTokenSource returns a token source that exchanges the client credentials for access tokens
+func NewClientCredentialsTokenSource(tokenURL string, credentials *settings.Credentials, scopes []string) *ClientCredentialsTokenSource {
+	return &ClientCredentialsTokenSource{
+		TokenURL:    tokenURL,
+		Credentials: credentials,
+		Scopes:      scopes,
+		ExpiryDelta: DefaultExpiryDelta,
+		HttpClient:  NewLoggingTransport(http.DefaultTransport),
+	}
+}
+
+// Token returns the cached access token or requests a new one if it is about to expire
+func (ts *ClientCredentialsTokenSource) Token(ctx context.Context) (*settings.Credentials, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token != nil && !ts.expiresSoon(ts.token) {
+		return ts.token, nil
+	}
+
+	token, err := ts.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ts.token = token
+
+	return token, nil
+}
+
+// Invalidate forces the next call to Token to request a new access token
+func (ts *ClientCredentialsTokenSource) Invalidate() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.token = nil
+}
+
+func (ts *ClientCredentialsTokenSource) expiresSoon(token *settings.Credentials) bool {
+	if token.Expires == 0 {
+		return false
+	}
+	return token.Expires-int64(ts.ExpiryDelta.Seconds()) <= stdlib.Now()
+}
+
+func (ts *ClientCredentialsTokenSource) fetch(ctx context.Context) (*settings.Credentials, error) {
+	creds := ts.Credentials
+	if ts.Provider != nil {
+		creds = ts.Provider.Credentials()
+	}
+	if creds == nil || creds.UserID == "" {
+		return nil, fmt.Errorf("missing client credentials for '%s'", ts.TokenURL)
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(ts.Scopes) > 0 {
+		form.Set("scope", strings.Join(ts.Scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", ts.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(creds.UserID), url.QueryEscape(creds.Token))
+
+	resp, err := ts.HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, NewAPIError(resp, body)
+	}
+
+	var tr tokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return nil, err
+	}
+	if tr.AccessToken == "" {
+		return nil, fmt.Errorf("no access token from '%s'", ts.TokenURL)
+	}
+
+	token := &settings.Credentials{
+		ProjectID: creds.ProjectID,
+		Token:     tr.AccessToken,
+	}
+	if tr.ExpiresIn > 0 {
+		token.Expires = stdlib.Now() + tr.ExpiresIn
+	}
+
+	return token, nil
+}
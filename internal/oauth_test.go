@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
+)
+
+func newTokenServer(t *testing.T, expiresIn int, issued *int32) *httptest.Server {
+	return httptest.NewServer(newTokenHandler(t, expiresIn, issued))
+}
+
+func newTokenHandler(t *testing.T, expiresIn int, issued *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "client", id)
+		assert.Equal(t, "secret", secret)
+
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.Form.Get("grant_type"))
+
+		n := atomic.AddInt32(issued, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"Bearer","expires_in":%d}`, n, expiresIn)
+	})
+}
+
+func TestClientCredentialsTokenSource(t *testing.T) {
+	var issued int32
+	srv := newTokenServer(t, 3600, &issued)
+	defer srv.Close()
+
+	ts := NewClientCredentialsTokenSource(srv.URL, &settings.Credentials{UserID: "client", Token: "secret"}, []string{"openid"})
+
+	tok, err := ts.Token(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", tok.Token)
+	assert.False(t, tok.Expired())
+
+	// cached
+	tok, err = ts.Token(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", tok.Token)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&issued))
+
+	// forced refresh
+	ts.Invalidate()
+	tok, err = ts.Token(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, "token-2", tok.Token)
+}
+
+func TestClientCredentialsTokenSourceRefresh(t *testing.T) {
+	var issued int32
+	srv := newTokenServer(t, 10, &issued) // expires within the expiry delta
+	defer srv.Close()
+
+	ts := NewClientCredentialsTokenSource(srv.URL, &settings.Credentials{UserID: "client", Token: "secret"}, nil)
+
+	tok, _ := ts.Token(context.TODO())
+	assert.Equal(t, "token-1", tok.Token)
+	tok, _ = ts.Token(context.TODO())
+	assert.Equal(t, "token-2", tok.Token)
+}
+
+func TestRestClientRenewsTokenOnce(t *testing.T) {
+	var issued int32
+	tokenSrv := newTokenServer(t, 3600, &issued)
+	defer tokenSrv.Close()
+
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.Header.Get("Authorization") != "Bearer token-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	cl, err := NewRestClient(context.TODO(), WithEndpoint(srv.URL), WithCredentials("client", "secret"), WithTokenURL(tokenSrv.URL))
+	assert.NoError(t, err)
+	assert.NotNil(t, cl.Settings.TokenSource)
+
+	// first token is rejected, second one accepted
+	status, err := cl.PUT("/resource", map[string]string{"foo": "bar"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, status)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// all tokens rejected, only one retry
+	cl.Settings.TokenSource.Invalidate()
+	atomic.StoreInt32(&calls, 0)
+
+	status, err = cl.GET("/resource", nil)
+	assert.True(t, IsAuthError(err))
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestRestClientTokenTransport(t *testing.T) {
+	var issued int32
+	tokenSrv := httptest.NewTLSServer(newTokenHandler(t, 3600, &issued))
+	defer tokenSrv.Close()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token-1", r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	// the test certificate is only trusted by the server's transport, not by http.DefaultTransport
+	cl, err := NewRestClient(context.TODO(), WithEndpoint(srv.URL), WithCredentials("client", "secret"), WithTokenURL(tokenSrv.URL), WithTransport(srv.Client().Transport))
+	assert.NoError(t, err)
+
+	status, err := cl.GET("/resource", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, status)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&issued))
+}
@@ -1,6 +1,9 @@
 package internal
 
 import (
+	"net/http"
+	"time"
+
 	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
 )
 
@@ -39,3 +42,205 @@ func (w withCredentials) Apply(ds *settings.DialSettings) {
 	ds.Credentials.UserID = w.userID
 	ds.Credentials.Token = w.token
 }
+
+// WithTokenURL returns a ClientOption that exchanges the client credentials for access tokens at an OAuth2 token endpoint.
+func WithTokenURL(url string) ClientOption {
+	return withTokenURL(url)
+}
+
+type withTokenURL string
+
+func (w withTokenURL) Apply(ds *settings.DialSettings) {
+	ds.TokenURL = string(w)
+}
+
+// WithScopes returns a ClientOption that overrides the scopes requested with an access token.
+func WithScopes(scopes ...string) ClientOption {
+	return withScopes(scopes)
+}
+
+type withScopes []string
+
+func (w withScopes) Apply(ds *settings.DialSettings) {
+	ds.Scopes = make([]string, len(w))
+	copy(ds.Scopes, w)
+}
+
+// WithTokenSource returns a ClientOption that uses ts to authorize all requests.
+func WithTokenSource(ts settings.TokenSource) ClientOption {
+	return withTokenSource{ts}
+}
+
+type withTokenSource struct {
+	ts settings.TokenSource
+}
+
+func (w withTokenSource) Apply(ds *settings.DialSettings) {
+	ds.TokenSource = w.ts
+}
+
+// WithRetryPolicy returns a ClientOption that overrides the default retry policy.
+func WithRetryPolicy(policy settings.RetryPolicy) ClientOption {
+	return withRetryPolicy(policy)
+}
+
+type withRetryPolicy settings.RetryPolicy
+
+func (w withRetryPolicy) Apply(ds *settings.DialSettings) {
+	p := settings.RetryPolicy(w)
+	ds.Retry = p.Clone()
+}
+
+// WithCircuitBreaker returns a ClientOption that fails calls fast once an endpoint failed failureThreshold times in a row.
+func WithCircuitBreaker(failureThreshold int, openTimeout time.Duration) ClientOption {
+	return withCircuitBreaker{
+		FailureThreshold: failureThreshold,
+		OpenTimeout:      settings.Duration(openTimeout),
+	}
+}
+
+type withCircuitBreaker settings.CircuitBreakerSettings
+
+func (w withCircuitBreaker) Apply(ds *settings.DialSettings) {
+	cb := settings.CircuitBreakerSettings(w)
+	ds.CircuitBreaker = &cb
+}
+
+// WithRateLimit returns a ClientOption that limits the requests per second sent to each endpoint.
+func WithRateLimit(requestsPerSecond float64, burst int) ClientOption {
+	return withRateLimit{
+		RequestsPerSecond: requestsPerSecond,
+		Burst:             burst,
+	}
+}
+
+type withRateLimit settings.RateLimitSettings
+
+func (w withRateLimit) Apply(ds *settings.DialSettings) {
+	rl := settings.RateLimitSettings(w)
+	ds.RateLimit = &rl
+}
+
+// WithRedaction returns a ClientOption that masks the JSON paths, e.g. "spec.authentication.pass", in the trace log
+// in addition to the defaults, and truncates logged bodies after maxBodySize bytes.
+func WithRedaction(maxBodySize int, paths ...string) ClientOption {
+	return withRedaction{
+		maxBodySize: maxBodySize,
+		paths:       paths,
+	}
+}
+
+type withRedaction struct {
+	maxBodySize int
+	paths       []string
+}
+
+func (w withRedaction) Apply(ds *settings.DialSettings) {
+	ds.Redaction = &settings.RedactionSettings{
+		Paths:       make([]string, len(w.paths)),
+		MaxBodySize: w.maxBodySize,
+	}
+	copy(ds.Redaction.Paths, w.paths)
+}
+
+// WithTLS returns a ClientOption that overrides the TLS settings, e.g. to trust a private CA or to use mTLS.
+func WithTLS(cfg settings.TLSSettings) ClientOption {
+	return withTLS(cfg)
+}
+
+type withTLS settings.TLSSettings
+
+func (w withTLS) Apply(ds *settings.DialSettings) {
+	tc := settings.TLSSettings(w)
+	ds.TLS = &tc
+}
+
+// WithCredentialsDir returns a ClientOption that reads the credentials from files in dir and reloads them when they change.
+func WithCredentialsDir(dir string) ClientOption {
+	return withCredentialsDir(dir)
+}
+
+type withCredentialsDir string
+
+func (w withCredentialsDir) Apply(ds *settings.DialSettings) {
+	ds.CredentialsDir = string(w)
+}
+
+// WithCredentialsProvider returns a ClientOption that asks p for the current credentials with every request.
+func WithCredentialsProvider(p settings.CredentialsProvider) ClientOption {
+	return withCredentialsProvider{p}
+}
+
+type withCredentialsProvider struct {
+	p settings.CredentialsProvider
+}
+
+func (w withCredentialsProvider) Apply(ds *settings.DialSettings) {
+	ds.CredentialsProvider = w.p
+}
+
+// WithProfile returns a ClientOption that fills in all values not set yet from the service's settings in p,
+// i.e. values from env vars and options applied before take precedence. A nil profile changes nothing.
+// p replaces the profile selected by SHADOWCAR_CONFIG and SHADOWCAR_PROFILE, see ApplyProfileFromEnv.
+func WithProfile(p settings.Profile) ClientOption {
+	return withProfile(p)
+}
+
+type withProfile settings.Profile
+
+func (w withProfile) Apply(ds *settings.DialSettings) {
+	if s, ok := w[ds.Service]; ok {
+		ds.Merge(s)
+	}
+}
+
+// ApplyProfileFromEnv applies the profile selected by SHADOWCAR_CONFIG and SHADOWCAR_PROFILE, if any.
+// Nothing is applied, or loaded, if opts contain an explicit WithProfile.
+func ApplyProfileFromEnv(ds *settings.DialSettings, opts ...ClientOption) error {
+	for _, opt := range opts {
+		if _, ok := opt.(withProfile); ok {
+			return nil
+		}
+	}
+
+	p, err := settings.ProfileFromEnv()
+	if err != nil {
+		return err
+	}
+	WithProfile(p).Apply(ds)
+	return nil
+}
+
+// WithTransport returns a ClientOption that sends all requests through transport instead of http.DefaultTransport.
+// Logging, tracing, metrics and retries are still applied on top of it.
+func WithTransport(transport http.RoundTripper) ClientOption {
+	return withTransport{transport}
+}
+
+type withTransport struct {
+	transport http.RoundTripper
+}
+
+func (w withTransport) Apply(ds *settings.DialSettings) {
+	ds.Transport = w.transport
+}
+
+// WithCassette returns a ClientOption that records or replays all requests, see Cassette.
+func WithCassette(c *Cassette) ClientOption {
+	return WithTransport(c)
+}
+
+// WithCache returns a ClientOption that caches up to size GET responses, for ttl unless the response's Cache-Control says otherwise.
+func WithCache(size int, ttl time.Duration) ClientOption {
+	return withCache{
+		Size: size,
+		TTL:  settings.Duration(ttl),
+	}
+}
+
+type withCache settings.CacheSettings
+
+func (w withCache) Apply(ds *settings.DialSettings) {
+	c := settings.CacheSettings(w)
+	ds.Cache = &c
+}
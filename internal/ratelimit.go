@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"math"
+	"net/http"
+	"sync"
+
+	"golang.org/x/time/rate"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
+)
+
+type (
+	// RateLimitTransport delays requests according to a token bucket per endpoint (host).
+	// Waiting honors the request's context, i.e. its deadline and cancellation.
+	RateLimitTransport struct {
+		InnerTransport http.RoundTripper
+		Limit          rate.Limit
+		Burst          int
+
+		mu       sync.Mutex
+		limiters map[string]*rate.Limiter
+	}
+)
+
+// NewRateLimitTransport wraps transport with a rate limiter per endpoint
+func NewRateLimitTransport(transport http.RoundTripper, cfg *settings.RateLimitSettings) *RateLimitTransport {
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(cfg.RequestsPerSecond)))
+	}
+
+	return &RateLimitTransport{
+		InnerTransport: transport,
+		Limit:          rate.Limit(cfg.RequestsPerSecond),
+		Burst:          burst,
+		limiters:       make(map[string]*rate.Limiter),
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *RateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter(req.URL.Host).Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.InnerTransport.RoundTrip(req)
+}
+
+func (t *RateLimitTransport) limiter(endpoint string) *rate.Limiter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	l, ok := t.limiters[endpoint]
+	if !ok {
+		l = rate.NewLimiter(t.Limit, t.Burst)
+		t.limiters[endpoint] = l
+	}
+	return l
+}
@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
+)
+
+const (
+	// DefaultMaxLogBodySize caps the number of body bytes written to the trace log
+	DefaultMaxLogBodySize = 4096
+
+	redacted = "***"
+)
+
+type (
+	// Redactor masks secrets in headers and JSON bodies before they are logged.
+	Redactor struct {
+		Headers     []string   // canonical header names whose values are masked
+		Paths       [][]string // JSON paths whose values are masked, arrays along a path are traversed
+		Queries     []string   // URL query parameters whose values are masked
+		MaxBodySize int        // bodies are truncated after MaxBodySize bytes, 0 disables the limit
+	}
+)
+
+var (
+	// DefaultRedactHeaders are always masked
+	DefaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+	// DefaultRedactQueries are the query parameters that carry credentials
+	DefaultRedactQueries = []string{"access_token", "token", "password", "client_secret", "api_key"}
+
+	// DefaultRedactPaths cover the credentials in Drogue device specs, access tokens and OAuth2 responses
+	DefaultRedactPaths = []string{
+		"spec.authentication.pass",
+		"spec.authentication.user.password",
+		"spec.credentials.credentials.pass",
+		"spec.credentials.credentials.user.password",
+		"spec.credentials.credentials.psk.key",
+		"user.password",
+		"password",
+		"client_secret",
+		"access_token",
+		"refresh_token",
+		"token",
+	}
+)
+
+// NewRedactor masks the default headers and paths, plus any paths given in cfg
+func NewRedactor(cfg *settings.RedactionSettings) *Redactor {
+	r := &Redactor{
+		Headers:     DefaultRedactHeaders,
+		Queries:     DefaultRedactQueries,
+		MaxBodySize: DefaultMaxLogBodySize,
+	}
+	for _, p := range DefaultRedactPaths {
+		r.Paths = append(r.Paths, strings.Split(p, "."))
+	}
+
+	if cfg != nil {
+		for _, p := range cfg.Paths {
+			r.Paths = append(r.Paths, strings.Split(p, "."))
+		}
+		if cfg.MaxBodySize != 0 {
+			r.MaxBodySize = cfg.MaxBodySize
+		}
+	}
+	if r.MaxBodySize < 0 {
+		r.MaxBodySize = 0
+	}
+	return r
+}
+
+// Header returns a copy of h with all sensitive values masked
+func (r *Redactor) Header(h http.Header) map[string]string {
+	m := make(map[string]string, len(h))
+	for k, v := range h {
+		m[k] = strings.Join(v, ", ")
+	}
+	for _, k := range r.Headers {
+		if v, ok := m[k]; ok {
+			m[k] = maskHeader(v)
+		}
+	}
+	return m
+}
+
+// URL returns u with all sensitive query values masked, u is returned as is if there are none
+func (r *Redactor) URL(u *url.URL) *url.URL {
+	if u.RawQuery == "" {
+		return u
+	}
+
+	q := u.Query()
+	masked := false
+	for _, k := range r.Queries {
+		if _, ok := q[k]; ok {
+			q.Set(k, redacted)
+			masked = true
+		}
+	}
+	if !masked {
+		return u
+	}
+
+	c := *u
+	c.RawQuery = q.Encode()
+	return &c
+}
+
+// Body returns data with all sensitive JSON values masked, truncated to MaxBodySize.
+// Bodies that are not valid JSON are only truncated.
+func (r *Redactor) Body(data []byte) []byte {
+	if len(r.Paths) > 0 && json.Valid(data) {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+
+		var v interface{}
+		if err := dec.Decode(&v); err == nil {
+			masked := false
+			for _, p := range r.Paths {
+				masked = maskPath(v, p) || masked
+			}
+			if masked {
+				if d, err := json.Marshal(v); err == nil {
+					data = d
+				}
+			}
+		}
+	}
+
+	if r.MaxBodySize > 0 && len(data) > r.MaxBodySize {
+		return append(data[:r.MaxBodySize:r.MaxBodySize], fmt.Sprintf("... (%d bytes)", len(data))...)
+	}
+	return data
+}
+
+// maskPath replaces the value at path in v, it reports whether anything was masked
+func maskPath(v interface{}, path []string) bool {
+	switch n := v.(type) {
+	case []interface{}:
+		masked := false
+		for _, e := range n {
+			masked = maskPath(e, path) || masked
+		}
+		return masked
+	case map[string]interface{}:
+		child, ok := n[path[0]]
+		if !ok {
+			return false
+		}
+		if len(path) == 1 {
+			if child != nil {
+				n[path[0]] = redacted
+			}
+			return child != nil
+		}
+		return maskPath(child, path[1:])
+	}
+	return false
+}
+
+// maskHeader keeps the authentication scheme, e.g. "Bearer ***"
+func maskHeader(v string) string {
+	if i := strings.IndexByte(v, ' '); i > 0 {
+		return v[:i] + " " + redacted
+	}
+	return redacted
+}
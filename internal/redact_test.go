@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
+)
+
+func TestRedactBody(t *testing.T) {
+	r := NewRedactor(&settings.RedactionSettings{Paths: []string{"metadata.annotations.secret"}})
+
+	device := `{"metadata":{"name":"WVW123","annotations":{"secret":"s3cr3t"}},"spec":{"authentication":{"pass":"foo"},"credentials":{"credentials":[{"pass":"bar"},{"user":{"username":"u","password":"baz"}}]}},"count":42}`
+	masked := string(r.Body([]byte(device)))
+
+	assert.NotContains(t, masked, "s3cr3t")
+	assert.NotContains(t, masked, "foo")
+	assert.NotContains(t, masked, "bar")
+	assert.NotContains(t, masked, "baz")
+	assert.Contains(t, masked, `"name":"WVW123"`)
+	assert.Contains(t, masked, `"username":"u"`)
+	assert.Contains(t, masked, `"count":42`)
+
+	// nothing to mask or not JSON, the body is unchanged
+	assert.Equal(t, `{"name":"WVW123"}`, string(r.Body([]byte(`{"name":"WVW123"}`))))
+	assert.Equal(t, "password=foo", string(r.Body([]byte("password=foo"))))
+}
+
+func TestRedactBodySize(t *testing.T) {
+	r := NewRedactor(&settings.RedactionSettings{MaxBodySize: 10})
+
+	body := strings.Repeat("x", 20)
+	assert.Equal(t, "xxxxxxxxxx... (20 bytes)", string(r.Body([]byte(body))))
+
+	r = NewRedactor(&settings.RedactionSettings{MaxBodySize: -1})
+	assert.Equal(t, body, string(r.Body([]byte(body))))
+}
+
+func TestRedactHeader(t *testing.T) {
+	h := http.Header{}
+	h.Set("Authorization", "Bearer abc")
+	h.Set("Content-Type", "application/json")
+
+	masked := NewRedactor(nil).Header(h)
+	assert.Equal(t, "Bearer ***", masked["Authorization"])
+	assert.Equal(t, "application/json", masked["Content-Type"])
+	assert.Equal(t, "Bearer abc", h.Get("Authorization"))
+}
+
+func TestRedactURL(t *testing.T) {
+	r := NewRedactor(nil)
+
+	u, _ := url.Parse("https://example.com/token?token=abc&description=ci")
+	assert.Equal(t, "https://example.com/token?description=ci&token=%2A%2A%2A", r.URL(u).String())
+	assert.Equal(t, "token=abc&description=ci", u.RawQuery)
+
+	u, _ = url.Parse("https://example.com/devices?labels=zone%3Dredhat")
+	assert.Same(t, u, r.URL(u))
+}
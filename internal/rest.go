@@ -11,7 +11,6 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/PuerkitoBio/rehttp"
 	"github.com/rs/zerolog/log"
 
 	"github.com/txsvc/apikit/config"
@@ -22,6 +21,7 @@ import (
 
 const (
 	HttpEndpoint = "HTTP_ENDPOINT"
+	RestService  = "rest" // the service name used in profiles
 
 	ApiAgent = "apikit/rest"
 
@@ -39,6 +39,7 @@ type (
 
 	LoggingTransport struct {
 		InnerTransport http.RoundTripper
+		Redactor       *Redactor // masks secrets, defaults are used if nil
 	}
 
 	contextKey struct {
@@ -55,9 +56,18 @@ var (
 
 func NewRestClient(ctx context.Context, opts ...ClientOption) (*RestClient, error) {
 	ds := &settings.DialSettings{
+		Service:     RestService,
 		Endpoint:    stdlib.GetString(HttpEndpoint, ""),
+		TokenURL:    stdlib.GetString(TokenURL, ""),
 		UserAgent:   ApiAgent,
 		Credentials: settings.CredentialsFromEnv(),
+		TLS:         TLSSettingsFromEnv(""),
+
+		CredentialsDir: stdlib.GetString(CredentialsDir, ""),
+	}
+
+	if err := ApplyProfileFromEnv(ds, opts...); err != nil {
+		return nil, err
 	}
 
 	// apply options
@@ -67,6 +77,10 @@ func NewRestClient(ctx context.Context, opts ...ClientOption) (*RestClient, erro
 		}
 	}
 
+	if err := ResolveCredentials(ctx, ds); err != nil {
+		return nil, err
+	}
+
 	// do some basic validation
 	if ds.Endpoint == "" {
 		return nil, fmt.Errorf("missing HTTP_ENDPOINT")
@@ -76,8 +90,33 @@ func NewRestClient(ctx context.Context, opts ...ClientOption) (*RestClient, erro
 		return nil, fmt.Errorf("missing CLIENT_SECRET")
 	}
 
+	return NewRestClientFromSettings(ds)
+}
+
+// NewRestClientFromSettings creates a RestClient from already validated settings.
+// It is used by the service specific clients once they applied their defaults and options.
+func NewRestClientFromSettings(ds *settings.DialSettings) (*RestClient, error) {
+	transport := http.DefaultTransport
+	if ds.Transport != nil {
+		transport = ds.Transport
+	} else if ds.TLS != nil {
+		t, err := NewTLSTransport(ds.TLS)
+		if err != nil {
+			return nil, err
+		}
+		transport = t
+	}
+
+	// the token endpoint is reached the same way as the API, e.g. behind the same private CA
+	if ds.TokenSource == nil && ds.TokenURL != "" {
+		ts := NewClientCredentialsTokenSource(ds.TokenURL, ds.Credentials, ds.GetScopes())
+		ts.Provider = ds.CredentialsProvider
+		ts.HttpClient = NewLoggingTransport(transport)
+		ds.TokenSource = ts
+	}
+
 	return &RestClient{
-		HttpClient: NewLoggingTransport(http.DefaultTransport),
+		HttpClient: NewHttpClient(transport, ds),
 		Settings:   ds,
 		Trace:      stdlib.GetString(config.ForceTraceENV, ""),
 	}, nil
@@ -89,22 +128,40 @@ func (c *RestClient) SetClient(cl *http.Client) {
 
 // GET is used to request data from the API. No payload, only queries!
 func (c *RestClient) GET(uri string, response interface{}) (int, error) {
-	return c.request("GET", fmt.Sprintf("%s%s", c.Settings.Endpoint, uri), nil, response)
+	return c.GETWithContext(context.Background(), uri, response)
 }
 
 func (c *RestClient) POST(uri string, request, response interface{}) (int, error) {
-	return c.request("POST", fmt.Sprintf("%s%s", c.Settings.Endpoint, uri), request, response)
+	return c.POSTWithContext(context.Background(), uri, request, response)
 }
 
 func (c *RestClient) PUT(uri string, request, response interface{}) (int, error) {
-	return c.request("PUT", fmt.Sprintf("%s%s", c.Settings.Endpoint, uri), request, response)
+	return c.PUTWithContext(context.Background(), uri, request, response)
 }
 
 func (c *RestClient) DELETE(uri string, request, response interface{}) (int, error) {
-	return c.request("DELETE", fmt.Sprintf("%s%s", c.Settings.Endpoint, uri), request, response)
+	return c.DELETEWithContext(context.Background(), uri, request, response)
 }
 
-func (c *RestClient) request(method, url string, request, response interface{}) (int, error) {
+// GETWithContext is like GET but the request is bound to ctx, i.e. it is aborted
+// as soon as ctx is cancelled or its deadline expires, including any retries.
+func (c *RestClient) GETWithContext(ctx context.Context, uri string, response interface{}) (int, error) {
+	return c.request(ctx, "GET", fmt.Sprintf("%s%s", c.Settings.Endpoint, uri), nil, response)
+}
+
+func (c *RestClient) POSTWithContext(ctx context.Context, uri string, request, response interface{}) (int, error) {
+	return c.request(ctx, "POST", fmt.Sprintf("%s%s", c.Settings.Endpoint, uri), request, response)
+}
+
+func (c *RestClient) PUTWithContext(ctx context.Context, uri string, request, response interface{}) (int, error) {
+	return c.request(ctx, "PUT", fmt.Sprintf("%s%s", c.Settings.Endpoint, uri), request, response)
+}
+
+func (c *RestClient) DELETEWithContext(ctx context.Context, uri string, request, response interface{}) (int, error) {
+	return c.request(ctx, "DELETE", fmt.Sprintf("%s%s", c.Settings.Endpoint, uri), request, response)
+}
+
+func (c *RestClient) request(ctx context.Context, method, url string, request, response interface{}) (int, error) {
 	var req *http.Request
 
 	if request != nil {
@@ -113,13 +170,13 @@ func (c *RestClient) request(method, url string, request, response interface{})
 			return http.StatusInternalServerError, err
 		}
 
-		req, err = http.NewRequest(method, url, bytes.NewBuffer(p))
+		req, err = http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(p))
 		if err != nil {
 			return http.StatusBadRequest, err
 		}
 	} else {
 		var err error
-		req, err = http.NewRequest(method, url, nil)
+		req, err = http.NewRequestWithContext(ctx, method, url, nil)
 		if err != nil {
 			return http.StatusBadRequest, err
 		}
@@ -129,14 +186,38 @@ func (c *RestClient) request(method, url string, request, response interface{})
 }
 
 func (c *RestClient) roundTrip(req *http.Request, response interface{}) (int, error) {
-
 	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	status, resp, err := c.send(req, true)
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+
+	// unmarshal the response if one is expected
+	if response != nil {
+		err = json.NewDecoder(resp.Body).Decode(response)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	return resp.StatusCode, nil
+}
+
+// send performs req, authorized unless it goes to another host than the endpoint.
+// Unless an error is returned, the caller has to close the response body.
+func (c *RestClient) send(req *http.Request, authorize bool) (int, *http.Response, error) {
+
 	req.Header.Set("User-Agent", c.Settings.UserAgent) // FIXME port this to apikit
 
-	if c.Settings.Credentials.UserID != "" && c.Settings.Credentials.Token != "" {
-		req.SetBasicAuth(c.Settings.Credentials.UserID, c.Settings.Credentials.Token)
-	} else if c.Settings.Credentials.Token != "" {
-		req.Header.Set("Authorization", "Bearer "+c.Settings.Credentials.Token)
+	if authorize {
+		if err := c.authorize(req); err != nil {
+			return http.StatusUnauthorized, nil, err
+		}
+	}
+	if key := idempotencyKey(req.Context()); key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
 	}
 	if c.Trace != "" {
 		req.Header.Set("X-Request-ID", XID())    // e.g ch3oncmfosvp07shov90
@@ -145,60 +226,179 @@ func (c *RestClient) roundTrip(req *http.Request, response interface{}) (int, er
 
 	// perform the request
 	resp, err := c.HttpClient.Transport.RoundTrip(req)
+
+	// the access token might have been revoked or expired early, try once more with a fresh one
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && authorize && c.Settings.TokenSource != nil {
+		if retry, rerr := c.renewAuthorization(req); rerr == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+
+			resp, err = c.HttpClient.Transport.RoundTrip(retry)
+		}
+	}
+
 	if err != nil {
+		// the retry transport masks cancellations, report the real cause instead
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			err = ctxErr
+		}
 		if resp == nil {
-			return http.StatusInternalServerError, err
+			if IsCircuitOpen(err) {
+				return http.StatusServiceUnavailable, nil, err
+			}
+			return http.StatusInternalServerError, nil, err
 		}
-		return resp.StatusCode, err
+		resp.Body.Close()
+		return resp.StatusCode, nil, err
 	}
 
-	defer resp.Body.Close()
+	// anything other than OK, Created, Accepted, NoContent or PartialContent is treated as an error
+	if resp.StatusCode > http.StatusNoContent && resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
 
-	// anything other than OK, Created, Accepted, NoContent is treated as an error
-	if resp.StatusCode > http.StatusNoContent {
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return resp.StatusCode, ErrApiInvocationError
+			return resp.StatusCode, nil, ErrApiInvocationError
 		}
-		return resp.StatusCode, errors.New(string(body))
+		return resp.StatusCode, nil, NewAPIError(resp, body)
 	}
 
-	// unmarshal the response if one is expected
-	if response != nil {
-		err = json.NewDecoder(resp.Body).Decode(response)
+	return resp.StatusCode, resp, nil
+}
+
+// authorize adds the Authorization header, either from the token source or the static credentials
+func (c *RestClient) authorize(req *http.Request) error {
+	if c.Settings.TokenSource != nil {
+		token, err := c.Settings.TokenSource.Token(req.Context())
 		if err != nil {
-			return http.StatusInternalServerError, err
+			return err
 		}
+		req.Header.Set("Authorization", "Bearer "+token.Token)
+		return nil
 	}
 
-	return resp.StatusCode, nil
+	creds := c.Settings.Credentials
+	if c.Settings.CredentialsProvider != nil {
+		creds = c.Settings.CredentialsProvider.Credentials()
+	}
+
+	if creds.UserID != "" && creds.Token != "" {
+		req.SetBasicAuth(creds.UserID, creds.Token)
+	} else if creds.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+creds.Token)
+	}
+	return nil
 }
 
+// Header returns the User-Agent and Authorization headers for the endpoint, e.g. for a WebSocket handshake
+func (c *RestClient) Header(ctx context.Context) (http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Settings.Endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", c.Settings.UserAgent)
+	if err := c.authorize(req); err != nil {
+		return nil, err
+	}
+	return req.Header, nil
+}
+
+// SetCredentials switches the client to c, e.g. after rotating an access token. This is not possible if the
+// credentials are managed elsewhere, e.g. by an OAuth2 token source or a credentials directory.
+func (c *RestClient) SetCredentials(creds *settings.Credentials) error {
+	if c.Settings.TokenSource != nil {
+		return fmt.Errorf("the client uses a token source")
+	}
+	sc, ok := c.Settings.CredentialsProvider.(*StaticCredentials)
+	if !ok {
+		return fmt.Errorf("the credentials are managed by the credentials provider")
+	}
+
+	sc.Set(creds)
+	return nil
+}
+
+// renewAuthorization discards the current access token and returns a copy of req with a new one
+func (c *RestClient) renewAuthorization(req *http.Request) (*http.Request, error) {
+	c.Settings.TokenSource.Invalidate()
+
+	retry := req.Clone(req.Context())
+	if req.Body != nil {
+		if req.GetBody == nil {
+			return nil, ErrApiInvocationError
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+
+	if err := c.authorize(retry); err != nil {
+		return nil, err
+	}
+	return retry, nil
+}
+
+// NewLoggingTransport returns a client with request logging and the default retry policy
 func NewLoggingTransport(transport http.RoundTripper) *http.Client {
-	retryTransport := rehttp.NewTransport(
-		transport,
-		rehttp.RetryAll(
-			rehttp.RetryMaxRetries(3),
-			rehttp.RetryAny(
-				rehttp.RetryTemporaryErr(),
-				rehttp.RetryStatuses(502, 503),
-			),
-		),
-		rehttp.ExpJitterDelay(100*time.Millisecond, 1*time.Second),
-	)
+	return &http.Client{
+		Transport: &LoggingTransport{
+			InnerTransport: &TracingTransport{
+				InnerTransport: &MetricsTransport{
+					InnerTransport: NewRetryTransport(transport, nil),
+				},
+			},
+			Redactor: NewRedactor(nil),
+		},
+	}
+}
+
+// NewHttpClient returns a client that wraps transport according to the dial settings.
+// The layers are, from the outside in: logging, tracing, cache, metrics, circuit breaker, retries, rate limiting.
+func NewHttpClient(transport http.RoundTripper, ds *settings.DialSettings) *http.Client {
+	if ds.RateLimit != nil && ds.RateLimit.RequestsPerSecond > 0 {
+		transport = NewRateLimitTransport(transport, ds.RateLimit)
+	}
+	transport = NewRetryTransport(transport, ds.Retry)
+	if ds.CircuitBreaker != nil {
+		transport = NewCircuitBreakerTransport(transport, ds.UserAgent, ds.CircuitBreaker)
+	}
+
+	// cache hits are not sent, so they don't show up in the request metrics
+	transport = &MetricsTransport{
+		InnerTransport: transport,
+	}
+	if ds.Cache != nil {
+		transport = NewCacheTransport(transport, ds.UserAgent, ds.Cache)
+	}
 
 	return &http.Client{
 		Transport: &LoggingTransport{
-			InnerTransport: retryTransport,
+			InnerTransport: &TracingTransport{
+				InnerTransport: transport,
+			},
+			Redactor: NewRedactor(ds.Redaction),
 		},
 	}
 }
 
-// RoundTrip logs the request and reply if the log level is debug or trace
+// RoundTrip logs the request and reply if the log level is debug or trace.
+// At trace level, headers and bodies are logged with all secrets masked. Streamed bodies are never logged.
 func (t *LoggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 
 	xreqid := XID()
 
+	if IsStream(req) {
+		log.Debug().Str("m", req.Method).Str("r", req.URL.RequestURI()).Str("uid", xreqid).Msg("REQ")
+		resp, err := t.InnerTransport.RoundTrip(req)
+		if err == nil {
+			log.Debug().Str("r", req.URL.RequestURI()).Int("status", resp.StatusCode).Int64("len", resp.ContentLength).Str("uid", xreqid).Msg("RESP")
+		}
+		return resp, err
+	}
+
 	if log.Debug().Enabled() {
 		req = req.WithContext(context.WithValue(req.Context(), ctxKeyRequestStart, time.Now()))
 		t.logRequest(req, xreqid)
@@ -231,7 +431,8 @@ func (t *LoggingTransport) logRequest(req *http.Request, reqid string) {
 		log.Error().Err(err).Str("uid", reqid).Msg(err.Error())
 	} else {
 		if log.Trace().Enabled() {
-			log.Trace().Str("m", req.Method).Str("r", req.URL.RequestURI()).Bytes("body", data).Str("uid", reqid).Msg("REQ")
+			r := t.redactor()
+			log.Trace().Str("m", req.Method).Str("r", req.URL.RequestURI()).Interface("h", r.Header(req.Header)).Bytes("body", r.Body(data)).Str("uid", reqid).Msg("REQ")
 		} else {
 			log.Debug().Str("m", req.Method).Str("r", req.URL.RequestURI()).Str("uid", reqid).Msg("REQ")
 		}
@@ -249,15 +450,17 @@ func (t *LoggingTransport) logResponse(resp *http.Response, reqid string) {
 		log.Error().Err(err).Str("uid", reqid).Msg(err.Error())
 	}
 
+	r := t.redactor()
+
 	if start, ok := ctx.Value(ctxKeyRequestStart).(time.Time); ok {
 		if log.Trace().Enabled() {
-			log.Trace().Str("r", resp.Request.URL.RequestURI()).Int("status", resp.StatusCode).Bytes("body", data).Str("d", fmt.Sprintf("%s", Duration(time.Since(start), 2))).Str("uid", reqid).Msg("RESP")
+			log.Trace().Str("r", resp.Request.URL.RequestURI()).Int("status", resp.StatusCode).Interface("h", r.Header(resp.Header)).Bytes("body", r.Body(data)).Str("d", fmt.Sprintf("%s", Duration(time.Since(start), 2))).Str("uid", reqid).Msg("RESP")
 		} else {
 			log.Debug().Str("r", resp.Request.URL.RequestURI()).Int("status", resp.StatusCode).Str("d", fmt.Sprintf("%s", Duration(time.Since(start), 2))).Str("uid", reqid).Msg("RESP")
 		}
 	} else {
 		if log.Trace().Enabled() {
-			log.Trace().Str("r", resp.Request.URL.RequestURI()).Int("status", resp.StatusCode).Bytes("body", data).Str("uid", reqid).Msg("RESP")
+			log.Trace().Str("r", resp.Request.URL.RequestURI()).Int("status", resp.StatusCode).Interface("h", r.Header(resp.Header)).Bytes("body", r.Body(data)).Str("uid", reqid).Msg("RESP")
 		} else {
 			log.Debug().Str("r", resp.Request.URL.RequestURI()).Int("status", resp.StatusCode).Str("uid", reqid).Msg("RESP")
 		}
@@ -265,3 +468,10 @@ func (t *LoggingTransport) logResponse(resp *http.Response, reqid string) {
 
 	resp.Body = io.NopCloser(bytes.NewReader(data))
 }
+
+func (t *LoggingTransport) redactor() *Redactor {
+	if t.Redactor == nil {
+		return NewRedactor(nil)
+	}
+	return t.Redactor
+}
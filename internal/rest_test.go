@@ -2,16 +2,56 @@ package internal
 
 import (
 	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
 )
 
+func newTestClient(endpoint string) *RestClient {
+	return &RestClient{
+		HttpClient: NewLoggingTransport(http.DefaultTransport),
+		Settings: &settings.DialSettings{
+			Endpoint:    endpoint,
+			UserAgent:   ApiAgent,
+			Credentials: &settings.Credentials{},
+		},
+	}
+}
+
+// newCassetteClient replays testdata/<test>.json. To record it against a live endpoint,
+// run the test with CASSETTE_MODE=record and the usual HTTP_ENDPOINT and CLIENT_* environment.
+func newCassetteClient(t *testing.T) *RestClient {
+	c, err := NewCassetteFromEnv(filepath.Join("testdata", t.Name()+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := []ClientOption{WithCassette(c)}
+	if c.Mode == CassetteRecord {
+		t.Cleanup(func() { assert.NoError(t, c.Save()) })
+	} else {
+		opts = append(opts, WithEndpoint(ReplayEndpoint), WithCredentials("foo", "bar"), WithTokenURL(""))
+	}
+
+	cl, err := NewRestClient(context.TODO(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cl
+}
+
 func TestNewRestClient(t *testing.T) {
 
-	cl, err := NewRestClient(context.TODO())
+	cl := newCassetteClient(t)
 	assert.NotNil(t, cl)
-	assert.NoError(t, err)
 
 	if cl != nil {
 		assert.NotNil(t, cl.HttpClient)
@@ -42,3 +82,140 @@ func TestNewDrogueRestWithOptions(t *testing.T) {
 	assert.NotEmpty(t, cl.Settings.Endpoint)
 	assert.Equal(t, "foo.example.com", cl.Settings.Endpoint)
 }
+
+func TestRequestWithContextDeadline(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		w.WriteHeader(http.StatusServiceUnavailable) // would trigger a retry
+	}))
+	defer srv.Close()
+
+	cl := newTestClient(srv.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := cl.GETWithContext(ctx, "/slow", nil)
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestRequestWithContextCancel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	cl := newTestClient(srv.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := cl.POSTWithContext(ctx, "/cancelled", map[string]string{"foo": "bar"}, nil)
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestAPIError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-ID", "req-1")
+		switch r.URL.Path {
+		case "/drogue":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"NotFound","message":"device not found"}`))
+		case "/problem":
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"title":"Conflict","status":409,"detail":"campaign already running"}`))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("go away"))
+		}
+	}))
+	defer srv.Close()
+
+	cl := newTestClient(srv.URL)
+
+	status, err := cl.GET("/drogue", nil)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.True(t, IsNotFound(err))
+	assert.True(t, errors.Is(err, ErrApiInvocationError))
+
+	apiErr, ok := AsAPIError(err)
+	if assert.True(t, ok) {
+		assert.Equal(t, "GET", apiErr.Method)
+		assert.Equal(t, srv.URL+"/drogue", apiErr.URL)
+		assert.Equal(t, "req-1", apiErr.RequestID)
+		assert.NotNil(t, apiErr.Details)
+		assert.Equal(t, "NotFound", apiErr.Details.Error)
+		assert.Nil(t, apiErr.Problem)
+	}
+
+	_, err = cl.POST("/problem", nil, nil)
+	assert.True(t, IsConflict(err))
+	apiErr, ok = AsAPIError(err)
+	if assert.True(t, ok) {
+		assert.NotNil(t, apiErr.Problem)
+		assert.Equal(t, "campaign already running", apiErr.Problem.Detail)
+		assert.Contains(t, apiErr.Error(), "campaign already running")
+	}
+
+	_, err = cl.DELETE("/other", nil, nil)
+	assert.True(t, IsAuthError(err))
+	assert.False(t, IsNotFound(err))
+	assert.Equal(t, []byte("go away"), err.(*APIError).Body)
+}
+
+func TestWithProfile(t *testing.T) {
+	profile := settings.Profile{
+		RestService: &settings.DialSettings{
+			Endpoint:    "https://api.example.com",
+			Credentials: &settings.Credentials{UserID: "foo", Token: "bar"},
+		},
+		"other": &settings.DialSettings{
+			Endpoint: "https://other.example.com",
+		},
+	}
+
+	cl, err := NewRestClient(context.TODO(), WithProfile(profile))
+	assert.NoError(t, err)
+	assert.Equal(t, "https://api.example.com", cl.Settings.Endpoint)
+	assert.Equal(t, "foo", cl.Settings.Credentials.UserID)
+
+	// values set before take precedence
+	t.Setenv(HttpEndpoint, "http://localhost")
+	cl, err = NewRestClient(context.TODO(), WithProfile(profile))
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost", cl.Settings.Endpoint)
+}
+
+func TestWithProfileReplacesEnvProfile(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(config, []byte("profiles:\n  env:\n    rest:\n      endpoint: https://env.example.com\n"), 0600))
+	t.Setenv(settings.ConfigFile, config)
+	t.Setenv(settings.ProfileName, "env")
+	t.Setenv(HttpEndpoint, "")
+	t.Setenv(settings.ClientSecret, "bar")
+
+	cl, err := NewRestClient(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, "https://env.example.com", cl.Settings.Endpoint)
+
+	explicit := settings.Profile{RestService: &settings.DialSettings{Endpoint: "https://api.example.com"}}
+	cl, err = NewRestClient(context.TODO(), WithProfile(explicit))
+	assert.NoError(t, err)
+	assert.Equal(t, "https://api.example.com", cl.Settings.Endpoint)
+
+	// the env config has no default profile, it is not loaded at all
+	os.Unsetenv(settings.ProfileName)
+	_, err = NewRestClient(context.TODO())
+	assert.Error(t, err)
+	_, err = NewRestClient(context.TODO(), WithProfile(explicit))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/PuerkitoBio/rehttp"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	// maxRetryAfter caps the delay requested by a server with Retry-After
+	maxRetryAfter = 1 * time.Minute
+)
+
+var (
+	ctxKeyIdempotencyKey = &contextKey{"IdempotencyKey"}
+)
+
+// DefaultRetryPolicy retries idempotent requests up to 3 times on temporary errors, 429, 502 and 503.
+func DefaultRetryPolicy() *settings.RetryPolicy {
+	return &settings.RetryPolicy{
+		MaxAttempts:   4,
+		MinBackoff:    settings.Duration(100 * time.Millisecond),
+		MaxBackoff:    settings.Duration(1 * time.Second),
+		RetryStatuses: []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable},
+	}
+}
+
+// WithIdempotencyKey returns a context that sends key as Idempotency-Key header with the request.
+// Non-idempotent requests, e.g. POST, are only retried if they carry such a key.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, ctxKeyIdempotencyKey, key)
+}
+
+func idempotencyKey(ctx context.Context) string {
+	if key, ok := ctx.Value(ctxKeyIdempotencyKey).(string); ok {
+		return key
+	}
+	return ""
+}
+
+// NewRetryTransport wraps transport with the retry logic defined by policy. A nil policy uses DefaultRetryPolicy.
+// Requests with a streamed body, see StreamRequest, are never retried, as retrying would buffer the whole body.
+func NewRetryTransport(transport http.RoundTripper, policy *settings.RetryPolicy) http.RoundTripper {
+	if policy == nil {
+		policy = DefaultRetryPolicy()
+	}
+	if policy.MaxAttempts <= 1 {
+		return transport
+	}
+
+	minBackoff, maxBackoff := policy.MinBackoff.Duration(), policy.MaxBackoff.Duration()
+	if minBackoff <= 0 {
+		minBackoff = DefaultRetryPolicy().MinBackoff.Duration()
+	}
+	if maxBackoff < minBackoff {
+		maxBackoff = minBackoff
+	}
+
+	retry := rehttp.NewTransport(
+		transport,
+		countRetries(rehttp.RetryAll(
+			rehttp.RetryMaxRetries(policy.MaxAttempts-1),
+			retryIdempotent(policy.RetryNonIdempotent),
+			rehttp.RetryAny(
+				rehttp.RetryTemporaryErr(),
+				rehttp.RetryStatuses(policy.RetryStatuses...),
+			),
+		)),
+		retryAfterDelay(rehttp.ExpJitterDelay(minBackoff, maxBackoff)),
+	)
+	return &streamBypass{retry: retry, transport: transport}
+}
+
+// streamBypass sends requests with a streamed body directly to transport, rehttp reads any body into memory
+type streamBypass struct {
+	retry     http.RoundTripper
+	transport http.RoundTripper
+}
+
+func (t *streamBypass) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody && IsStream(req) {
+		return t.transport.RoundTrip(req)
+	}
+	return t.retry.RoundTrip(req)
+}
+
+// countRetries records a retry metric whenever retry decides to try again
+func countRetries(retry rehttp.RetryFn) rehttp.RetryFn {
+	return func(attempt rehttp.Attempt) bool {
+		if !retry(attempt) {
+			return false
+		}
+		retriesTotal.WithLabelValues(metricLabels(attempt.Request)).Inc()
+		return true
+	}
+}
+
+// retryIdempotent only allows retries of idempotent methods or requests with an idempotency key
+func retryIdempotent(nonIdempotent bool) rehttp.RetryFn {
+	return func(attempt rehttp.Attempt) bool {
+		if nonIdempotent || attempt.Request.Header.Get(IdempotencyKeyHeader) != "" {
+			return true
+		}
+		switch attempt.Request.Method {
+		case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+			return true
+		}
+		return false
+	}
+}
+
+// retryAfterDelay honors the Retry-After header of e.g. 429 or 503 responses and uses delay otherwise
+func retryAfterDelay(delay rehttp.DelayFn) rehttp.DelayFn {
+	return func(attempt rehttp.Attempt) time.Duration {
+		if attempt.Response != nil {
+			if d, ok := parseRetryAfter(attempt.Response.Header.Get("Retry-After")); ok {
+				if d > maxRetryAfter {
+					return maxRetryAfter
+				}
+				return d
+			}
+		}
+		return delay(attempt)
+	}
+}
+
+// parseRetryAfter supports both delay-seconds and HTTP-date values
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/rehttp"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	cl, err := NewRestClient(context.TODO(), WithEndpoint(srv.URL), WithCredentials("foo", "bar"), WithRetryPolicy(settings.RetryPolicy{
+		MaxAttempts:   3,
+		MinBackoff:    settings.Duration(time.Millisecond),
+		MaxBackoff:    settings.Duration(5 * time.Millisecond),
+		RetryStatuses: []int{http.StatusServiceUnavailable},
+	}))
+	assert.NoError(t, err)
+
+	// idempotent, retried
+	status, err := cl.GET("/", nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, int32(3), atomic.SwapInt32(&calls, 0))
+
+	// not idempotent, not retried
+	cl.POST("/", nil, nil)
+	assert.Equal(t, int32(1), atomic.SwapInt32(&calls, 0))
+
+	// not idempotent but with an idempotency key
+	cl.POSTWithContext(WithIdempotencyKey(context.TODO(), "key-1"), "/", map[string]string{"foo": "bar"}, nil)
+	assert.Equal(t, int32(3), atomic.SwapInt32(&calls, 0))
+}
+
+func TestRetryDisabled(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	cl, err := NewRestClient(context.TODO(), WithEndpoint(srv.URL), WithCredentials("foo", "bar"), WithRetryPolicy(settings.RetryPolicy{MaxAttempts: 1}))
+	assert.NoError(t, err)
+
+	cl.GET("/", nil)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestRetryAfter(t *testing.T) {
+	delay := retryAfterDelay(func(rehttp.Attempt) time.Duration { return time.Millisecond })
+
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+	resp.Header.Set("Retry-After", "2")
+	assert.Equal(t, 2*time.Second, delay(rehttp.Attempt{Response: resp}))
+
+	resp.Header.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	assert.Equal(t, maxRetryAfter, delay(rehttp.Attempt{Response: resp}))
+
+	resp.Header.Set("Retry-After", "soon")
+	assert.Equal(t, time.Millisecond, delay(rehttp.Attempt{Response: resp}))
+	assert.Equal(t, time.Millisecond, delay(rehttp.Attempt{}))
+}
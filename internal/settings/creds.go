@@ -5,6 +5,7 @@
 package settings
 
 import (
+	"context"
 	"strings"
 
 	"github.com/txsvc/stdlib/v2"
@@ -23,6 +24,19 @@ type (
 		Token     string `json:"token,omitempty"`      // may be empty
 		Expires   int64  `json:"expires,omitempty"`    // 0 = never, > 0 = unix timestamp, < 0 = invalid
 	}
+
+	// TokenSource provides short-lived access tokens, e.g. from an OAuth2 token endpoint.
+	TokenSource interface {
+		// Token returns a valid access token, fetching a new one if needed
+		Token(ctx context.Context) (*Credentials, error)
+		// Invalidate discards the current token, e.g. because the API rejected it
+		Invalidate()
+	}
+
+	// CredentialsProvider supplies the current static credentials, e.g. from a secret that is rotated at runtime.
+	CredentialsProvider interface {
+		Credentials() *Credentials
+	}
 )
 
 func CredentialsFromEnv() *Credentials {
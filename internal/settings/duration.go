@@ -0,0 +1,47 @@
+package settings
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Duration is a time.Duration that is written as a string like "30s" or "1m30s" in config files.
+// Plain numbers are accepted as nanoseconds.
+type Duration time.Duration
+
+// Duration returns d as time.Duration
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	switch value := v.(type) {
+	case float64:
+		*d = Duration(value)
+	case string:
+		td, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(td)
+	default:
+		return fmt.Errorf("invalid duration '%s'", string(data))
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package settings
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/txsvc/stdlib/v2"
+)
+
+const (
+	ConfigFile  = "SHADOWCAR_CONFIG"  // path of the YAML or JSON config file
+	ProfileName = "SHADOWCAR_PROFILE" // the profile to use, DefaultProfile if not set
+
+	DefaultProfile = "default"
+)
+
+var (
+	// Services are the service names a profile may configure, see the clients' *Service constants
+	Services = []string{"rest", "drogue", "drogue-command", "drogue-events", "campaignmanager", "shadow"}
+)
+
+type (
+	// Config holds named profiles, e.g. for the lab, staging and local clusters:
+	//
+	//	profiles:
+	//	  lab:
+	//	    drogue:
+	//	      endpoint: https://api-drogue.example.com
+	//	      token_url: https://sso.example.com/realms/drogue/protocol/openid-connect/token
+	//	    campaignmanager:
+	//	      endpoint: https://campaign-manager.example.com
+	Config struct {
+		Profiles map[string]Profile `json:"profiles"`
+	}
+
+	// Profile holds the settings per service, e.g. "drogue" or "campaignmanager"
+	Profile map[string]*DialSettings
+)
+
+// LoadConfig reads and validates a config file. JSON is accepted as well, as it is a subset of YAML.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// decode the YAML generically and use the JSON tags of DialSettings
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid config '%s': %w", path, err)
+	}
+	js, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config '%s': %w", path, err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.DisallowUnknownFields()
+
+	var cfg Config
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid config '%s': %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config '%s': %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// LoadProfile reads the config file at path and returns the profile name
+func LoadProfile(path, name string) (Profile, error) {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Profile(name)
+}
+
+// ProfileFromEnv loads the profile selected by SHADOWCAR_CONFIG and SHADOWCAR_PROFILE, it returns nil if no config file is set
+func ProfileFromEnv() (Profile, error) {
+	path := stdlib.GetString(ConfigFile, "")
+	if path == "" {
+		return nil, nil
+	}
+	return LoadProfile(path, stdlib.GetString(ProfileName, DefaultProfile))
+}
+
+// Profile returns the profile name
+func (c *Config) Profile(name string) (Profile, error) {
+	p, ok := c.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile '%s'", name)
+	}
+	return p, nil
+}
+
+// Validate verifies all profiles
+func (c *Config) Validate() error {
+	if len(c.Profiles) == 0 {
+		return fmt.Errorf("no profiles")
+	}
+	for name, p := range c.Profiles {
+		for service, ds := range p {
+			if !isService(service) {
+				return fmt.Errorf("profile '%s': unknown service '%s'", name, service)
+			}
+			if ds == nil {
+				return fmt.Errorf("profile '%s': no settings for '%s'", name, service)
+			}
+			if err := ds.Validate(); err != nil {
+				return fmt.Errorf("profile '%s', service '%s': %w", name, service, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks the values that are set, it does not require any of them
+func (ds *DialSettings) Validate() error {
+	if err := validateURL("endpoint", ds.Endpoint); err != nil {
+		return err
+	}
+	if err := validateURL("token_url", ds.TokenURL); err != nil {
+		return err
+	}
+
+	if r := ds.Retry; r != nil {
+		if r.MaxAttempts < 0 || r.MinBackoff < 0 || r.MaxBackoff < 0 {
+			return fmt.Errorf("retry: negative values")
+		}
+		if r.MaxBackoff > 0 && r.MaxBackoff < r.MinBackoff {
+			return fmt.Errorf("retry: max_backoff < min_backoff")
+		}
+	}
+	if cb := ds.CircuitBreaker; cb != nil && (cb.FailureThreshold < 0 || cb.OpenTimeout < 0) {
+		return fmt.Errorf("circuit_breaker: negative values")
+	}
+	if rl := ds.RateLimit; rl != nil && (rl.RequestsPerSecond < 0 || rl.Burst < 0) {
+		return fmt.Errorf("rate_limit: negative values")
+	}
+	if c := ds.Cache; c != nil && (c.Size < 0 || c.TTL < 0) {
+		return fmt.Errorf("cache: negative values")
+	}
+
+	if t := ds.TLS; t != nil {
+		if (t.CertFile == "") != (t.KeyFile == "") {
+			return fmt.Errorf("tls: cert_file and key_file are required for mTLS")
+		}
+		switch t.MinVersion {
+		case "", "1.0", "1.1", "1.2", "1.3":
+		default:
+			return fmt.Errorf("tls: unsupported min_version '%s'", t.MinVersion)
+		}
+	}
+	return nil
+}
+
+// Merge copies all values from p that are not set in ds, i.e. values already in ds take precedence
+func (ds *DialSettings) Merge(p *DialSettings) {
+	if p == nil {
+		return
+	}
+	s := p.Clone()
+
+	if ds.Endpoint == "" {
+		ds.Endpoint = s.Endpoint
+	}
+	if ds.Credentials == nil || (ds.Credentials.UserID == "" && ds.Credentials.Token == "") {
+		if s.Credentials != nil {
+			ds.Credentials = s.Credentials
+		}
+	}
+	if ds.TokenURL == "" {
+		ds.TokenURL = s.TokenURL
+	}
+	if ds.TokenSource == nil {
+		ds.TokenSource = s.TokenSource
+	}
+	if ds.CredentialsDir == "" {
+		ds.CredentialsDir = s.CredentialsDir
+	}
+	if ds.CredentialsProvider == nil {
+		ds.CredentialsProvider = s.CredentialsProvider
+	}
+	if len(ds.Scopes) == 0 {
+		ds.Scopes = s.Scopes
+	}
+	if len(ds.DefaultScopes) == 0 {
+		ds.DefaultScopes = s.DefaultScopes
+	}
+	if ds.UserAgent == "" {
+		ds.UserAgent = s.UserAgent
+	}
+	if ds.Retry == nil {
+		ds.Retry = s.Retry
+	}
+	if ds.CircuitBreaker == nil {
+		ds.CircuitBreaker = s.CircuitBreaker
+	}
+	if ds.RateLimit == nil {
+		ds.RateLimit = s.RateLimit
+	}
+	if ds.Redaction == nil {
+		ds.Redaction = s.Redaction
+	}
+	if ds.TLS == nil {
+		ds.TLS = s.TLS
+	}
+	if ds.Cache == nil {
+		ds.Cache = s.Cache
+	}
+	if ds.Transport == nil {
+		ds.Transport = s.Transport
+	}
+	for k, v := range s.Options {
+		if !ds.HasOption(k) {
+			ds.SetOption(k, v)
+		}
+	}
+}
+
+func isService(name string) bool {
+	for _, s := range Services {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+func validateURL(name, v string) error {
+	if v == "" {
+		return nil
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s: '%s' is not a http(s) URL", name, v)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package settings
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfig = `
+profiles:
+  lab:
+    drogue:
+      endpoint: https://api-drogue.lab.example.com
+      token_url: https://sso.lab.example.com/token
+      credentials:
+        user_id: foo
+        token: bar
+      circuit_breaker:
+        failure_threshold: 3
+        open_timeout: 30s
+      cache:
+        ttl: 1m30s
+    campaignmanager:
+      endpoint: https://campaign-manager.lab.example.com
+  local:
+    drogue:
+      endpoint: http://localhost:8080
+`
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := LoadConfig(writeConfig(t, testConfig))
+	assert.NoError(t, err)
+	assert.Len(t, cfg.Profiles, 2)
+
+	p, err := cfg.Profile("lab")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://api-drogue.lab.example.com", p["drogue"].Endpoint)
+	assert.Equal(t, "bar", p["drogue"].Credentials.Token)
+	assert.Equal(t, 3, p["drogue"].CircuitBreaker.FailureThreshold)
+	assert.Equal(t, 30*time.Second, p["drogue"].CircuitBreaker.OpenTimeout.Duration())
+	assert.Equal(t, 90*time.Second, p["drogue"].Cache.TTL.Duration())
+
+	_, err = cfg.Profile("staging")
+	assert.Error(t, err)
+
+	// JSON works as well
+	p, err = LoadProfile(writeConfig(t, `{"profiles":{"default":{"rest":{"endpoint":"http://localhost"}}}}`), DefaultProfile)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost", p["rest"].Endpoint)
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	for _, content := range []string{
+		"profiles: {}",
+		"profiles:\n  lab:\n    drogue:\n      endpoint: localhost:8080",
+		"profiles:\n  lab:\n    drogue:\n      endpont: http://localhost",
+		"profiles:\n  lab:\n    drogue:\n      tls:\n        cert_file: client.pem",
+		"profiles:\n  lab:\n    drogue:\n      tls:\n        min_version: '2.0'",
+		"profiles:\n  lab:\n    drogue:\n      retry:\n        max_attempts: -1",
+		"profiles:\n  lab:\n    drogue:\n      cache:\n        ttl: 30 seconds",
+		"profiles:\n  lab:\n    droguee:\n      endpoint: http://localhost",
+		"profiles: [",
+	} {
+		_, err := LoadConfig(writeConfig(t, content))
+		assert.Error(t, err, content)
+	}
+
+	_, err := LoadConfig("missing.yaml")
+	assert.Error(t, err)
+}
+
+func TestMergeDialSettings(t *testing.T) {
+	ds := &DialSettings{
+		Endpoint:    "http://localhost",
+		Credentials: &Credentials{},
+		Options:     map[string]string{"a": "1"},
+	}
+	p := &DialSettings{
+		Endpoint:       "https://api.example.com",
+		TokenURL:       "https://sso.example.com/token",
+		Credentials:    &Credentials{UserID: "foo", Token: "bar"},
+		CircuitBreaker: &CircuitBreakerSettings{OpenTimeout: Duration(time.Second)},
+		Options:        map[string]string{"a": "2", "b": "3"},
+	}
+
+	ds.Merge(p)
+	assert.Equal(t, "http://localhost", ds.Endpoint)
+	assert.Equal(t, "https://sso.example.com/token", ds.TokenURL)
+	assert.Equal(t, "bar", ds.Credentials.Token)
+	assert.Equal(t, time.Second, ds.CircuitBreaker.OpenTimeout.Duration())
+	assert.Equal(t, "1", ds.GetOption("a"))
+	assert.Equal(t, "3", ds.GetOption("b"))
+
+	// the profile is not shared
+	ds.Credentials.Token = "baz"
+	assert.Equal(t, "bar", p.Credentials.Token)
+}
@@ -4,29 +4,101 @@
 // For details and copyright etc. see above url.
 package settings
 
+import (
+	"net/http"
+)
+
 type (
 	State int
 
 	// DialSettings holds information needed to establish a connection with a
 	// backend API service or to simply configure a service/CLI.
 	DialSettings struct {
+		Service  string `json:"-"` // selects the settings of a Profile
 		Endpoint string `json:"endpoint,omitempty"`
 
 		Credentials *Credentials `json:"credentials,omitempty"`
+		TokenURL    string       `json:"token_url,omitempty"` // OAuth2 token endpoint, Credentials are used as client credentials
+		TokenSource TokenSource  `json:"-"`
+		// CredentialsDir contains files with the credentials, they are reloaded when changed
+		CredentialsDir      string              `json:"credentials_dir,omitempty"`
+		CredentialsProvider CredentialsProvider `json:"-"`
 
 		Scopes        []string `json:"scopes,omitempty"`
 		DefaultScopes []string `json:"default_scopes,omitempty"`
 
 		UserAgent string `json:"user_agent,omitempty"`
 
+		Retry          *RetryPolicy            `json:"retry,omitempty"`
+		CircuitBreaker *CircuitBreakerSettings `json:"circuit_breaker,omitempty"`
+		RateLimit      *RateLimitSettings      `json:"rate_limit,omitempty"`
+		Redaction      *RedactionSettings      `json:"redaction,omitempty"`
+		TLS            *TLSSettings            `json:"tls,omitempty"`
+		Cache          *CacheSettings          `json:"cache,omitempty"`
+		// Transport replaces the default transport, e.g. with a recording for tests. TLS is ignored if set.
+		Transport http.RoundTripper `json:"-"`
+
 		Options map[string]string `json:"options,omitempty"` // holds all other values ...
 	}
+
+	// RetryPolicy controls if and how failed requests are retried.
+	RetryPolicy struct {
+		MaxAttempts   int      `json:"max_attempts,omitempty"` // including the first attempt, 1 disables retries
+		MinBackoff    Duration `json:"min_backoff,omitempty"`
+		MaxBackoff    Duration `json:"max_backoff,omitempty"`
+		RetryStatuses []int    `json:"retry_statuses,omitempty"`
+		// RetryNonIdempotent allows retries of e.g. POST requests without an idempotency key
+		RetryNonIdempotent bool `json:"retry_non_idempotent,omitempty"`
+	}
+
+	// CircuitBreakerSettings controls when calls to an unhealthy endpoint fail fast.
+	CircuitBreakerSettings struct {
+		FailureThreshold int      `json:"failure_threshold,omitempty"` // consecutive failures that open the circuit
+		OpenTimeout      Duration `json:"open_timeout,omitempty"`      // time until a probe request is let through
+	}
+
+	// RateLimitSettings configures a token bucket per endpoint.
+	RateLimitSettings struct {
+		RequestsPerSecond float64 `json:"requests_per_second,omitempty"`
+		Burst             int     `json:"burst,omitempty"`
+	}
+
+	// RedactionSettings control what is masked in the request/response trace log.
+	RedactionSettings struct {
+		Paths       []string `json:"paths,omitempty"`         // dot-separated JSON paths, in addition to the defaults
+		MaxBodySize int      `json:"max_body_size,omitempty"` // in bytes, negative disables the limit
+	}
+
+	// CacheSettings enable the response cache for GET requests.
+	CacheSettings struct {
+		Size int      `json:"size,omitempty"` // max. number of entries
+		TTL  Duration `json:"ttl,omitempty"`  // used if the response has no Cache-Control max-age
+	}
+
+	// TLSSettings configure how the server is verified and how the client authenticates itself.
+	TLSSettings struct {
+		CAFile     string `json:"ca_file,omitempty"`   // PEM bundle, in addition to the system roots
+		CertFile   string `json:"cert_file,omitempty"` // client certificate for mTLS
+		KeyFile    string `json:"key_file,omitempty"`
+		ServerName string `json:"server_name,omitempty"`
+		MinVersion string `json:"min_version,omitempty"` // e.g. "1.2" or "1.3"
+		// InsecureSkipVerify disables the verification of the server certificate, never use this in production!
+		InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+	}
 )
 
 func (ds *DialSettings) Clone() DialSettings {
 	s := DialSettings{
-		Endpoint:  ds.Endpoint,
-		UserAgent: ds.UserAgent,
+		Service:     ds.Service,
+		Endpoint:    ds.Endpoint,
+		TokenURL:    ds.TokenURL,
+		TokenSource: ds.TokenSource,
+		UserAgent:   ds.UserAgent,
+
+		CredentialsDir:      ds.CredentialsDir,
+		CredentialsProvider: ds.CredentialsProvider,
+
+		Transport: ds.Transport,
 	}
 
 	if len(ds.Scopes) > 0 {
@@ -41,6 +113,32 @@ func (ds *DialSettings) Clone() DialSettings {
 	if ds.Credentials != nil {
 		s.Credentials = ds.Credentials.Clone()
 	}
+	if ds.Retry != nil {
+		s.Retry = ds.Retry.Clone()
+	}
+	if ds.CircuitBreaker != nil {
+		cb := *ds.CircuitBreaker
+		s.CircuitBreaker = &cb
+	}
+	if ds.RateLimit != nil {
+		rl := *ds.RateLimit
+		s.RateLimit = &rl
+	}
+	if ds.Redaction != nil {
+		s.Redaction = &RedactionSettings{MaxBodySize: ds.Redaction.MaxBodySize}
+		if len(ds.Redaction.Paths) > 0 {
+			s.Redaction.Paths = make([]string, len(ds.Redaction.Paths))
+			copy(s.Redaction.Paths, ds.Redaction.Paths)
+		}
+	}
+	if ds.TLS != nil {
+		tc := *ds.TLS
+		s.TLS = &tc
+	}
+	if ds.Cache != nil {
+		c := *ds.Cache
+		s.Cache = &c
+	}
 	if len(ds.Options) > 0 {
 		s.Options = make(map[string]string)
 		for k, v := range ds.Options {
@@ -79,3 +177,13 @@ func (ds *DialSettings) SetOption(opt, o string) {
 	}
 	ds.Options[opt] = o
 }
+
+// Clone returns a deep copy of the retry policy
+func (p *RetryPolicy) Clone() *RetryPolicy {
+	c := *p
+	if len(p.RetryStatuses) > 0 {
+		c.RetryStatuses = make([]int, len(p.RetryStatuses))
+		copy(c.RetryStatuses, p.RetryStatuses)
+	}
+	return &c
+}
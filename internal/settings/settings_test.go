@@ -70,4 +70,28 @@ func TestCloneDialSettings(t *testing.T) {
 
 	dup4 := s1.Clone()
 	assert.Equal(t, s1, dup4)
+
+	// adding a retry policy
+	s1.Retry = &RetryPolicy{
+		MaxAttempts:   3,
+		RetryStatuses: []int{429, 503},
+	}
+
+	dup5 := s1.Clone()
+	assert.Equal(t, s1, dup5)
+
+	dup5.Retry.RetryStatuses[0] = 500
+	assert.Equal(t, 429, s1.Retry.RetryStatuses[0])
+
+	// adding redaction paths
+	s1.Redaction = &RedactionSettings{
+		Paths:       []string{"user.password"},
+		MaxBodySize: 1024,
+	}
+
+	dup6 := s1.Clone()
+	assert.Equal(t, s1, dup6)
+
+	dup6.Redaction.Paths[0] = "token"
+	assert.Equal(t, "user.password", s1.Redaction.Paths[0])
 }
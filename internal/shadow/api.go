@@ -0,0 +1,120 @@
+package shadow
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/txsvc/apikit/api"
+)
+
+const (
+	// REST routes
+	PathVehicles = "/api/shadow/v1alpha1/vehicles"
+	PathVehicle  = "/api/shadow/v1alpha1/vehicles/:vin"
+	PathReported = "/api/shadow/v1alpha1/vehicles/:vin/reported"
+	PathDesired  = "/api/shadow/v1alpha1/vehicles/:vin/desired"
+	PathDelta    = "/api/shadow/v1alpha1/vehicles/:vin/delta"
+)
+
+type (
+	// API exposes a Service over REST
+	API struct {
+		svc *Service
+	}
+)
+
+// NewAPI adds the shadow endpoints to e
+func NewAPI(e *echo.Echo, svc *Service) *API {
+	a := &API{svc: svc}
+
+	e.GET(PathVehicles, a.listEndpoint)
+	e.GET(PathVehicle, a.getEndpoint)
+	e.DELETE(PathVehicle, a.deleteEndpoint)
+	e.PATCH(PathReported, a.reportEndpoint)
+	e.PATCH(PathDesired, a.desiredEndpoint)
+	e.PUT(PathDesired, a.replaceDesiredEndpoint)
+	e.GET(PathDelta, a.deltaEndpoint)
+
+	return a
+}
+
+func (a *API) listEndpoint(c echo.Context) error {
+	shadows, err := a.svc.List(c.Request().Context())
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusInternalServerError, err, "shadows not available")
+	}
+	return api.StandardResponse(c, http.StatusOK, shadows)
+}
+
+func (a *API) getEndpoint(c echo.Context) error {
+	s, err := a.svc.Get(c.Request().Context(), c.Param("vin"))
+	if err != nil {
+		return a.errorResponse(c, err)
+	}
+	return api.StandardResponse(c, http.StatusOK, s)
+}
+
+func (a *API) deleteEndpoint(c echo.Context) error {
+	if err := a.svc.Delete(c.Request().Context(), c.Param("vin")); err != nil {
+		return a.errorResponse(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// reportEndpoint merges the ReportedState in the body, see ReportedState.Merge
+func (a *API) reportEndpoint(c echo.Context) error {
+	var reported ReportedState
+	if err := c.Bind(&reported); err != nil {
+		return api.ErrorResponse(c, http.StatusBadRequest, err, "invalid reported state")
+	}
+
+	s, err := a.svc.Report(c.Request().Context(), c.Param("vin"), &reported)
+	if err != nil {
+		return a.errorResponse(c, err)
+	}
+	return api.StandardResponse(c, http.StatusOK, s)
+}
+
+// desiredEndpoint merges the DesiredState in the body, see DesiredState.Merge
+func (a *API) desiredEndpoint(c echo.Context) error {
+	var desired DesiredState
+	if err := c.Bind(&desired); err != nil {
+		return api.ErrorResponse(c, http.StatusBadRequest, err, "invalid desired state")
+	}
+
+	s, err := a.svc.SetDesired(c.Request().Context(), c.Param("vin"), &desired)
+	if err != nil {
+		return a.errorResponse(c, err)
+	}
+	return api.StandardResponse(c, http.StatusOK, s)
+}
+
+// replaceDesiredEndpoint replaces the desired state with the body, an empty body clears it
+func (a *API) replaceDesiredEndpoint(c echo.Context) error {
+	var desired DesiredState
+	if err := c.Bind(&desired); err != nil {
+		return api.ErrorResponse(c, http.StatusBadRequest, err, "invalid desired state")
+	}
+
+	s, err := a.svc.ReplaceDesired(c.Request().Context(), c.Param("vin"), &desired)
+	if err != nil {
+		return a.errorResponse(c, err)
+	}
+	return api.StandardResponse(c, http.StatusOK, s)
+}
+
+func (a *API) deltaEndpoint(c echo.Context) error {
+	s, err := a.svc.Get(c.Request().Context(), c.Param("vin"))
+	if err != nil {
+		return a.errorResponse(c, err)
+	}
+	return api.StandardResponse(c, http.StatusOK, s.Delta())
+}
+
+func (a *API) errorResponse(c echo.Context, err error) error {
+	if err == ErrNotFound {
+		return api.ErrorResponse(c, http.StatusNotFound, err, c.Param("vin"))
+	}
+	return api.ErrorResponse(c, http.StatusInternalServerError, err, c.Param("vin"))
+}
@@ -0,0 +1,135 @@
+package shadow
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/txsvc/stdlib/v2"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal"
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
+)
+
+const (
+	ShadowHttpEndpoint = "SHADOW_HTTP_ENDPOINT"
+
+	ShadowService  = "shadow" // the service name used in profiles
+	ShadowApiAgent = "shadowcar/shadow"
+
+	// API routes of the client, also used to label the request metrics
+	pathVehicle  = "/api/shadow/v1alpha1/vehicles/%s"
+	pathReported = "/api/shadow/v1alpha1/vehicles/%s/reported"
+	pathDesired  = "/api/shadow/v1alpha1/vehicles/%s/desired"
+)
+
+type (
+	// Client accesses the shadow service's REST API, see NewAPI
+	Client struct {
+		rc *internal.RestClient
+	}
+)
+
+func NewClient(ctx context.Context, opts ...internal.ClientOption) (*Client, error) {
+
+	ds := &settings.DialSettings{
+		Service:     ShadowService,
+		Endpoint:    stdlib.GetString(ShadowHttpEndpoint, ""),
+		UserAgent:   ShadowApiAgent,
+		Credentials: &settings.Credentials{}, // the service runs next to its clients, without authentication
+		TLS:         internal.TLSSettingsFromEnv(""),
+	}
+
+	if err := internal.ApplyProfileFromEnv(ds, opts...); err != nil {
+		return nil, err
+	}
+
+	// apply options
+	if len(opts) > 0 {
+		for _, opt := range opts {
+			opt.Apply(ds)
+		}
+	}
+
+	if err := internal.ResolveCredentials(ctx, ds); err != nil {
+		return nil, err
+	}
+
+	// do some basic validation
+	if ds.Endpoint == "" {
+		return nil, fmt.Errorf("missing SHADOW_HTTP_ENDPOINT")
+	}
+
+	rc, err := internal.NewRestClientFromSettings(ds)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		rc: rc,
+	}, nil
+}
+
+func (c *Client) Get(vin string) (int, *Shadow, error) {
+	return c.GetWithContext(context.Background(), vin)
+}
+
+func (c *Client) GetWithContext(ctx context.Context, vin string) (int, *Shadow, error) {
+	var resp Shadow
+
+	status, err := c.rc.GETWithContext(internal.WithRoute(ctx, pathVehicle), fmt.Sprintf(pathVehicle, url.PathEscape(vin)), &resp)
+	if err != nil {
+		return status, nil, err
+	}
+	return status, &resp, nil
+}
+
+func (c *Client) Report(vin string, reported *ReportedState) (int, *Shadow, error) {
+	return c.ReportWithContext(context.Background(), vin, reported)
+}
+
+// ReportWithContext merges reported into the vehicle's reported state, see Service.Report
+func (c *Client) ReportWithContext(ctx context.Context, vin string, reported *ReportedState) (int, *Shadow, error) {
+	return c.send(internal.WithRoute(ctx, pathReported), http.MethodPatch, fmt.Sprintf(pathReported, url.PathEscape(vin)), reported)
+}
+
+func (c *Client) SetDesired(vin string, desired *DesiredState) (int, *Shadow, error) {
+	return c.SetDesiredWithContext(context.Background(), vin, desired)
+}
+
+// SetDesiredWithContext merges desired into the vehicle's desired state, see Service.SetDesired
+func (c *Client) SetDesiredWithContext(ctx context.Context, vin string, desired *DesiredState) (int, *Shadow, error) {
+	return c.send(internal.WithRoute(ctx, pathDesired), http.MethodPatch, fmt.Sprintf(pathDesired, url.PathEscape(vin)), desired)
+}
+
+func (c *Client) ReplaceDesired(vin string, desired *DesiredState) (int, *Shadow, error) {
+	return c.ReplaceDesiredWithContext(context.Background(), vin, desired)
+}
+
+// ReplaceDesiredWithContext replaces the vehicle's desired state, see Service.ReplaceDesired
+func (c *Client) ReplaceDesiredWithContext(ctx context.Context, vin string, desired *DesiredState) (int, *Shadow, error) {
+	var resp Shadow
+
+	status, err := c.rc.PUTWithContext(internal.WithRoute(ctx, pathDesired), fmt.Sprintf(pathDesired, url.PathEscape(vin)), desired, &resp)
+	if err != nil {
+		return status, nil, err
+	}
+	return status, &resp, nil
+}
+
+func (c *Client) send(ctx context.Context, method, uri string, request interface{}) (int, *Shadow, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return http.StatusBadRequest, nil, err
+	}
+
+	var resp Shadow
+	status, err := c.rc.Upload(ctx, method, uri, bytes.NewReader(body), internal.ContentTypeJSON, &resp)
+	if err != nil {
+		return status, nil, err
+	}
+	return status, &resp, nil
+}
@@ -0,0 +1,163 @@
+package shadow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog/log"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal"
+)
+
+const (
+	// DefaultDeltaTopic is the MQTT topic of a vehicle's deltas, %s is the VIN
+	DefaultDeltaTopic = "shadowcar/%s/shadow/delta"
+
+	PublishTimeout = 10 * time.Second
+)
+
+type (
+	// Service applies changes to the shadows and notifies about changed deltas
+	Service struct {
+		Store    Store
+		Notifier Notifier // optional
+
+		mu sync.Mutex
+	}
+
+	// Notifier is told whenever the delta of a shadow changed, including when it becomes empty,
+	// and when a shadow is deleted
+	Notifier interface {
+		NotifyDelta(ctx context.Context, d *Delta) error
+		ClearDelta(ctx context.Context, vin string) error
+	}
+
+	// MQTTNotifier publishes deltas as retained messages, so that a vehicle receives the latest one when it connects
+	MQTTNotifier struct {
+		Client mqtt.Client
+		Topic  string // DefaultDeltaTopic if empty
+	}
+)
+
+func NewService(store Store, notifier Notifier) *Service {
+	return &Service{
+		Store:    store,
+		Notifier: notifier,
+	}
+}
+
+func (svc *Service) Get(ctx context.Context, vin string) (*Shadow, error) {
+	return svc.Store.Get(ctx, vin)
+}
+
+func (svc *Service) List(ctx context.Context) ([]*Shadow, error) {
+	return svc.Store.List(ctx)
+}
+
+// Delete removes the shadow and tells the notifier to drop its last delta
+func (svc *Service) Delete(ctx context.Context, vin string) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if err := svc.Store.Delete(ctx, vin); err != nil {
+		return err
+	}
+
+	if svc.Notifier != nil {
+		if err := svc.Notifier.ClearDelta(ctx, vin); err != nil {
+			log.Error().Str("vin", vin).Err(err).Msg("clearing the delta failed")
+		}
+	}
+	return nil
+}
+
+// Report merges reported into the vehicle's reported state, the shadow is created if needed
+func (svc *Service) Report(ctx context.Context, vin string, reported *ReportedState) (*Shadow, error) {
+	return svc.update(ctx, vin, func(s *Shadow) {
+		s.Reported.Merge(reported)
+	})
+}
+
+// SetDesired merges desired into the vehicle's desired state, the shadow is created if needed
+func (svc *Service) SetDesired(ctx context.Context, vin string, desired *DesiredState) (*Shadow, error) {
+	return svc.update(ctx, vin, func(s *Shadow) {
+		s.Desired.Merge(desired)
+		s.Desired.UpdatedAt = time.Now().UTC()
+	})
+}
+
+// ReplaceDesired replaces the vehicle's desired state, e.g. to withdraw a campaign. The shadow is created if needed.
+func (svc *Service) ReplaceDesired(ctx context.Context, vin string, desired *DesiredState) (*Shadow, error) {
+	return svc.update(ctx, vin, func(s *Shadow) {
+		s.Desired = DesiredState{
+			Campaign:  desired.Campaign,
+			Software:  cloneVersions(desired.Software),
+			UpdatedAt: time.Now().UTC(),
+		}
+	})
+}
+
+func (svc *Service) update(ctx context.Context, vin string, modify func(*Shadow)) (*Shadow, error) {
+	if vin == "" {
+		return nil, fmt.Errorf("missing vin")
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	s, err := svc.Store.Get(ctx, vin)
+	if err == ErrNotFound {
+		s = New(vin)
+	} else if err != nil {
+		return nil, err
+	}
+	before := s.Delta()
+
+	modify(s)
+	s.Version++
+	s.UpdatedAt = time.Now().UTC()
+
+	if err := svc.Store.Put(ctx, s); err != nil {
+		return nil, err
+	}
+
+	if after := s.Delta(); !after.Equal(before) && svc.Notifier != nil {
+		if err := svc.Notifier.NotifyDelta(ctx, after); err != nil {
+			// the delta is still available via the API
+			log.Error().Str("vin", vin).Err(err).Msg("delta notification failed")
+		}
+	}
+	return s, nil
+}
+
+// NotifyDelta implements Notifier
+func (n *MQTTNotifier) NotifyDelta(ctx context.Context, d *Delta) error {
+	payload, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	return n.publish(ctx, d.VIN, payload)
+}
+
+// ClearDelta implements Notifier, an empty retained message removes the retained delta from the broker
+func (n *MQTTNotifier) ClearDelta(ctx context.Context, vin string) error {
+	return n.publish(ctx, vin, []byte{})
+}
+
+func (n *MQTTNotifier) publish(ctx context.Context, vin string, payload []byte) error {
+	topic := n.Topic
+	if topic == "" {
+		topic = DefaultDeltaTopic
+	}
+
+	token := internal.PublishWithContext(ctx, n.Client, fmt.Sprintf(topic, vin), internal.AtLeastOnce, true, payload)
+	if !token.WaitTimeout(PublishTimeout) {
+		return fmt.Errorf("publishing the delta of '%s' timed out", vin)
+	}
+	return token.Error()
+}
@@ -0,0 +1,140 @@
+// Package shadow keeps a device shadow per vehicle: the state the vehicle last reported and the state
+// it should be in, e.g. the campaign it should install. The difference of both is the delta.
+package shadow
+
+import (
+	"time"
+)
+
+type (
+	// Shadow is the state of a vehicle, identified by its VIN
+	Shadow struct {
+		VIN       string        `json:"vin"`
+		Reported  ReportedState `json:"reported"`
+		Desired   DesiredState  `json:"desired"`
+		Version   int64         `json:"version"` // incremented with every change
+		UpdatedAt time.Time     `json:"updatedAt"`
+	}
+
+	// ReportedState is what the vehicle, or a service on its behalf, reported last
+	ReportedState struct {
+		Position       *Position         `json:"position,omitempty"`
+		Zone           string            `json:"zone,omitempty"`
+		Campaign       string            `json:"campaign,omitempty"`
+		CampaignStatus string            `json:"campaignStatus,omitempty"`
+		Software       map[string]string `json:"software,omitempty"` // component -> version
+		LastSeen       time.Time         `json:"lastSeen,omitempty"`
+	}
+
+	// DesiredState is the state the vehicle should reach
+	DesiredState struct {
+		Campaign  string            `json:"campaign,omitempty"`
+		Software  map[string]string `json:"software,omitempty"`  // component -> version
+		UpdatedAt time.Time         `json:"updatedAt,omitempty"` // set by the Service
+	}
+
+	Position struct {
+		Lat       float64 `json:"lat"`
+		Long      float64 `json:"long"`
+		Elevation float64 `json:"elev,omitempty"`
+	}
+
+	// Delta lists the desired state the vehicle has not reported yet
+	Delta struct {
+		VIN      string            `json:"vin"`
+		Campaign string            `json:"campaign,omitempty"`
+		Software map[string]string `json:"software,omitempty"`
+		Version  int64             `json:"version"`
+	}
+)
+
+// New returns an empty shadow
+func New(vin string) *Shadow {
+	return &Shadow{VIN: vin}
+}
+
+// Delta returns the difference between the desired and the reported state
+func (s *Shadow) Delta() *Delta {
+	d := &Delta{
+		VIN:     s.VIN,
+		Version: s.Version,
+	}
+
+	if s.Desired.Campaign != "" && s.Desired.Campaign != s.Reported.Campaign {
+		d.Campaign = s.Desired.Campaign
+	}
+	for component, version := range s.Desired.Software {
+		if s.Reported.Software[component] != version {
+			if d.Software == nil {
+				d.Software = make(map[string]string)
+			}
+			d.Software[component] = version
+		}
+	}
+	return d
+}
+
+// InSync reports whether the vehicle reached the desired state
+func (d *Delta) InSync() bool {
+	return d.Campaign == "" && len(d.Software) == 0
+}
+
+// Equal reports whether d and other describe the same difference, the version is not compared
+func (d *Delta) Equal(other *Delta) bool {
+	if d.Campaign != other.Campaign || len(d.Software) != len(other.Software) {
+		return false
+	}
+	for component, version := range d.Software {
+		if other.Software[component] != version {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge sets the fields of u that are not empty, software versions are merged per component
+func (r *ReportedState) Merge(u *ReportedState) {
+	if u.Position != nil {
+		p := *u.Position
+		r.Position = &p
+	}
+	if u.Zone != "" {
+		r.Zone = u.Zone
+	}
+	if u.Campaign != "" {
+		r.Campaign = u.Campaign
+	}
+	if u.CampaignStatus != "" {
+		r.CampaignStatus = u.CampaignStatus
+	}
+	r.Software = mergeVersions(r.Software, u.Software)
+	if u.LastSeen.After(r.LastSeen) {
+		r.LastSeen = u.LastSeen
+	}
+}
+
+// Merge sets the fields of u that are not empty, software versions are merged per component.
+// An empty version removes the component from the desired state, use Service.ReplaceDesired to clear the campaign.
+func (ds *DesiredState) Merge(u *DesiredState) {
+	if u.Campaign != "" {
+		ds.Campaign = u.Campaign
+	}
+	ds.Software = mergeVersions(ds.Software, u.Software)
+}
+
+func mergeVersions(versions, updates map[string]string) map[string]string {
+	if len(updates) == 0 {
+		return versions
+	}
+	if versions == nil {
+		versions = make(map[string]string)
+	}
+	for component, version := range updates {
+		if version == "" {
+			delete(versions, component)
+		} else {
+			versions[component] = version
+		}
+	}
+	return versions
+}
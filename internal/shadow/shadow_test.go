@@ -0,0 +1,195 @@
+package shadow
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal"
+)
+
+const vin = "WP0AA2991YS620631"
+
+type recordingNotifier struct {
+	deltas  []*Delta
+	cleared []string
+}
+
+func (n *recordingNotifier) NotifyDelta(ctx context.Context, d *Delta) error {
+	n.deltas = append(n.deltas, d)
+	return nil
+}
+
+func (n *recordingNotifier) ClearDelta(ctx context.Context, vin string) error {
+	n.cleared = append(n.cleared, vin)
+	return nil
+}
+
+func TestDelta(t *testing.T) {
+	s := New(vin)
+	assert.True(t, s.Delta().InSync())
+
+	s.Desired.Merge(&DesiredState{Campaign: "a", Software: map[string]string{"ecu": "2.0", "hmi": "1.1"}})
+	s.Reported.Merge(&ReportedState{Campaign: "a", Software: map[string]string{"ecu": "1.0", "hmi": "1.1"}})
+
+	d := s.Delta()
+	assert.False(t, d.InSync())
+	assert.Empty(t, d.Campaign)
+	assert.Equal(t, map[string]string{"ecu": "2.0"}, d.Software)
+
+	// an empty version removes the component from the desired state
+	s.Desired.Merge(&DesiredState{Software: map[string]string{"ecu": ""}})
+	assert.True(t, s.Delta().InSync())
+}
+
+func TestReportedStateMerge(t *testing.T) {
+	now := time.Now().UTC()
+
+	r := ReportedState{Zone: "redhat", LastSeen: now}
+	r.Merge(&ReportedState{Position: &Position{Lat: 39.79, Long: -86.23}, LastSeen: now.Add(-time.Minute)})
+
+	assert.Equal(t, "redhat", r.Zone)
+	assert.Equal(t, 39.79, r.Position.Lat)
+	assert.Equal(t, now, r.LastSeen) // older reports don't move it back
+}
+
+func TestService(t *testing.T) {
+	ctx := context.Background()
+	n := &recordingNotifier{}
+	svc := NewService(NewMemoryStore(), n)
+
+	_, err := svc.Get(ctx, vin)
+	assert.Equal(t, ErrNotFound, err)
+
+	s, err := svc.SetDesired(ctx, vin, &DesiredState{Campaign: "a"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), s.Version)
+	if assert.Len(t, n.deltas, 1) {
+		assert.Equal(t, "a", n.deltas[0].Campaign)
+	}
+
+	// unrelated changes don't notify
+	_, err = svc.Report(ctx, vin, &ReportedState{Zone: "luxoft"})
+	assert.NoError(t, err)
+	assert.Len(t, n.deltas, 1)
+
+	s, err = svc.Report(ctx, vin, &ReportedState{Campaign: "a"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), s.Version)
+	if assert.Len(t, n.deltas, 2) {
+		assert.True(t, n.deltas[1].InSync())
+	}
+
+	_, err = svc.Report(ctx, "", &ReportedState{Zone: "luxoft"})
+	assert.Error(t, err)
+
+	// the desired campaign can be withdrawn
+	s, err = svc.SetDesired(ctx, vin, &DesiredState{Campaign: "b"})
+	assert.NoError(t, err)
+	assert.False(t, s.Desired.UpdatedAt.IsZero())
+	s, err = svc.ReplaceDesired(ctx, vin, &DesiredState{})
+	assert.NoError(t, err)
+	assert.Empty(t, s.Desired.Campaign)
+	if assert.Len(t, n.deltas, 4) {
+		assert.True(t, n.deltas[3].InSync())
+	}
+
+	// the retained delta is removed with the shadow
+	assert.NoError(t, svc.Delete(ctx, vin))
+	assert.Equal(t, []string{vin}, n.cleared)
+	assert.Equal(t, ErrNotFound, svc.Delete(ctx, vin))
+	assert.Len(t, n.cleared, 1)
+}
+
+func TestAPI(t *testing.T) {
+	e := echo.New()
+	NewAPI(e, NewService(NewMemoryStore(), nil))
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodGet, "/api/shadow/v1alpha1/vehicles/"+vin, "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = do(http.MethodPatch, "/api/shadow/v1alpha1/vehicles/"+vin+"/desired", `{"software":{"ecu":"2.0"}}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = do(http.MethodPatch, "/api/shadow/v1alpha1/vehicles/"+vin+"/reported", `{"zone":"redhat","software":{"ecu":"1.0"}}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = do(http.MethodGet, "/api/shadow/v1alpha1/vehicles/"+vin+"/delta", "")
+	if assert.Equal(t, http.StatusOK, rec.Code) {
+		var d Delta
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &d))
+		assert.Equal(t, map[string]string{"ecu": "2.0"}, d.Software)
+		assert.Equal(t, int64(2), d.Version)
+	}
+
+	rec = do(http.MethodGet, "/api/shadow/v1alpha1/vehicles", "")
+	if assert.Equal(t, http.StatusOK, rec.Code) {
+		var shadows []*Shadow
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &shadows))
+		if assert.Len(t, shadows, 1) {
+			assert.Equal(t, "redhat", shadows[0].Reported.Zone)
+		}
+	}
+
+	rec = do(http.MethodDelete, "/api/shadow/v1alpha1/vehicles/"+vin, "")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	rec = do(http.MethodDelete, "/api/shadow/v1alpha1/vehicles/"+vin, "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestClient(t *testing.T) {
+	e := echo.New()
+	NewAPI(e, NewService(NewMemoryStore(), nil))
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	t.Setenv(ShadowHttpEndpoint, "")
+	_, err := NewClient(context.TODO())
+	assert.Error(t, err)
+
+	c, err := NewClient(context.TODO(), internal.WithEndpoint(srv.URL))
+	assert.NoError(t, err)
+
+	status, _, err := c.Get(vin)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.True(t, internal.IsNotFound(err))
+
+	status, s, err := c.Report(vin, &ReportedState{Zone: "redhat", CampaignStatus: "RUNNING"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "redhat", s.Reported.Zone)
+		assert.True(t, s.Desired.UpdatedAt.IsZero())
+	}
+
+	_, s, err = c.SetDesired(vin, &DesiredState{Campaign: "a"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "a", s.Desired.Campaign)
+		assert.False(t, s.Desired.UpdatedAt.IsZero())
+	}
+
+	_, s, err = c.ReplaceDesired(vin, &DesiredState{})
+	if assert.NoError(t, err) {
+		assert.Empty(t, s.Desired.Campaign)
+	}
+
+	_, s, err = c.Get(vin)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "RUNNING", s.Reported.CampaignStatus)
+		assert.Equal(t, int64(3), s.Version)
+	}
+}
@@ -0,0 +1,232 @@
+package shadow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	StoreMemory = "memory"
+	StoreFile   = "file" // file:<path>, e.g. file:/data/shadows.json
+)
+
+type (
+	// Store persists the shadows. Implementations must be safe for concurrent use,
+	// read-modify-write cycles are serialized by the Service.
+	Store interface {
+		Get(ctx context.Context, vin string) (*Shadow, error)
+		Put(ctx context.Context, s *Shadow) error
+		Delete(ctx context.Context, vin string) error
+		List(ctx context.Context) ([]*Shadow, error)
+	}
+
+	// MemoryStore keeps the shadows in memory, they are lost when the service stops
+	MemoryStore struct {
+		mu      sync.RWMutex
+		shadows map[string]*Shadow
+	}
+
+	// FileStore is a MemoryStore that writes all shadows to a JSON file after every change.
+	// As every change rewrites the whole file, it is meant for a single instance and small fleets, e.g. tests and demos.
+	FileStore struct {
+		*MemoryStore
+		Path string
+	}
+)
+
+var (
+	ErrNotFound = errors.New("shadow not found")
+)
+
+// OpenStore returns the store described by uri, either 'memory' or 'file:<path>'
+func OpenStore(uri string) (Store, error) {
+	kind, path, _ := strings.Cut(uri, ":")
+
+	switch kind {
+	case StoreMemory, "":
+		return NewMemoryStore(), nil
+	case StoreFile:
+		if path == "" {
+			return nil, fmt.Errorf("missing path in '%s'", uri)
+		}
+		return NewFileStore(path)
+	}
+	return nil, fmt.Errorf("unsupported store '%s'", uri)
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		shadows: make(map[string]*Shadow),
+	}
+}
+
+// Get returns a copy of the shadow
+func (m *MemoryStore) Get(ctx context.Context, vin string) (*Shadow, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	s, ok := m.shadows[vin]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return s.clone(), nil
+}
+
+func (m *MemoryStore) Put(ctx context.Context, s *Shadow) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.shadows[s.VIN] = s.clone()
+	return nil
+}
+
+func (m *MemoryStore) Delete(ctx context.Context, vin string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.shadows[vin]; !ok {
+		return ErrNotFound
+	}
+	delete(m.shadows, vin)
+	return nil
+}
+
+// List returns copies of all shadows, ordered by VIN
+func (m *MemoryStore) List(ctx context.Context) ([]*Shadow, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	shadows := make([]*Shadow, 0, len(m.shadows))
+	for _, s := range m.shadows {
+		shadows = append(shadows, s.clone())
+	}
+	sort.Slice(shadows, func(i, j int) bool { return shadows[i].VIN < shadows[j].VIN })
+	return shadows, nil
+}
+
+// NewFileStore loads the shadows from path, a missing file is created with the first change
+func NewFileStore(path string) (*FileStore, error) {
+	f := &FileStore{
+		MemoryStore: NewMemoryStore(),
+		Path:        path,
+	}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Put changes nothing if the file can not be written
+func (f *FileStore) Put(ctx context.Context, s *Shadow) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	prev, existed := f.shadows[s.VIN]
+	f.shadows[s.VIN] = s.clone()
+
+	if err := f.save(); err != nil {
+		if existed {
+			f.shadows[s.VIN] = prev
+		} else {
+			delete(f.shadows, s.VIN)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete changes nothing if the file can not be written
+func (f *FileStore) Delete(ctx context.Context, vin string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	prev, ok := f.shadows[vin]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(f.shadows, vin)
+
+	if err := f.save(); err != nil {
+		f.shadows[vin] = prev
+		return err
+	}
+	return nil
+}
+
+func (f *FileStore) load() error {
+	data, err := os.ReadFile(f.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var shadows []*Shadow
+	if err := json.Unmarshal(data, &shadows); err != nil {
+		return fmt.Errorf("invalid shadow store '%s': %w", f.Path, err)
+	}
+	for _, s := range shadows {
+		f.shadows[s.VIN] = s
+	}
+	return nil
+}
+
+// save replaces the file atomically, the caller holds the lock
+func (f *FileStore) save() error {
+	shadows := make([]*Shadow, 0, len(f.shadows))
+	for _, s := range f.shadows {
+		shadows = append(shadows, s)
+	}
+	sort.Slice(shadows, func(i, j int) bool { return shadows[i].VIN < shadows[j].VIN })
+
+	data, err := json.MarshalIndent(shadows, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.Path), filepath.Base(f.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+func (s *Shadow) clone() *Shadow {
+	c := *s
+	if s.Reported.Position != nil {
+		p := *s.Reported.Position
+		c.Reported.Position = &p
+	}
+	c.Reported.Software = cloneVersions(s.Reported.Software)
+	c.Desired.Software = cloneVersions(s.Desired.Software)
+	return &c
+}
+
+func cloneVersions(versions map[string]string) map[string]string {
+	if versions == nil {
+		return nil
+	}
+	c := make(map[string]string, len(versions))
+	for k, v := range versions {
+		c[k] = v
+	}
+	return c
+}
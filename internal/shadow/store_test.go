@@ -0,0 +1,98 @@
+package shadow
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenStore(t *testing.T) {
+	s, err := OpenStore("memory")
+	assert.NoError(t, err)
+	assert.IsType(t, &MemoryStore{}, s)
+
+	s, err = OpenStore("file:" + filepath.Join(t.TempDir(), "shadows.json"))
+	assert.NoError(t, err)
+	assert.IsType(t, &FileStore{}, s)
+
+	_, err = OpenStore("file:")
+	assert.Error(t, err)
+	_, err = OpenStore("redis://localhost")
+	assert.Error(t, err)
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+
+	s := New(vin)
+	s.Reported.Software = map[string]string{"ecu": "1.0"}
+	assert.NoError(t, m.Put(ctx, s))
+
+	// the store keeps its own copy
+	s.Reported.Software["ecu"] = "2.0"
+	got, err := m.Get(ctx, vin)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.0", got.Reported.Software["ecu"])
+
+	assert.NoError(t, m.Put(ctx, New("AAA")))
+	all, err := m.List(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, all, 2) {
+		assert.Equal(t, "AAA", all[0].VIN)
+	}
+
+	assert.NoError(t, m.Delete(ctx, vin))
+	assert.Equal(t, ErrNotFound, m.Delete(ctx, vin))
+}
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "shadows.json")
+
+	f, err := NewFileStore(path)
+	assert.NoError(t, err)
+
+	s := New(vin)
+	s.Desired.Campaign = "a"
+	s.Reported.Position = &Position{Lat: 39.79, Long: -86.23}
+	assert.NoError(t, f.Put(ctx, s))
+	assert.NoError(t, f.Put(ctx, New("AAA")))
+	assert.NoError(t, f.Delete(ctx, "AAA"))
+
+	// reopen
+	f, err = NewFileStore(path)
+	assert.NoError(t, err)
+
+	got, err := f.Get(ctx, vin)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", got.Desired.Campaign)
+	assert.Equal(t, 39.79, got.Reported.Position.Lat)
+
+	_, err = f.Get(ctx, "AAA")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestFileStoreWriteError(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "shadows")
+
+	f, err := NewFileStore(filepath.Join(dir, "shadows.json"))
+	assert.NoError(t, err)
+
+	// the directory doesn't exist, memory must not diverge from the file
+	assert.Error(t, f.Put(ctx, New(vin)))
+	_, err = f.Get(ctx, vin)
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.NoError(t, os.Mkdir(dir, 0755))
+	assert.NoError(t, f.Put(ctx, New(vin)))
+	assert.NoError(t, os.RemoveAll(dir))
+
+	assert.Error(t, f.Delete(ctx, vin))
+	_, err = f.Get(ctx, vin)
+	assert.NoError(t, err)
+}
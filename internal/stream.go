@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	ContentTypeJSON        = "application/json"
+	ContentTypeOctetStream = "application/octet-stream"
+	ContentTypeNDJSON      = "application/x-ndjson"
+)
+
+type (
+	// StreamRequest is a request with a raw body and/or a response that is not decoded as JSON
+	StreamRequest struct {
+		Method      string    // GET if empty
+		URI         string    // relative to the endpoint or an absolute URL, e.g. a download location
+		Body        io.Reader // sent as it is read, requests with a body are therefore never retried
+		ContentType string    // of Body, application/octet-stream by default
+		Accept      string
+		Range       string // e.g. ByteRange(1024, -1)
+		Header      http.Header
+	}
+)
+
+var (
+	ctxKeyStream = &contextKey{"Stream"}
+)
+
+// ByteRange returns the value of a Range header for the bytes from start to end (inclusive). end < 0 means until the end.
+func ByteRange(start, end int64) string {
+	if end < 0 {
+		return fmt.Sprintf("bytes=%d-", start)
+	}
+	return fmt.Sprintf("bytes=%d-%d", start, end)
+}
+
+// IsStream reports whether the request's body or response is streamed, i.e. must not be read by other layers
+func IsStream(req *http.Request) bool {
+	s, ok := req.Context().Value(ctxKeyStream).(bool)
+	return ok && s
+}
+
+// Stream sends sr and returns the response with its body unread, the caller has to close it.
+// Requests to other hosts than the endpoint are sent without credentials.
+// Status codes other than 200-204 and 206 are returned as APIError.
+func (c *RestClient) Stream(ctx context.Context, sr *StreamRequest) (int, *http.Response, error) {
+	method := sr.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	target, sameHost, err := c.resolve(sr.URI)
+	if err != nil {
+		return http.StatusBadRequest, nil, err
+	}
+
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, ctxKeyStream, true), method, target, sr.Body)
+	if err != nil {
+		return http.StatusBadRequest, nil, err
+	}
+
+	for k, v := range sr.Header {
+		req.Header[k] = v
+	}
+	if sr.Body != nil {
+		contentType := sr.ContentType
+		if contentType == "" {
+			contentType = ContentTypeOctetStream
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+	if sr.Accept != "" {
+		req.Header.Set("Accept", sr.Accept)
+	}
+	if sr.Range != "" {
+		req.Header.Set("Range", sr.Range)
+	}
+
+	return c.send(req, sameHost)
+}
+
+// Download writes the response body of a GET to uri to w, it returns the number of bytes written
+func (c *RestClient) Download(ctx context.Context, uri string, w io.Writer) (int, int64, error) {
+	status, resp, err := c.Stream(ctx, &StreamRequest{URI: uri})
+	if err != nil {
+		return status, 0, err
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return http.StatusInternalServerError, n, err
+	}
+	return status, n, nil
+}
+
+// Upload sends body with the given content type and decodes the JSON response, if one is expected
+func (c *RestClient) Upload(ctx context.Context, method, uri string, body io.Reader, contentType string, response interface{}) (int, error) {
+	status, resp, err := c.Stream(ctx, &StreamRequest{
+		Method:      method,
+		URI:         uri,
+		Body:        body,
+		ContentType: contentType,
+	})
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+
+	if response != nil {
+		if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	return status, nil
+}
+
+// StreamJSON GETs newline delimited JSON from uri and calls fn for every line until the stream ends, ctx is done or fn fails
+func (c *RestClient) StreamJSON(ctx context.Context, uri string, fn func(json.RawMessage) error) (int, error) {
+	status, resp, err := c.Stream(ctx, &StreamRequest{URI: uri, Accept: ContentTypeNDJSON})
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if !json.Valid(line) {
+			return http.StatusInternalServerError, fmt.Errorf("invalid JSON in stream: '%s'", line)
+		}
+		if err := fn(json.RawMessage(line)); err != nil {
+			return status, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return status, ctxErr
+		}
+		return http.StatusInternalServerError, err
+	}
+	return status, nil
+}
+
+// resolve returns the URL for uri and whether it points to the endpoint's host
+func (c *RestClient) resolve(uri string) (string, bool, error) {
+	if !strings.HasPrefix(uri, "http://") && !strings.HasPrefix(uri, "https://") {
+		return c.Settings.Endpoint + uri, true, nil
+	}
+
+	target, err := url.Parse(uri)
+	if err != nil {
+		return "", false, err
+	}
+	endpoint, err := url.Parse(c.Settings.Endpoint)
+	if err != nil {
+		return uri, false, nil
+	}
+	return uri, strings.EqualFold(target.Host, endpoint.Host), nil
+}
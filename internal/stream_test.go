@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
+)
+
+func TestStream(t *testing.T) {
+	pkg := bytes.Repeat([]byte("0123456789"), 100)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/upload":
+			body, _ := io.ReadAll(r.Body)
+			assert.Equal(t, "application/zip", r.Header.Get("Content-Type"))
+			fmt.Fprintf(w, `{"size":%d}`, len(body))
+		case "/package":
+			http.ServeContent(w, r, "package.bin", time.Time{}, bytes.NewReader(pkg))
+		case "/events":
+			w.Header().Set("Content-Type", ContentTypeNDJSON)
+			w.Write([]byte("{\"n\":1}\n\n{\"n\":2}\n{\"n\":3}\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	cl, err := NewRestClient(context.TODO(), WithEndpoint(srv.URL), WithCredentials("foo", "bar"))
+	assert.NoError(t, err)
+
+	// raw upload with a custom content type
+	var resp map[string]int
+	status, err := cl.Upload(context.TODO(), "POST", "/upload", strings.NewReader("PK"), "application/zip", &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 2, resp["size"])
+
+	// full and partial downloads
+	var buf bytes.Buffer
+	status, n, err := cl.Download(context.TODO(), "/package", &buf)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, int64(len(pkg)), n)
+	assert.Equal(t, pkg, buf.Bytes())
+
+	status, r, err := cl.Stream(context.TODO(), &StreamRequest{URI: "/package", Range: ByteRange(990, -1)})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, status)
+	data, _ := io.ReadAll(r.Body)
+	r.Body.Close()
+	assert.Equal(t, "0123456789", string(data))
+
+	// NDJSON
+	var events []int
+	status, err = cl.StreamJSON(context.TODO(), "/events", func(msg json.RawMessage) error {
+		var e map[string]int
+		assert.NoError(t, json.Unmarshal(msg, &e))
+		events = append(events, e["n"])
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []int{1, 2, 3}, events)
+
+	// errors are still typed
+	status, _, err = cl.Stream(context.TODO(), &StreamRequest{URI: "/missing"})
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.True(t, IsNotFound(err))
+}
+
+func TestStreamOtherHost(t *testing.T) {
+	var auth string
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.Write([]byte("package"))
+	}))
+	defer cdn.Close()
+
+	cl, err := NewRestClient(context.TODO(), WithEndpoint("http://api.example.com"), WithCredentials("foo", "bar"))
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	_, _, err = cl.Download(context.TODO(), cdn.URL+"/package.bin", &buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "package", buf.String())
+	assert.Empty(t, auth)
+}
+
+func TestStreamBodyNotRetried(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	cl, err := NewRestClient(context.TODO(), WithEndpoint(srv.URL), WithCredentials("foo", "bar"), WithRetryPolicy(settings.RetryPolicy{
+		MaxAttempts:   3,
+		RetryStatuses: []int{http.StatusServiceUnavailable},
+	}))
+	assert.NoError(t, err)
+
+	// PUT is idempotent, but the streamed body is sent once
+	status, err := cl.Upload(context.TODO(), http.MethodPut, "/upload", strings.NewReader("PK"), "application/zip", nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, 1, calls)
+
+	// downloads are retried
+	calls = 0
+	cl.Download(context.TODO(), "/package", io.Discard)
+	assert.Equal(t, 3, calls)
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/txsvc/stdlib/v2"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
+)
+
+const (
+	// TLS settings of the REST clients, the MQTT client uses the same names prefixed with MQTT_
+	TLSCAFile             = "TLS_CA_FILE"   // PEM bundle, added to the system roots
+	TLSCertFile           = "TLS_CERT_FILE" // client certificate for mTLS
+	TLSKeyFile            = "TLS_KEY_FILE"
+	TLSServerName         = "TLS_SERVER_NAME"
+	TLSMinVersion         = "TLS_MIN_VERSION"          // 1.0, 1.1, 1.2 (default) or 1.3
+	TLSInsecureSkipVerify = "TLS_INSECURE_SKIP_VERIFY" // only for testing!
+
+	MqttPrefix = "MQTT_"
+)
+
+// TLSSettingsFromEnv reads the TLS settings from the environment, e.g. TLS_CA_FILE or MQTT_TLS_CA_FILE with prefix "MQTT_".
+// It returns nil if none are set.
+func TLSSettingsFromEnv(prefix string) *settings.TLSSettings {
+	cfg := &settings.TLSSettings{
+		CAFile:             stdlib.GetString(prefix+TLSCAFile, ""),
+		CertFile:           stdlib.GetString(prefix+TLSCertFile, ""),
+		KeyFile:            stdlib.GetString(prefix+TLSKeyFile, ""),
+		ServerName:         stdlib.GetString(prefix+TLSServerName, ""),
+		MinVersion:         stdlib.GetString(prefix+TLSMinVersion, ""),
+		InsecureSkipVerify: GetBool(prefix+TLSInsecureSkipVerify, false),
+	}
+	if *cfg == (settings.TLSSettings{}) {
+		return nil
+	}
+	return cfg
+}
+
+// NewTLSConfig creates a client TLS configuration. A nil cfg verifies the server against the system roots.
+func NewTLSConfig(cfg *settings.TLSSettings) (*tls.Config, error) {
+	tc := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if cfg == nil {
+		return tc, nil
+	}
+
+	if cfg.MinVersion != "" {
+		v, err := parseTLSVersion(cfg.MinVersion)
+		if err != nil {
+			return nil, err
+		}
+		tc.MinVersion = v
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in '%s'", cfg.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, fmt.Errorf("mTLS requires both a certificate and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	tc.ServerName = cfg.ServerName
+
+	if cfg.InsecureSkipVerify {
+		log.Warn().Msg("TLS certificate verification is disabled")
+		tc.InsecureSkipVerify = true
+	}
+
+	return tc, nil
+}
+
+// NewTLSTransport returns a copy of http.DefaultTransport that uses the TLS configuration cfg
+func NewTLSTransport(cfg *settings.TLSSettings) (http.RoundTripper, error) {
+	tc, err := NewTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tc
+
+	return transport, nil
+}
+
+func parseTLSVersion(v string) (uint16, error) {
+	switch v {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version '%s'", v)
+}
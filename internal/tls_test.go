@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/settings"
+)
+
+func TestTLSConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+	assert.NoError(t, err)
+
+	// the test certificate is not trusted by default
+	cl, err := NewRestClient(context.TODO(), WithEndpoint(srv.URL), WithCredentials("foo", "bar"), WithRetryPolicy(settings.RetryPolicy{MaxAttempts: 1}))
+	assert.NoError(t, err)
+	_, err = cl.GET("/", nil)
+	assert.Error(t, err)
+
+	// trust the private CA
+	cl, err = NewRestClient(context.TODO(), WithEndpoint(srv.URL), WithCredentials("foo", "bar"), WithTLS(settings.TLSSettings{CAFile: caFile, MinVersion: "1.2"}))
+	assert.NoError(t, err)
+	status, err := cl.GET("/", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, status)
+
+	// explicit opt-in only
+	cl, err = NewRestClient(context.TODO(), WithEndpoint(srv.URL), WithCredentials("foo", "bar"), WithTLS(settings.TLSSettings{InsecureSkipVerify: true}))
+	assert.NoError(t, err)
+	_, err = cl.GET("/", nil)
+	assert.NoError(t, err)
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	tc, err := NewTLSConfig(nil)
+	assert.NoError(t, err)
+	assert.False(t, tc.InsecureSkipVerify)
+
+	_, err = NewTLSConfig(&settings.TLSSettings{MinVersion: "2.0"})
+	assert.Error(t, err)
+
+	_, err = NewTLSConfig(&settings.TLSSettings{CertFile: "client.pem"})
+	assert.Error(t, err)
+
+	_, err = NewRestClient(context.TODO(), WithEndpoint("https://localhost"), WithCredentials("foo", "bar"), WithTLS(settings.TLSSettings{CAFile: "missing.pem"}))
+	assert.Error(t, err)
+}
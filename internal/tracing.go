@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/txsvc/stdlib/v2"
+)
+
+const (
+	// the standard OpenTelemetry ENV variables
+	OTEL_SERVICE_NAME    = "OTEL_SERVICE_NAME"
+	OTEL_TRACES_EXPORTER = "OTEL_TRACES_EXPORTER" // none (default), stdout
+
+	tracerName = "github.com/redhat-partner-ecosystem/shadowcar"
+)
+
+type (
+	// TracingTransport creates a client span for each request and propagates
+	// its context to the server with the W3C traceparent/tracestate headers.
+	TracingTransport struct {
+		InnerTransport http.RoundTripper
+	}
+
+	// MapCarrier adapts e.g. Kafka or MQTT message headers to a propagation.TextMapCarrier
+	MapCarrier map[string]string
+)
+
+var (
+	// Propagator is used for all context propagation, independent of the global settings
+	Propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+)
+
+// StartTracing installs the global tracer provider with the exporter selected by OTEL_TRACES_EXPORTER.
+// The returned function flushes and stops the exporter.
+func StartTracing(service string) (func(context.Context) error, error) {
+	exporter := strings.ToLower(stdlib.GetString(OTEL_TRACES_EXPORTER, "none"))
+
+	switch exporter {
+	case "none", "":
+		otel.SetTextMapPropagator(Propagator)
+		return func(context.Context) error { return nil }, nil
+	case "stdout", "console":
+		exp, err := stdouttrace.New()
+		if err != nil {
+			return nil, err
+		}
+		return StartTracingWithExporter(service, exp), nil
+	}
+
+	return nil, fmt.Errorf("unsupported %s '%s'", OTEL_TRACES_EXPORTER, exporter)
+}
+
+// StartTracingWithExporter installs the global tracer provider using exporter, e.g. a tracetest.InMemoryExporter.
+func StartTracingWithExporter(service string, exporter sdktrace.SpanExporter) func(context.Context) error {
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceNameKey.String(stdlib.GetString(OTEL_SERVICE_NAME, service)),
+		)),
+	)
+
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(Propagator)
+
+	return tp.Shutdown
+}
+
+// Tracer returns the tracer used by all shadowcar packages
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *TracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	_, _, route := metricLabels(req)
+
+	ctx, span := Tracer().Start(req.Context(), fmt.Sprintf("HTTP %s %s", req.Method, route),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(req.Method),
+			semconv.HTTPURLKey.String(req.URL.String()),
+			semconv.HTTPRouteKey.String(route),
+			semconv.NetPeerNameKey.String(req.URL.Host),
+		),
+	)
+	defer span.End()
+
+	// RoundTrip must not modify the request, inject into a copy
+	req = req.Clone(ctx)
+	Propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.InnerTransport.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return resp, err
+	}
+
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+	if resp.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	}
+
+	return resp, err
+}
+
+// Get implements propagation.TextMapCarrier
+func (c MapCarrier) Get(key string) string {
+	return c[key]
+}
+
+// Set implements propagation.TextMapCarrier
+func (c MapCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+// Keys implements propagation.TextMapCarrier
+func (c MapCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// PublishWithContext publishes payload to topic within a producer span. MQTT 3.1.1 has no message headers,
+// so the trace context is added as 'traceparent' and 'tracestate' attributes to JSON object payloads,
+// similar to the CloudEvents distributed tracing extension. Other payloads are sent unchanged.
+func PublishWithContext(ctx context.Context, client mqtt.Client, topic string, qos byte, retained bool, payload []byte) mqtt.Token {
+	ctx, span := Tracer().Start(ctx, fmt.Sprintf("%s publish", topic),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("mqtt"),
+			semconv.MessagingDestinationNameKey.String(topic),
+		),
+	)
+	defer span.End()
+
+	payload = injectPayload(ctx, payload)
+
+	return client.Publish(topic, qos, retained, payload)
+}
+
+// ExtractPayload returns a context with the remote span context found in a JSON payload, see PublishWithContext
+func ExtractPayload(ctx context.Context, payload []byte) context.Context {
+	var attrs map[string]interface{}
+	if err := json.Unmarshal(payload, &attrs); err != nil {
+		return ctx
+	}
+
+	carrier := MapCarrier{}
+	for _, k := range Propagator.Fields() {
+		if v, ok := attrs[k].(string); ok {
+			carrier[k] = v
+		}
+	}
+	return Propagator.Extract(ctx, carrier)
+}
+
+func injectPayload(ctx context.Context, payload []byte) []byte {
+	carrier := MapCarrier{}
+	Propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 || !bytes.HasPrefix(bytes.TrimSpace(payload), []byte("{")) {
+		return payload
+	}
+
+	var attrs map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &attrs); err != nil {
+		return payload
+	}
+	for k, v := range carrier {
+		attrs[k], _ = json.Marshal(v)
+	}
+
+	p, err := json.Marshal(attrs)
+	if err != nil {
+		return payload
+	}
+	return p
+}
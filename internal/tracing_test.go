@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newTestTracer(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prev)
+		tp.Shutdown(context.TODO())
+	})
+
+	return exporter
+}
+
+func TestTracingTransport(t *testing.T) {
+	exporter := newTestTracer(t)
+
+	var traceparent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	cl, err := NewRestClient(context.TODO(), WithEndpoint(srv.URL), WithCredentials("foo", "bar"))
+	assert.NoError(t, err)
+
+	ctx, parent := Tracer().Start(context.TODO(), "test")
+	_, err = cl.GETWithContext(WithRoute(ctx, "/trace/%s"), "/trace/42", nil)
+	parent.End()
+	assert.NoError(t, err)
+
+	spans := exporter.GetSpans()
+	if assert.Len(t, spans, 2) {
+		client := spans[0]
+		assert.Equal(t, "HTTP GET /trace/*", client.Name)
+		assert.Equal(t, trace.SpanKindClient, client.SpanKind)
+		assert.Equal(t, parent.SpanContext().TraceID(), client.SpanContext.TraceID())
+		assert.Equal(t, parent.SpanContext().SpanID(), client.Parent.SpanID())
+
+		// the server sees the client span as its parent
+		assert.Contains(t, traceparent, client.SpanContext.SpanID().String())
+	}
+}
+
+func TestPayloadPropagation(t *testing.T) {
+	newTestTracer(t)
+
+	ctx, span := Tracer().Start(context.TODO(), "test")
+	defer span.End()
+
+	payload := injectPayload(ctx, []byte(`{"vin":"WVW123"}`))
+	assert.Contains(t, string(payload), `"vin":"WVW123"`)
+	assert.Contains(t, string(payload), `"traceparent"`)
+
+	remote := trace.SpanContextFromContext(ExtractPayload(context.TODO(), payload))
+	assert.True(t, remote.IsRemote())
+	assert.Equal(t, span.SpanContext().TraceID(), remote.TraceID())
+
+	// non-JSON payloads are sent unchanged
+	assert.Equal(t, []byte("42"), injectPayload(ctx, []byte("42")))
+	assert.False(t, trace.SpanContextFromContext(ExtractPayload(context.TODO(), []byte("42"))).IsValid())
+}
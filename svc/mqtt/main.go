@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/tls"
 	"fmt"
 	stdlog "log"
 	"os"
@@ -14,18 +13,19 @@ import (
 	"github.com/rs/zerolog/log"
 
 	"github.com/txsvc/stdlib/v2"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/internal"
 )
 
 const (
-	// expected ENV variables
-	CLIENT_ID            = "client_id"
-	SOURCE_TOPIC         = "source_topic"
-	MQTT_HOST            = "mqtt_host"
-	MQTT_PROTOCOL        = "mqtt_protocol"
-	MQTT_PORT            = "mqtt_port"
-	MQTT_TLS_SKIP_VERIFY = "mqtt_tls_skip_verify"
-	MQTT_USER            = "default-mqtt-user"
-	MQTT_PASSWORD        = "default-mqtt-password"
+	// expected ENV variables, MQTT_TLS_* are read by internal.CreateMqttClient
+	CLIENT_ID     = "client_id"
+	SOURCE_TOPIC  = "source_topic"
+	MQTT_HOST     = "mqtt_host"
+	MQTT_PROTOCOL = "mqtt_protocol"
+	MQTT_PORT     = "mqtt_port"
+	MQTT_USER     = "default-mqtt-user"
+	MQTT_PASSWORD = "default-mqtt-password"
 
 	// controll the behaviour of the listener
 	traceMQTT = false // debug MQTT client
@@ -87,7 +87,10 @@ func init() {
 func main() {
 
 	// listen for messages on the integration endpoint
-	cl := createMqttClient(mqttIntegrationProtocol, mqttIntegrationHost, mqttIntegrationPort, clientID, stdlib.GetString(MQTT_USER, ""), stdlib.GetString(MQTT_PASSWORD, ""))
+	cl, err := internal.CreateMqttClient(mqttIntegrationProtocol, mqttIntegrationHost, mqttIntegrationPort, clientID, stdlib.GetString(MQTT_USER, ""), stdlib.GetString(MQTT_PASSWORD, ""))
+	if err != nil {
+		log.Fatal().Err(err).Msg(err.Error())
+	}
 	if token := cl.Connect(); token.Wait() && token.Error() != nil {
 		log.Fatal().Err(token.Error()).Msg(token.Error().Error())
 	}
@@ -103,36 +106,3 @@ func main() {
 func receiveMqttMsg(client mqtt.Client, msg mqtt.Message) {
 	log.Logger.Info().Str("topic", msg.Topic()).Str("body", string(msg.Payload())).Msg(fmt.Sprintf("message id %d", msg.MessageID()))
 }
-
-func createMqttClient(protocol, host, port, clientID, username, password string) mqtt.Client {
-	// setup and configuration
-	broker := fmt.Sprintf("%s://%s:%s", protocol, host, port)
-	opts := mqtt.NewClientOptions().AddBroker(broker)
-
-	opts.SetCleanSession(true)
-	opts.SetClientID(clientID)
-	opts.SetConnectTimeout(10 * time.Second)
-	opts.SetKeepAlive(30 * time.Second)
-	opts.SetPingTimeout(5 * time.Second)
-
-	opts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
-		log.Logger.Info().Str("topic", msg.Topic()).Str("body", string(msg.Payload())).Msg(fmt.Sprintf("un-handled message id %d", msg.MessageID()))
-	})
-	opts.SetOnConnectHandler(func(c mqtt.Client) {
-		log.Logger.Info().Bool("connected", c.IsConnected()).Bool("open", c.IsConnectionOpen()).Msg("onConnect")
-	})
-
-	if username != "" {
-
-		opts.SetUsername(username)
-	}
-	if password != "" {
-		opts.SetPassword(password)
-	}
-	opts.SetTLSConfig(&tls.Config{
-		InsecureSkipVerify: true,
-	})
-
-	// create a client
-	return mqtt.NewClient(opts)
-}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/txsvc/apikit/api"
+
+	"github.com/txsvc/stdlib/v2"
+	"github.com/txsvc/stdlib/v2/stdlibx/stringsx"
+
+	"github.com/redhat-partner-ecosystem/shadowcar/api/drogue"
+	"github.com/redhat-partner-ecosystem/shadowcar/internal"
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/shadow"
+)
+
+const (
+	// expected ENV variables, MQTT_TLS_* are read by internal.CreateMqttClient
+	CLIENT_ID      = "client_id"
+	APPLICATION_ID = "application_id"
+	SHADOW_STORE   = "shadow_store" // memory or file:<path>
+	DELTA_TOPIC    = "delta_topic"
+	MQTT_HOST      = "mqtt_host"
+	MQTT_PROTOCOL  = "mqtt_protocol"
+	MQTT_PORT      = "mqtt_port"
+	MQTT_USER      = "default-mqtt-user"
+	MQTT_PASSWORD  = "default-mqtt-password"
+
+	// vehicles publish a shadow.ReportedState on this channel, e.g. their installed software
+	ReportedChannel = "shadow"
+
+	ShutdownTimeout = time.Second * 15
+
+	PORT_ENV     = "PORT"
+	PORT_DEFAULT = "8080"
+)
+
+type (
+	// Telemetry is the position published by a vehicle, see internal.ZoneChangeEvent
+	Telemetry struct {
+		VIN       string  `json:"carid"`
+		EventTime int64   `json:"eventTime"`
+		Elev      string  `json:"elev"`
+		Lat       float64 `json:"lat"`
+		Long      float64 `json:"long"`
+	}
+)
+
+var (
+	svc         *shadow.Service
+	application string // the Drogue application of the vehicles
+)
+
+func init() {
+
+	// setup logging
+	internal.SetLogLevel()
+
+	application = stdlib.GetString(APPLICATION_ID, drogue.DefaultApplication)
+
+	store, err := shadow.OpenStore(stdlib.GetString(SHADOW_STORE, shadow.StoreMemory))
+	if err != nil {
+		log.Fatal().Err(err).Msg(err.Error())
+	}
+	svc = shadow.NewService(store, nil)
+}
+
+func main() {
+	// cancelled on SIGINT/SIGTERM, stops all background work and in-flight calls
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// expose the metrics of all outbound calls
+	internal.StartPrometheusListener()
+
+	// publish deltas to the vehicles, they are only available via the API without MQTT
+	if cl := connectMqtt(); cl != nil {
+		defer cl.Disconnect(250)
+		svc.Notifier = &shadow.MQTTNotifier{Client: cl, Topic: stdlib.GetString(DELTA_TOPIC, shadow.DefaultDeltaTopic)}
+	}
+
+	// update the reported state from the vehicles' telemetry
+	go listenTelemetry(ctx)
+
+	// start the http listener
+	startHttpListener(ctx)
+}
+
+func connectMqtt() mqtt.Client {
+	host := stdlib.GetString(MQTT_HOST, "")
+	if host == "" {
+		log.Warn().Msg("delta notifications disabled, missing env MQTT_HOST")
+		return nil
+	}
+
+	cl, err := internal.CreateMqttClient(stdlib.GetString(MQTT_PROTOCOL, "tcp"), host, stdlib.GetString(MQTT_PORT, "1883"), stdlib.GetString(CLIENT_ID, "shadow-svc"), stdlib.GetString(MQTT_USER, ""), stdlib.GetString(MQTT_PASSWORD, ""))
+	if err != nil {
+		log.Fatal().Err(err).Msg(err.Error())
+	}
+	if token := cl.Connect(); token.Wait() && token.Error() != nil {
+		log.Fatal().Err(token.Error()).Msg(token.Error().Error())
+	}
+	return cl
+}
+
+func listenTelemetry(ctx context.Context) {
+	es, err := drogue.NewEventStream(ctx, application)
+	if err != nil {
+		log.Warn().Err(err).Msg("telemetry disabled")
+		return
+	}
+
+	log.Info().Str("url", es.URL()).Msg("start listening")
+
+	for evt := range es.Subscribe(ctx) {
+		if te, ok := evt.(*drogue.TelemetryEvent); ok {
+			handleTelemetry(ctx, te)
+		}
+	}
+}
+
+func handleTelemetry(ctx context.Context, te *drogue.TelemetryEvent) {
+	if te.Channel == ReportedChannel {
+		handleReported(ctx, te)
+		return
+	}
+
+	var t Telemetry
+	if err := te.Decode(&t); err != nil {
+		log.Debug().Err(err).Str("device", te.Device).Msg("ignoring telemetry")
+		return
+	}
+
+	vin := stringsx.TakeOne(t.VIN, te.Device)
+	seen := te.Time
+	if t.EventTime > 0 {
+		seen = time.Unix(t.EventTime, 0).UTC()
+	}
+	elev, _ := strconv.ParseFloat(t.Elev, 64)
+
+	reported := &shadow.ReportedState{
+		Position: &shadow.Position{Lat: t.Lat, Long: t.Long, Elevation: elev},
+		LastSeen: seen,
+	}
+	if _, err := svc.Report(ctx, vin, reported); err != nil {
+		log.Error().Err(err).Str("vin", vin).Msg("reporting telemetry failed")
+	}
+}
+
+func handleReported(ctx context.Context, te *drogue.TelemetryEvent) {
+	var reported shadow.ReportedState
+	if err := te.Decode(&reported); err != nil {
+		log.Debug().Err(err).Str("device", te.Device).Msg("ignoring reported state")
+		return
+	}
+	if reported.LastSeen.IsZero() {
+		reported.LastSeen = te.Time
+	}
+
+	if _, err := svc.Report(ctx, te.Device, &reported); err != nil {
+		log.Error().Err(err).Str("vin", te.Device).Msg("reporting state failed")
+	}
+}
+
+func startHttpListener(ctx context.Context) {
+	// create a new router instance
+	e := echo.New()
+	e.HideBanner = true
+
+	// add and configure any middlewares
+	e.Use(middleware.Recover())
+	e.Use(middleware.CORSWithConfig(middleware.DefaultCORSConfig))
+
+	// add your own endpoints here
+	e.GET("/", api.DefaultEndpoint)
+	shadow.NewAPI(e, svc)
+
+	// shutdown the listener once ctx is cancelled
+	go func() {
+		<-ctx.Done()
+		log.Warn().Msg("shutting down")
+
+		sctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		e.Shutdown(sctx)
+	}()
+
+	port := fmt.Sprintf(":%s", stringsx.TakeOne(stdlib.GetString(PORT_ENV, ""), PORT_DEFAULT))
+	if err := e.Start(port); err != http.ErrServerClosed {
+		log.Fatal().Err(err).Msg(err.Error())
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
@@ -16,6 +18,9 @@ import (
 
 	"github.com/rs/zerolog/log"
 
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/txsvc/apikit/api"
 
 	"github.com/txsvc/stdlib/v2"
@@ -24,6 +29,7 @@ import (
 	"github.com/redhat-partner-ecosystem/shadowcar/api/drogue"
 	"github.com/redhat-partner-ecosystem/shadowcar/api/ota"
 	"github.com/redhat-partner-ecosystem/shadowcar/internal"
+	"github.com/redhat-partner-ecosystem/shadowcar/internal/shadow"
 )
 
 const (
@@ -37,7 +43,15 @@ const (
 	KAFKA_AUTO_OFFSET  = "auto_offset"
 	KAFKA_SOURCE_TOPIC = "source_topic"
 
-	DefaultTTL = time.Minute * 1
+	DefaultTTL     = time.Minute * 1
+	RequestTimeout = time.Second * 15 // upper bound for any call to Drogue or the campaign manager
+
+	// protect Drogue when it is degraded
+	DrogueFailureThreshold = 5
+	DrogueOpenTimeout      = time.Second * 30
+	DrogueRequestsPerSec   = 10
+	DrogueBurst            = 20
+	DrogueCacheSize        = 1024 // devices cached for DefaultTTL, unless Drogue says otherwise
 
 	PORT_ENV     = "PORT"
 	PORT_DEFAULT = "8080"
@@ -49,8 +63,11 @@ var (
 	campaignZoneMapping map[string]string
 
 	//kc *kafka.Consumer
-	cm *ota.CampaignManagerClient
-	dm *drogue.DrogueClient
+	cm          *ota.CampaignManagerClient
+	dm          *drogue.DrogueClient
+	cc          *drogue.CommandClient // nil if DROGUE_HTTP_INTEGRATION_ENDPOINT is not configured
+	sc          *shadow.Client        // nil if SHADOW_HTTP_ENDPOINT is not configured
+	application string                // the Drogue application of the vehicles
 )
 
 func init() {
@@ -58,6 +75,8 @@ func init() {
 	// setup logging
 	internal.SetLogLevel()
 
+	application = stdlib.GetString(APPLICATION_ID, drogue.DefaultApplication)
+
 	// campaign manager client
 	_cm, err := ota.NewCampaignManagerClient(context.TODO())
 	if err != nil {
@@ -66,11 +85,30 @@ func init() {
 	cm = _cm
 
 	// drogue client
-	dm, err = drogue.NewDrogueClient(context.TODO())
+	dm, err = drogue.NewDrogueClient(context.TODO(),
+		internal.WithCircuitBreaker(DrogueFailureThreshold, DrogueOpenTimeout),
+		internal.WithRateLimit(DrogueRequestsPerSec, DrogueBurst),
+		internal.WithCache(DrogueCacheSize, DefaultTTL),
+	)
 	if err != nil {
 		log.Fatal().Err(err).Msg(err.Error())
 	}
 
+	// shadow client, the zone and campaign are only kept in Drogue without it
+	sc, err = shadow.NewClient(context.TODO())
+	if err != nil {
+		log.Warn().Err(err).Msg("vehicle shadows disabled")
+	}
+
+	// command client, vehicles are not notified without it
+	cc, err = drogue.NewCommandClient(context.TODO(),
+		internal.WithCircuitBreaker(DrogueFailureThreshold, DrogueOpenTimeout),
+		internal.WithRateLimit(DrogueRequestsPerSec, DrogueBurst),
+	)
+	if err != nil {
+		log.Warn().Err(err).Msg("vehicle commands disabled")
+	}
+
 	// HACK
 	knownCampaigns = make([]string, 4)
 	knownCampaigns[0] = "aaaaaaaa-0000-0000-0000-000000000000" // Summit Adaptive Autosar Update A
@@ -94,18 +132,32 @@ func init() {
 }
 
 func main() {
+	// cancelled on SIGINT/SIGTERM, stops all background work and in-flight calls
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// expose the metrics of all outbound calls
+	internal.StartPrometheusListener()
+
+	// trace events from Kafka to Drogue and the campaign manager
+	shutdownTracing, err := internal.StartTracing("zonechange-adapter")
+	if err != nil {
+		log.Fatal().Err(err).Msg(err.Error())
+	}
+	defer shutdownTracing(context.Background())
+
 	// sync Drogue and Campaign Manager
-	go refreshVehicleCampaignStatus()
+	go refreshVehicleCampaignStatus(ctx)
 
 	// start the kafka event listener
-	go listenZoneChangeEvents()
+	go listenZoneChangeEvents(ctx)
 
 	// start the http listener
-	startHttpListener()
+	startHttpListener(ctx)
 
 }
 
-func listenZoneChangeEvents() {
+func listenZoneChangeEvents(ctx context.Context) {
 
 	// setup Kafka client
 	clientID := stdlib.GetString(CLIENT_ID, "kafka-listener-svc")
@@ -142,8 +194,10 @@ func listenZoneChangeEvents() {
 
 	log.Info().Str("source", sourceTopic).Str("clientid", clientID).Msg("start listening")
 
-	for {
-		msg, err := kc.ReadMessage(-1)
+	defer kc.Close()
+
+	for ctx.Err() == nil {
+		msg, err := kc.ReadMessage(time.Second)
 
 		if err == nil {
 			var evt internal.ZoneChangeEvent
@@ -152,19 +206,42 @@ func listenZoneChangeEvents() {
 				log.Err(err).Msg("")
 			}
 
+			// continue the trace of the producer, if any
+			mctx := internal.Propagator.Extract(ctx, kafkaHeaders(msg))
+			mctx, span := internal.Tracer().Start(mctx, "handleZoneChange",
+				trace.WithSpanKind(trace.SpanKindConsumer),
+				trace.WithAttributes(
+					semconv.MessagingSystemKey.String("kafka"),
+					semconv.MessagingSourceNameKey.String(*msg.TopicPartition.Topic),
+					semconv.MessagingKafkaMessageKeyKey.String(string(msg.Key)),
+				),
+			)
+
 			// handle the event
-			handleZoneChange(&evt)
+			handleZoneChange(mctx, &evt)
+			span.End()
 
-		} else {
+		} else if kerr, ok := err.(kafka.Error); !ok || kerr.Code() != kafka.ErrTimedOut {
 			// The client will automatically try to recover from all errors.
 			log.Error().Err(err).Msg("error")
 		}
 	}
+
+	log.Info().Str("source", sourceTopic).Str("clientid", clientID).Msg("stop listening")
 }
 
-func handleZoneChange(evt *internal.ZoneChangeEvent) {
+// kafkaHeaders exposes the message headers to the trace context propagator
+func kafkaHeaders(msg *kafka.Message) internal.MapCarrier {
+	carrier := internal.MapCarrier{}
+	for _, h := range msg.Headers {
+		carrier[h.Key] = string(h.Value)
+	}
+	return carrier
+}
 
-	device := lookupVehicle(evt.CarID)
+func handleZoneChange(ctx context.Context, evt *internal.ZoneChangeEvent) {
+
+	device := lookupVehicle(ctx, evt.CarID)
 
 	if device == nil {
 		log.Warn().Str("vin", evt.CarID).Str("zone", evt.NextZoneID).Msg("device not found")
@@ -180,25 +257,47 @@ func handleZoneChange(evt *internal.ZoneChangeEvent) {
 			lastCampaignExecution, _ := strconv.ParseInt(last, 0, 64)
 			age = stdlib.Now() - lastCampaignExecution
 		}
+		currentCampaign, _ := device.GetAnnotation("campaign")
+
+		// prefer the shadow, the annotations remain the fallback
+		if s := reportZone(ctx, evt.CarID, evt.NextZoneID); s != nil && !s.Desired.UpdatedAt.IsZero() {
+			age = stdlib.Now() - s.Desired.UpdatedAt.Unix()
+			currentCampaign = stringsx.TakeOne(s.Desired.Campaign, stringsx.TakeOne(s.Reported.Campaign, currentCampaign))
+		}
 
 		if age > stdlib.GetInt("zone_change_delay", 60) {
 
-			currentCampaign, _ := device.GetAnnotation("campaign")
 			campaign := nextCampaignMapping[currentCampaign]
 			zone := campaignZoneMapping[campaign]
 
 			log.Info().Str("vin", evt.CarID).Str("zone", zone).Str("campaign", campaign).Int64("age", age).Msg("executing campaign")
 
-			err := cm.ExecuteCampaign(campaign)
+			cctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+			err := cm.ExecuteCampaignWithContext(cctx, campaign)
+			cancel()
 
 			if err != nil {
 				log.Error().Str("vin", evt.CarID).Str("zone", zone).Str("campaign", campaign).Err(err).Msg("executing campaign failed")
 			} else {
-				device.SetAnnotation("lastCampaignExecution", fmt.Sprintf("%d", stdlib.Now()))
-				device.SetAnnotation("campaign", campaign)
-				device.SetLabel("zone", zone)
+				// only touch our own keys, the campaign status refresh might update the device at the same time
+				uctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+				_, err := dm.PatchDeviceWithContext(uctx, application, device.Metadata.Name, drogue.MergePatchType, drogue.NewMetadataPatch(
+					map[string]string{"zone": zone},
+					map[string]string{
+						"lastCampaignExecution": fmt.Sprintf("%d", stdlib.Now()),
+						"campaign":              campaign,
+					},
+				))
+				cancel()
+
+				if err != nil {
+					log.Error().Str("vin", evt.CarID).Str("zone", zone).Str("campaign", campaign).Err(err).Msg("device not updated")
+				}
+
+				// the desired campaign also marks the time of the execution
+				setDesiredCampaign(ctx, evt.CarID, campaign)
 
-				dm.UpdateDevice(stdlib.GetString(APPLICATION_ID, "bobbycar"), device, false)
+				startUpdate(ctx, device.Metadata.Name, campaign, zone)
 			}
 
 		} else {
@@ -207,50 +306,142 @@ func handleZoneChange(evt *internal.ZoneChangeEvent) {
 	}
 }
 
-func lookupVehicle(vin string) *drogue.Device {
-	status, device := dm.GetDevice(stdlib.GetString(APPLICATION_ID, "bobbycar"), vin)
-	if status != http.StatusOK {
+// startUpdate tells the vehicle to install the campaign's update package
+func startUpdate(ctx context.Context, vin, campaign, zone string) {
+	if cc == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+	defer cancel()
+
+	status, _, err := cc.StartUpdateWithContext(ctx, application, vin, &drogue.StartUpdatePayload{
+		Campaign: campaign,
+		Zone:     zone,
+	})
+	if err != nil {
+		log.Error().Str("vin", vin).Str("campaign", campaign).Int("http", status).Err(err).Msg("start update not sent")
+	}
+}
+
+func lookupVehicle(ctx context.Context, vin string) *drogue.Device {
+	ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+	defer cancel()
+
+	_, device, err := dm.GetDeviceWithContext(ctx, application, vin)
+	if err != nil {
+		if !internal.IsNotFound(err) {
+			log.Error().Str("vin", vin).Err(err).Msg("device lookup failed")
+		}
 		return nil
 	}
 	return &device
 }
 
-func refreshVehicleCampaignStatus() {
+func refreshVehicleCampaignStatus(ctx context.Context) {
 	for {
-		updateCampaignStatus(knownCampaigns)
-		time.Sleep(60 * time.Second) // refesh every x sec
+		updateCampaignStatus(ctx, knownCampaigns)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(60 * time.Second): // refesh every x sec
+		}
 	}
 }
 
-func updateCampaignStatus(campaigns []string) {
+func updateCampaignStatus(ctx context.Context, campaigns []string) {
 	for _, campaignId := range campaigns {
-		status, exec := cm.GetCampaignExecution(campaignId)
-		if status == http.StatusOK {
-			if len(exec) > 0 {
-				for _, e := range exec {
-					device := lookupVehicle(e.VIN)
-					if device != nil {
-						device.SetAnnotation("campaign", e.CampaignID)
-						device.SetAnnotation("campaignStatus", e.Status)
-						device.SetLabel("zone", campaignZoneMapping[e.CampaignID])
-
-						if status, _ := dm.UpdateDevice(stdlib.GetString(APPLICATION_ID, "bobbycar"), device, false); status == http.StatusNoContent {
-							log.Trace().Str("vin", e.VIN).Str("campaign", e.CampaignID).Str("executionId", e.CampaignExecutionID).Msg(e.Status)
-						} else {
-							log.Error().Str("vin", e.VIN).Str("campaign", e.CampaignID).Str("executionId", e.CampaignExecutionID).Int("http", status).Msg("device not updated")
-						}
-					} else {
-						log.Warn().Str("vin", e.VIN).Msg("device not found")
-					}
+		if ctx.Err() != nil {
+			return
+		}
+
+		cctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+		_, exec, err := cm.GetCampaignExecutionWithContext(cctx, campaignId)
+		cancel()
+
+		if err != nil {
+			log.Error().Str("campaign", campaignId).Err(err).Msg("campaign executions not available")
+		} else if len(exec) > 0 {
+			for _, e := range exec {
+				uctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+				status, err := dm.PatchDeviceWithContext(uctx, application, e.VIN, drogue.MergePatchType, drogue.NewMetadataPatch(
+					map[string]string{"zone": campaignZoneMapping[e.CampaignID]},
+					map[string]string{
+						"campaign":       e.CampaignID,
+						"campaignStatus": e.Status,
+					},
+				))
+				cancel()
+
+				if err == nil {
+					log.Trace().Str("vin", e.VIN).Str("campaign", e.CampaignID).Str("executionId", e.CampaignExecutionID).Msg(e.Status)
+
+					// the vehicle is registered, the shadow service would create a shadow for any VIN
+					reportCampaignStatus(ctx, e.VIN, e.CampaignID, e.Status)
+				} else if internal.IsNotFound(err) {
+					log.Warn().Str("vin", e.VIN).Msg("device not found")
+				} else {
+					log.Error().Str("vin", e.VIN).Str("campaign", e.CampaignID).Str("executionId", e.CampaignExecutionID).Int("http", status).Err(err).Msg("device not updated")
 				}
 			}
 		}
 	}
 }
 
+// shadow bookkeeping, failures are logged and never stop a campaign
+
+// reportZone updates the vehicle's zone and returns its shadow, nil if the shadow is not available
+func reportZone(ctx context.Context, vin, zone string) *shadow.Shadow {
+	if sc == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+	defer cancel()
+
+	status, s, err := sc.ReportWithContext(ctx, vin, &shadow.ReportedState{Zone: zone})
+	if err != nil {
+		log.Warn().Str("vin", vin).Str("zone", zone).Int("http", status).Err(err).Msg("shadow not updated")
+		return nil
+	}
+	return s
+}
+
+func setDesiredCampaign(ctx context.Context, vin, campaign string) {
+	if sc == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+	defer cancel()
+
+	status, _, err := sc.SetDesiredWithContext(ctx, vin, &shadow.DesiredState{Campaign: campaign})
+	if err != nil {
+		log.Warn().Str("vin", vin).Str("campaign", campaign).Int("http", status).Err(err).Msg("shadow not updated")
+	}
+}
+
+func reportCampaignStatus(ctx context.Context, vin, campaign, campaignStatus string) {
+	if sc == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+	defer cancel()
+
+	status, _, err := sc.ReportWithContext(ctx, vin, &shadow.ReportedState{
+		Campaign:       campaign,
+		CampaignStatus: campaignStatus,
+	})
+	if err != nil {
+		log.Warn().Str("vin", vin).Str("campaign", campaign).Int("http", status).Err(err).Msg("shadow not updated")
+	}
+}
+
 // http endpoint setup
 
-func startHttpListener() {
+func startHttpListener(ctx context.Context) {
 	// create a new router instance
 	e := echo.New()
 	e.HideBanner = true
@@ -263,8 +454,20 @@ func startHttpListener() {
 	e.GET("/", api.DefaultEndpoint)
 	e.GET("/api/registry/apps/:applicationid/devices/:deviceid", getDeviceEndpoint)
 
+	// shutdown the listener once ctx is cancelled
+	go func() {
+		<-ctx.Done()
+		log.Warn().Msg("shutting down")
+
+		sctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+		defer cancel()
+		e.Shutdown(sctx)
+	}()
+
 	port := fmt.Sprintf(":%s", stringsx.TakeOne(stdlib.GetString(PORT_ENV, ""), PORT_DEFAULT))
-	log.Fatal().Err(e.Start(port)).Msg("fuck")
+	if err := e.Start(port); err != http.ErrServerClosed {
+		log.Fatal().Err(err).Msg("fuck")
+	}
 }
 
 // handler
@@ -279,8 +482,11 @@ func getDeviceEndpoint(c echo.Context) error {
 		return api.ErrorResponse(c, http.StatusBadRequest, api.ErrInvalidRoute, "deviceid")
 	}
 
-	status, device := dm.GetDevice(applicationId, deviceId)
-	if status != http.StatusOK {
+	_, device, err := dm.GetDeviceWithContext(c.Request().Context(), applicationId, deviceId)
+	if err != nil {
+		if internal.IsNotFound(err) {
+			return api.ErrorResponse(c, http.StatusNotFound, err, "device not found")
+		}
 		return api.ErrorResponse(c, http.StatusBadRequest, api.ErrInternalError, "device not found")
 	}
 